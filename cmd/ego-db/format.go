@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+/*format.go 键值对的文本表示：JSON lines或hex*/
+
+const (
+	formatJSON = "json"
+	formatHex  = "hex"
+)
+
+// maxLineSize 导入时单行的最大长度
+const maxLineSize = 64 << 20
+
+// record JSON lines中的一行。key/value为UTF-8文本，不是合法UTF-8的数据改用key_hex/value_hex
+type record struct {
+	Key      *string `json:"key,omitempty"`
+	KeyHex   string  `json:"key_hex,omitempty"`
+	Value    *string `json:"value,omitempty"`
+	ValueHex string  `json:"value_hex,omitempty"`
+}
+
+// codec 按格式解析命令行参数、输出与读入键值对
+type codec struct {
+	format string
+}
+
+func newCodec(format string) (*codec, error) {
+	if format != formatJSON && format != formatHex {
+		return nil, fmt.Errorf("unknown format %q, want %s or %s", format, formatJSON, formatHex)
+	}
+	return &codec{format: format}, nil
+}
+
+// arg 解析命令行中的key或value：hex格式下为十六进制，否则为原始文本
+func (c *codec) arg(s string) ([]byte, error) {
+	if c.format == formatHex {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex %q: %v", s, err)
+		}
+		return b, nil
+	}
+	return []byte(s), nil
+}
+
+// value 单独输出一个值
+func (c *codec) value(w io.Writer, v []byte) error {
+	if c.format == formatHex {
+		_, err := fmt.Fprintln(w, hex.EncodeToString(v))
+		return err
+	}
+	_, err := fmt.Fprintln(w, string(v))
+	return err
+}
+
+// writeKV 输出一行键值对，value为nil时只输出key。hex格式下空value同样只输出key，读入时视为空value
+func (c *codec) writeKV(w io.Writer, k, v []byte) error {
+	if c.format == formatHex {
+		line := hex.EncodeToString(k)
+		if len(v) > 0 {
+			line += " " + hex.EncodeToString(v)
+		}
+		_, err := fmt.Fprintln(w, line)
+		return err
+	}
+
+	var r record
+	if utf8.Valid(k) {
+		s := string(k)
+		r.Key = &s
+	} else {
+		r.KeyHex = hex.EncodeToString(k)
+	}
+	if v != nil {
+		if utf8.Valid(v) {
+			s := string(v)
+			r.Value = &s
+		} else {
+			r.ValueHex = hex.EncodeToString(v)
+		}
+	}
+	line, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", line)
+	return err
+}
+
+// readKVs 逐行读入键值对交给fn，空行忽略
+func (c *codec) readKVs(r io.Reader, fn func(k, v []byte) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for line := 1; sc.Scan(); line++ {
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		k, v, err := c.parseLine(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err = fn(k, v); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (c *codec) parseLine(line []byte) ([]byte, []byte, error) {
+	if c.format == formatHex {
+		fields := bytes.Fields(line)
+		if len(fields) != 1 && len(fields) != 2 {
+			return nil, nil, fmt.Errorf("want \"<hex key> [hex value]\", got %d fields", len(fields))
+		}
+		k, err := hex.DecodeString(string(fields[0]))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(fields) == 1 { // 没有value表示空value
+			return k, []byte{}, nil
+		}
+		v, err := hex.DecodeString(string(fields[1]))
+		return k, v, err
+	}
+
+	var r record
+	if err := json.Unmarshal(line, &r); err != nil {
+		return nil, nil, err
+	}
+	k, err := pick(r.Key, r.KeyHex)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(k) == 0 {
+		return nil, nil, fmt.Errorf("missing key")
+	}
+	v, err := pick(r.Value, r.ValueHex)
+	return k, v, err
+}
+
+// pick 取文本或hex表示中出现的那一个
+func pick(text *string, hexText string) ([]byte, error) {
+	if text != nil {
+		return []byte(*text), nil
+	}
+	return hex.DecodeString(hexText)
+}
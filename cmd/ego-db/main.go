@@ -0,0 +1,389 @@
+// Command ego-db 查看与维护edatabase数据库的命令行工具。
+//
+// 用法：
+//
+//	ego-db [-engine badger] -path DIR [-format json|hex] <command> [args]
+//
+// 只读的命令(get/scan/count/dump/size)以只读方式打开数据库，不会修改其中的数据。
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/azd1997/ego/edatabase"
+)
+
+// loadBatchSize load每批写入的键值对数
+const loadBatchSize = 1000
+
+// env 命令的运行环境
+type env struct {
+	codec  *codec
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// command 一个子命令
+type command struct {
+	name     string
+	args     string // 参数说明
+	help     string
+	readOnly bool
+	run      func(db edatabase.Database, args []string, e *env) error
+}
+
+var commands = []*command{
+	{name: "get", args: "KEY", help: "print the value of KEY", readOnly: true, run: runGet},
+	{name: "set", args: "[-ttl DURATION] KEY VALUE", help: "set KEY to VALUE", run: runSet},
+	{name: "delete", args: "KEY...", help: "delete keys", run: runDelete},
+	{name: "scan", args: "[-prefix P] [-limit N] [-keys-only]", help: "print key-value pairs", readOnly: true, run: runScan},
+	{name: "count", args: "[-prefix P]", help: "count keys", readOnly: true, run: runCount},
+	{name: "dump", args: "[-prefix P] [-o FILE]", help: "export key-value pairs, one per line", readOnly: true, run: runDump},
+	{name: "load", args: "[-i FILE]", help: "import key-value pairs written by dump", run: runLoad},
+	{name: "size", help: "print the size of LSM tree and value log", readOnly: true, run: runSize},
+	{name: "gc", args: "[-ratio R]", help: "run value log garbage collection", run: runGC},
+}
+
+// errUsage 子命令的参数错误，由run输出该命令的用法
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run 执行一次命令，返回进程退出码：0成功，1执行出错，2用法错误
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ego-db", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	engine := fs.String("engine", "badger", "database engine: "+strings.Join(edatabase.Engines(), ", "))
+	path := fs.String("path", "", "database directory")
+	format := fs.String("format", formatJSON, "key/value format: json or hex")
+	fs.Usage = func() { usage(fs, stderr) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 || *path == "" {
+		fs.Usage()
+		return 2
+	}
+	cmd := lookup(fs.Arg(0))
+	if cmd == nil {
+		fmt.Fprintf(stderr, "ego-db: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+	c, err := newCodec(*format)
+	if err != nil {
+		fmt.Fprintln(stderr, "ego-db:", err)
+		return 2
+	}
+
+	db, err := open(*engine, *path, cmd.readOnly, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "ego-db:", err)
+		return 1
+	}
+	err = cmd.run(db, fs.Args()[1:], &env{codec: c, stdin: stdin, stdout: stdout})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err == errUsage:
+		fmt.Fprintf(stderr, "usage: ego-db [flags] %s %s\n", cmd.name, cmd.args)
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "ego-db %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(fs *flag.FlagSet, w io.Writer) {
+	fmt.Fprintln(w, "usage: ego-db [flags] <command> [args]")
+	fmt.Fprintln(w, "\nflags:")
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-7s %-36s %s\n", cmd.name, cmd.args, cmd.help)
+	}
+}
+
+func lookup(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// open 打开数据库。数据库不存在时报错而不是新建一个空库
+func open(engine, path string, readOnly bool, stderr io.Writer) (edatabase.Database, error) {
+	exists, err := edatabase.DbExists(engine, path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && engine != "memory" {
+		return nil, fmt.Errorf("%w: %s", edatabase.ErrNotFound, path)
+	}
+	opts := edatabase.DefaultOptions()
+	opts.ReadOnly = readOnly
+	opts.Logger = quietLogger{w: stderr}
+	return edatabase.OpenDatabaseWithOptions(engine, path, opts)
+}
+
+// quietLogger 只输出引擎的警告与错误，避免淹没命令的输出
+type quietLogger struct {
+	w io.Writer
+}
+
+func (l quietLogger) Errorf(format string, args ...interface{}) {
+	fmt.Fprintf(l.w, "ERROR: "+format, args...)
+}
+
+func (l quietLogger) Warningf(format string, args ...interface{}) {
+	fmt.Fprintf(l.w, "WARNING: "+format, args...)
+}
+
+func (quietLogger) Infof(string, ...interface{}) {}
+
+func (quietLogger) Debugf(string, ...interface{}) {}
+
+// parseFlags 解析子命令的参数，出错时返回errUsage
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	return nil
+}
+
+func runGet(db edatabase.Database, args []string, e *env) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	k, err := e.codec.arg(args[0])
+	if err != nil {
+		return err
+	}
+	v, err := db.Get(k)
+	if err != nil {
+		return err
+	}
+	return e.codec.value(e.stdout, v)
+}
+
+func runSet(db edatabase.Database, args []string, e *env) error {
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "time to live, 0 means never expire")
+	if err := parseFlags(fs, args); err != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+	k, err := e.codec.arg(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	v, err := e.codec.arg(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *ttl > 0 {
+		return db.SetWithTTL(k, v, time.Now().Add(*ttl).Unix())
+	}
+	return db.Set(k, v)
+}
+
+func runDelete(db edatabase.Database, args []string, e *env) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	keys := make([][]byte, len(args))
+	for i, arg := range args {
+		k, err := e.codec.arg(arg)
+		if err != nil {
+			return err
+		}
+		keys[i] = k
+	}
+	return db.BatchDelete(keys)
+}
+
+// iterate 遍历以prefix开头的键值对。IterPrefix无法中途停止，fn返回错误后剩余的键值对直接跳过
+func iterate(db edatabase.Database, prefix []byte, fn func(k, v []byte) error) error {
+	var err error
+	db.IterPrefix(prefix, func(k, v []byte) error {
+		if err == nil {
+			err = fn(k, v)
+		}
+		return err
+	})
+	return err
+}
+
+// errStop 用于提前结束遍历
+var errStop = errors.New("stop")
+
+func runScan(db edatabase.Database, args []string, e *env) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only keys with this prefix")
+	limit := fs.Int("limit", 0, "print at most N pairs, 0 means no limit")
+	keysOnly := fs.Bool("keys-only", false, "print keys only")
+	if err := parseFlags(fs, args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	p, err := e.codec.arg(*prefix)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	err = iterate(db, p, func(k, v []byte) error {
+		if *limit > 0 && n >= *limit {
+			return errStop
+		}
+		n++
+		if *keysOnly {
+			v = nil
+		} else if v == nil {
+			v = []byte{}
+		}
+		return e.codec.writeKV(e.stdout, k, v)
+	})
+	if err == errStop {
+		err = nil
+	}
+	return err
+}
+
+func runCount(db edatabase.Database, args []string, e *env) error {
+	fs := flag.NewFlagSet("count", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only keys with this prefix")
+	if err := parseFlags(fs, args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	p, err := e.codec.arg(*prefix)
+	if err != nil {
+		return err
+	}
+	n := db.IterPrefix(p, func(k, v []byte) error { return nil })
+	_, err = fmt.Fprintln(e.stdout, n)
+	return err
+}
+
+func runDump(db edatabase.Database, args []string, e *env) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only keys with this prefix")
+	output := fs.String("o", "", "output file, default stdout")
+	if err := parseFlags(fs, args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	p, err := e.codec.arg(*prefix)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return dump(db, p, e.codec, e.stdout)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err = dump(db, p, e.codec, f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func dump(db edatabase.Database, prefix []byte, c *codec, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	err := iterate(db, prefix, func(k, v []byte) error {
+		if v == nil {
+			v = []byte{}
+		}
+		return c.writeKV(bw, k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func runLoad(db edatabase.Database, args []string, e *env) error {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	input := fs.String("i", "", "input file, default stdin")
+	if err := parseFlags(fs, args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	r := e.stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	total := 0
+	keys := make([][]byte, 0, loadBatchSize)
+	values := make([][]byte, 0, loadBatchSize)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := db.BatchSet(keys, values); err != nil {
+			return err
+		}
+		total += len(keys)
+		keys, values = keys[:0], values[:0]
+		return nil
+	}
+	err := e.codec.readKVs(r, func(k, v []byte) error {
+		keys, values = append(keys, k), append(values, v)
+		if len(keys) < loadBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	fmt.Fprintf(e.stdout, "loaded %d keys\n", total)
+	return err
+}
+
+func runSize(db edatabase.Database, args []string, e *env) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	lsm, vlog := db.Size()
+	_, err := fmt.Fprintf(e.stdout, "lsm: %d\nvlog: %d\n", lsm, vlog)
+	return err
+}
+
+func runGC(db edatabase.Database, args []string, e *env) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	ratio := fs.Float64("ratio", edatabase.DefaultGCDiscardRatio, "rewrite value log files with at least this fraction of garbage")
+	if err := parseFlags(fs, args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	n, err := db.RunGC(*ratio)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.stdout, "rewrote %d value log files\n", n)
+	return err
+}
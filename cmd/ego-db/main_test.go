@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/azd1997/ego/edatabase"
+)
+
+// egoDb 执行一次命令，返回退出码与标准输出
+func egoDb(t *testing.T, stdin string, args ...string) (int, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	if code != 0 {
+		t.Logf("ego-db %v: exit %d: %s", args, code, stderr.String())
+	}
+	return code, stdout.String()
+}
+
+func newTestDb(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ego-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := edatabase.OpenDatabase("badger", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	keys := [][]byte{[]byte("user/1"), []byte("user/2"), []byte("order/1"), {0xff, 0x00}}
+	values := [][]byte{[]byte("alice"), []byte("bob"), []byte("book"), {0x01, 0xfe}}
+	if err = db.BatchSet(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReadCommands(t *testing.T) {
+	dir := newTestDb(t)
+
+	if code, out := egoDb(t, "", "-path", dir, "get", "user/1"); code != 0 || out != "alice\n" {
+		t.Fatalf("get = %d, %q", code, out)
+	}
+	if code, _ := egoDb(t, "", "-path", dir, "get", "missing"); code != 1 {
+		t.Fatalf("get missing key exit %d, want 1", code)
+	}
+	if code, out := egoDb(t, "", "-path", dir, "-format", "hex", "get", "ff00"); code != 0 || out != "01fe\n" {
+		t.Fatalf("get hex = %d, %q", code, out)
+	}
+
+	want := `{"key":"user/1","value":"alice"}` + "\n" + `{"key":"user/2","value":"bob"}` + "\n"
+	if code, out := egoDb(t, "", "-path", dir, "scan", "--prefix", "user/"); code != 0 || out != want {
+		t.Fatalf("scan = %d, %q, want %q", code, out, want)
+	}
+	if code, out := egoDb(t, "", "-path", dir, "scan", "-keys-only", "-limit", "1"); code != 0 || out != `{"key":"order/1"}`+"\n" {
+		t.Fatalf("scan -keys-only -limit 1 = %d, %q", code, out)
+	}
+	if code, out := egoDb(t, "", "-path", dir, "count"); code != 0 || out != "4\n" {
+		t.Fatalf("count = %d, %q", code, out)
+	}
+	if code, out := egoDb(t, "", "-path", dir, "count", "-prefix", "user/"); code != 0 || out != "2\n" {
+		t.Fatalf("count -prefix = %d, %q", code, out)
+	}
+	if code, out := egoDb(t, "", "-path", dir, "size"); code != 0 || !strings.HasPrefix(out, "lsm: ") {
+		t.Fatalf("size = %d, %q", code, out)
+	}
+
+	// 参数错误与数据库不存在
+	if code, _ := egoDb(t, "", "-path", dir, "get"); code != 2 {
+		t.Fatalf("get without key exit %d, want 2", code)
+	}
+	if code, _ := egoDb(t, "", "-path", dir, "unknown"); code != 2 {
+		t.Fatalf("unknown command exit %d, want 2", code)
+	}
+	if code, _ := egoDb(t, "", "-path", filepath.Join(dir, "missing"), "count"); code != 1 {
+		t.Fatalf("missing database exit %d, want 1", code)
+	}
+}
+
+func TestWriteCommands(t *testing.T) {
+	dir := newTestDb(t)
+
+	if code, _ := egoDb(t, "", "-path", dir, "set", "-ttl", "1h", "session", "xyz"); code != 0 {
+		t.Fatal("set failed")
+	}
+	if code, out := egoDb(t, "", "-path", dir, "get", "session"); code != 0 || out != "xyz\n" {
+		t.Fatalf("get after set = %d, %q", code, out)
+	}
+	if code, _ := egoDb(t, "", "-path", dir, "delete", "session", "user/2"); code != 0 {
+		t.Fatal("delete failed")
+	}
+	if code, out := egoDb(t, "", "-path", dir, "count"); code != 0 || out != "3\n" {
+		t.Fatalf("count after delete = %d, %q", code, out)
+	}
+	if code, out := egoDb(t, "", "-path", dir, "gc", "-ratio", "0.5"); code != 0 || !strings.HasPrefix(out, "rewrote ") {
+		t.Fatalf("gc = %d, %q", code, out)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	for _, format := range []string{formatJSON, formatHex} {
+		src := newTestDb(t)
+		if code, _ := egoDb(t, "", "-path", src, "set", "empty", ""); code != 0 {
+			t.Fatal("set empty value failed")
+		}
+		code, dump := egoDb(t, "", "-path", src, "-format", format, "dump")
+		if code != 0 || strings.Count(dump, "\n") != 5 {
+			t.Fatalf("%s dump = %d, %q", format, code, dump)
+		}
+
+		// 导入到另一个数据库后再导出，内容应当一致
+		dst := newTestDb(t)
+		egoDb(t, "", "-path", dst, "delete", "user/1", "user/2", "order/1", "\xff\x00")
+		if code, out := egoDb(t, dump, "-path", dst, "-format", format, "load"); code != 0 || out != "loaded 5 keys\n" {
+			t.Fatalf("%s load = %d, %q", format, code, out)
+		}
+		if code, out := egoDb(t, "", "-path", dst, "get", "empty"); code != 0 || out != "\n" {
+			t.Fatalf("%s get empty value after load = %d, %q", format, code, out)
+		}
+		file := filepath.Join(dst, "dump.txt")
+		if code, _ := egoDb(t, "", "-path", dst, "-format", format, "dump", "-o", file); code != 0 {
+			t.Fatalf("%s dump -o failed", format)
+		}
+		if again, err := ioutil.ReadFile(file); err != nil || string(again) != dump {
+			t.Fatalf("%s round trip = %q, %v, want %q", format, again, err, dump)
+		}
+	}
+
+	dir := newTestDb(t)
+	if code, _ := egoDb(t, "not json\n", "-path", dir, "load"); code != 1 {
+		t.Fatalf("load of malformed input exit %d, want 1", code)
+	}
+}
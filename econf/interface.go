@@ -12,3 +12,10 @@ type IConfig interface {
 	// Reload 重新加载配置
 	Reload() error
 }
+
+// IUnmarshaler 能把配置段直接解析到结构体的配置器。与IConfig分开，已有的IConfig实现不需要改动
+type IUnmarshaler interface {
+
+	// Unmarshal 把key对应的配置段解析到结构体v中，key为空表示整个配置
+	Unmarshal(key string, v interface{}) error
+}
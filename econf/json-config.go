@@ -1 +1,105 @@
 package econf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// JsonConfig json文件配置器，实现IConfig与IUnmarshaler接口。key使用"."分隔表示层级，如"database.sync_writes"
+type JsonConfig struct {
+	path string
+	data map[string]interface{}
+	mu   sync.RWMutex
+}
+
+// NewJsonConfig 读取json配置文件
+func NewJsonConfig(path string) (*JsonConfig, error) {
+	jc := &JsonConfig{path: path}
+	if err := jc.Reload(); err != nil {
+		return nil, err
+	}
+	return jc, nil
+}
+
+// Get 根据键查值，不存在时返回nil
+func (jc *JsonConfig) Get(key string) (value interface{}) {
+	jc.mu.RLock()
+	defer jc.mu.RUnlock()
+
+	return lookup(jc.data, key)
+}
+
+// Put 修改配置并写回文件
+func (jc *JsonConfig) Put(key string, value interface{}) error {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+
+	parts := strings.Split(key, ".")
+	node := jc.data
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			node[part] = child
+		}
+		node = child
+	}
+	node[parts[len(parts)-1]] = value
+
+	content, err := json.MarshalIndent(jc.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(jc.path, content, 0644)
+}
+
+// Reload 重新从文件加载配置
+func (jc *JsonConfig) Reload() error {
+	content, err := ioutil.ReadFile(jc.path)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]interface{})
+	if err = json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("parse %s: %s", jc.path, err)
+	}
+
+	jc.mu.Lock()
+	jc.data = data
+	jc.mu.Unlock()
+	return nil
+}
+
+// Unmarshal 把key对应的配置段解析到v中。key不存在时v保持不变
+func (jc *JsonConfig) Unmarshal(key string, v interface{}) error {
+	value := jc.Get(key)
+	if value == nil {
+		return nil
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// lookup 按"."分隔的路径在嵌套map中查值
+func lookup(data map[string]interface{}, key string) interface{} {
+	if key == "" {
+		return data
+	}
+	var cur interface{} = data
+	for _, part := range strings.Split(key, ".") {
+		node, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if cur, ok = node[part]; !ok {
+			return nil
+		}
+	}
+	return cur
+}
@@ -35,4 +35,19 @@ func BytesToUint32(b []byte) uint32 {
 	_ = binary.Read(bytesBuffer, binary.BigEndian, &x)
 
 	return x
-}
\ No newline at end of file
+}
+//整形转换成字节
+func Int64ToBytes(n int64) []byte {
+	bytesBuffer := bytes.NewBuffer([]byte{})
+	_ = binary.Write(bytesBuffer, binary.BigEndian, n)
+	return bytesBuffer.Bytes()
+}
+//字节转换成整形
+func BytesToInt64(b []byte) int64 {
+	bytesBuffer := bytes.NewBuffer(b)
+
+	var x int64
+	_ = binary.Read(bytesBuffer, binary.BigEndian, &x)
+
+	return x
+}
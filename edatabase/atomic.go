@@ -0,0 +1,167 @@
+package edatabase
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/azd1997/ego/econvert"
+)
+
+/*atomic.go 基于Update事务实现的原子操作：CompareAndSwap、Increment与Merge。
+各引擎只需实现Update，这里的通用实现即可保证并发写同一个key时不会丢失更新*/
+
+// Txn Update回调中使用的读写事务。回调返回nil时事务中的全部写入原子生效，返回错误时全部丢弃
+type Txn interface {
+	Get(k []byte) ([]byte, error)
+	Has(k []byte) bool
+	Set(k, v []byte) error
+	// SetWithTTL 写入带过期时间的key，expireAt为unix秒
+	SetWithTTL(k, v []byte, expireAt int64) error
+	Delete(k []byte) error
+}
+
+// ExpiryTxn 由能读出key过期时间的事务实现，Increment借此在更新计数器时保留原有的TTL
+type ExpiryTxn interface {
+	// ExpireAt 返回k的过期时间(unix秒)，0表示永不过期。k不存在时返回ErrKeyNotFound
+	ExpireAt(k []byte) (int64, error)
+}
+
+// MergeFunc 合并操作。existing为key当前的值，key不存在时为nil；value为本次要合并进去的值。
+// 返回nil表示删除该key。MergeFunc可能因事务冲突被重复调用，不应有副作用
+type MergeFunc func(existing, value []byte) []byte
+
+// maxTxnRetries 事务冲突时的最大重试次数
+const maxTxnRetries = 100
+
+// 事务冲突后重试前等待时间的下限与上限
+const (
+	minTxnBackoff = 50 * time.Microsecond
+	maxTxnBackoff = 10 * time.Millisecond
+)
+
+// txnBackoff 第attempt次冲突后等待的时间：指数增长并加上随机抖动，避免冲突的事务同时重试又再次冲突
+func txnBackoff(attempt int) time.Duration {
+	d := maxTxnBackoff
+	if attempt < 8 {
+		d = minTxnBackoff << uint(attempt)
+		if d > maxTxnBackoff {
+			d = maxTxnBackoff
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// ErrTxnConflict 事务多次重试后仍然冲突
+var ErrTxnConflict = errors.New("transaction conflict, retries exhausted")
+
+// ErrNotCounter Increment的目标key中保存的不是计数器
+var ErrNotCounter = errors.New("value is not an 8-byte counter")
+
+// MergeAppend 把value追加到已有值之后
+func MergeAppend(existing, value []byte) []byte {
+	return append(append([]byte{}, existing...), value...)
+}
+
+// MergeMax 保留字典序较大的值
+func MergeMax(existing, value []byte) []byte {
+	if bytes.Compare(existing, value) > 0 {
+		return existing
+	}
+	return value
+}
+
+// txnGet 读取key，区分"不存在"与"值为空"：存在时返回的值不为nil
+func txnGet(txn Txn, k []byte) ([]byte, bool, error) {
+	v, err := txn.Get(k)
+	if err == ErrKeyNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v, true, nil
+}
+
+// txnExpireAt 读取k的过期时间，txn不支持读取过期时间时视为永不过期
+func txnExpireAt(txn Txn, k []byte) (int64, error) {
+	if et, ok := txn.(ExpiryTxn); ok {
+		return et.ExpireAt(k)
+	}
+	return 0, nil
+}
+
+// compareAndSwap 当key的当前值等于old时将其设为new。old为nil表示要求key不存在，new为nil表示删除key
+func compareAndSwap(db Database, k, old, new []byte) (bool, error) {
+	swapped := false
+	err := db.Update(func(txn Txn) error {
+		swapped = false
+		cur, found, err := txnGet(txn, k)
+		if err != nil {
+			return err
+		}
+		if (old == nil) == found || !bytes.Equal(cur, old) {
+			return nil
+		}
+		swapped = true
+		if new == nil {
+			return txn.Delete(k)
+		}
+		return txn.Set(k, new)
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+// increment 把key中保存的int64计数器加上delta并返回新值。key不存在时视为0，已存在时保留原有的过期时间
+func increment(db Database, k []byte, delta int64) (int64, error) {
+	var result int64
+	err := db.Update(func(txn Txn) error {
+		cur, found, err := txnGet(txn, k)
+		if err != nil {
+			return err
+		}
+		result = delta
+		var expireAt int64
+		if found {
+			if len(cur) != 8 {
+				return fmt.Errorf("%w: key %q has %d bytes", ErrNotCounter, k, len(cur))
+			}
+			result += econvert.BytesToInt64(cur)
+			if expireAt, err = txnExpireAt(txn, k); err != nil {
+				return err
+			}
+		}
+		return txn.SetWithTTL(k, econvert.Int64ToBytes(result), expireAt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// merge 用fn把value合并到key的当前值上，返回合并后的值
+func merge(db Database, k, value []byte, fn MergeFunc) ([]byte, error) {
+	var result []byte
+	err := db.Update(func(txn Txn) error {
+		cur, _, err := txnGet(txn, k)
+		if err != nil {
+			return err
+		}
+		result = fn(cur, value)
+		if result == nil {
+			return txn.Delete(k)
+		}
+		return txn.Set(k, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
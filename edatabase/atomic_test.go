@@ -0,0 +1,103 @@
+package edatabase
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azd1997/ego/econvert"
+)
+
+// expireAtOf 在事务中读取k的过期时间
+func expireAtOf(t *testing.T, db Database, k string) int64 {
+	var expireAt int64
+	err := db.Update(func(txn Txn) error {
+		var err error
+		expireAt, err = txn.(ExpiryTxn).ExpireAt([]byte(k))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expireAt
+}
+
+func checkAtomic(t *testing.T, db Database) {
+	const workers, loop = 10, 50
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < loop; j++ {
+				if _, err := db.Increment([]byte("counter"), 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := db.Increment([]byte("counter"), 0); err != nil || n != workers*loop {
+		t.Fatalf("counter = %d, %v, want %d", n, err, workers*loop)
+	}
+
+	// 计数器原有的过期时间在Increment后保留
+	expireAt := time.Now().Add(time.Hour).Unix()
+	if err := db.SetWithTTL([]byte("ttl-counter"), econvert.Int64ToBytes(1), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Increment([]byte("ttl-counter"), 1); err != nil || n != 2 {
+		t.Fatalf("ttl-counter = %d, %v, want 2", n, err)
+	}
+	if got := expireAtOf(t, db, "ttl-counter"); got != expireAt {
+		t.Fatalf("ttl-counter expires at %d after Increment, want %d", got, expireAt)
+	}
+
+	// old为nil要求key不存在
+	if ok, err := db.CompareAndSwap([]byte("version"), nil, []byte("1")); !ok || err != nil {
+		t.Fatalf("CAS on missing key got %v, %v", ok, err)
+	}
+	if ok, _ := db.CompareAndSwap([]byte("version"), nil, []byte("1")); ok {
+		t.Fatal("CAS expecting missing key succeeded on existing key")
+	}
+	if ok, _ := db.CompareAndSwap([]byte("version"), []byte("0"), []byte("2")); ok {
+		t.Fatal("CAS with stale old value succeeded")
+	}
+	if ok, _ := db.CompareAndSwap([]byte("version"), []byte("1"), []byte("2")); !ok {
+		t.Fatal("CAS with current old value failed")
+	}
+	if ok, _ := db.CompareAndSwap([]byte("version"), []byte("2"), nil); !ok || db.Has([]byte("version")) {
+		t.Fatal("CAS to nil did not delete the key")
+	}
+
+	if _, err := db.Merge([]byte("log"), []byte("a"), MergeAppend); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Merge([]byte("log"), []byte("b"), MergeAppend); err != nil || string(v) != "ab" {
+		t.Fatalf("merged value = %s, %v", v, err)
+	}
+
+	if err := db.Set([]byte("text"), []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Increment([]byte("text"), 1); !errors.Is(err, ErrNotCounter) {
+		t.Fatalf("Increment on non-counter got %v", err)
+	}
+}
+
+func TestAtomicMemory(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+
+	checkAtomic(t, db)
+	checkAtomic(t, db.Namespace("ns"))
+}
+
+func TestAtomicBadger(t *testing.T) {
+	db, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	checkAtomic(t, db)
+}
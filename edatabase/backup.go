@@ -0,0 +1,130 @@
+package edatabase
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger/pb"
+)
+
+/*backup.go 通用的备份流格式。
+与badger的DB.Backup保持一致：若干个(uint64小端长度 + protobuf编码的KVList)首尾相连，
+因此badger产生的备份可以被其他引擎恢复，反之亦然*/
+
+// kvMetaDelete KV.Meta中的删除标记位，与badger内部的bitDelete相同
+const kvMetaDelete byte = 1 << 0
+
+// backupBatchSize 通用备份时每个KVList包含的最大条目数
+const backupBatchSize = 1000
+
+// writeKVList 把一个KVList按备份流格式写入w
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(list.Size())); err != nil {
+		return err
+	}
+	buf, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// readKVLists 依次读出备份流中的每个KVList并交给fn处理，直到流结束
+func readKVLists(r io.Reader, fn func(list *pb.KVList) error) error {
+	br := bufio.NewReaderSize(r, 16<<10)
+	buf := make([]byte, 1<<10)
+	for {
+		var sz uint64
+		err := binary.Read(br, binary.LittleEndian, &sz)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if uint64(cap(buf)) < sz {
+			buf = make([]byte, sz)
+		}
+		if _, err = io.ReadFull(br, buf[:sz]); err != nil {
+			return err
+		}
+
+		list := &pb.KVList{}
+		if err = list.Unmarshal(buf[:sz]); err != nil {
+			return err
+		}
+		if err = fn(list); err != nil {
+			return err
+		}
+	}
+}
+
+// backupByIter 对不记录版本号的数据库（如命名空间视图）做全量备份，返回的版本号恒为0。
+// 无法做增量备份，since不为0时返回错误
+func backupByIter(db Database, w io.Writer, since uint64) (uint64, error) {
+	if since != 0 {
+		return 0, errors.New("incremental backup is not supported by this database")
+	}
+	var err error
+	list := &pb.KVList{}
+	db.IterDB(func(k, v []byte) error {
+		if err != nil {
+			return err
+		}
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:   append([]byte{}, k...),
+			Value: append([]byte{}, v...),
+		})
+		if len(list.Kv) >= backupBatchSize {
+			err = writeKVList(w, list)
+			list = &pb.KVList{}
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(list.Kv) > 0 {
+		if err = writeKVList(w, list); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// restoreByWrite 把备份流逐条写回db，适用于没有原生导入能力的数据库。
+// badger的备份流中同一key的多个版本按从新到旧排列，因此每个key只恢复版本号最大的一条，
+// 版本号相同(如不记录版本号的视图)时后出现的生效；最新一条是删除标记或已过期时该key不恢复
+func restoreByWrite(db Database, r io.Reader) error {
+	now := uint64(time.Now().Unix())
+	applied := make(map[string]uint64)
+	return readKVLists(r, func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			if version, ok := applied[string(kv.Key)]; ok && kv.Version < version {
+				continue
+			}
+			applied[string(kv.Key)] = kv.Version
+
+			var err error
+			switch {
+			case len(kv.Meta) > 0 && kv.Meta[0]&kvMetaDelete != 0:
+				err = db.Delete(kv.Key)
+			case kv.ExpiresAt > 0 && kv.ExpiresAt <= now:
+				// 备份期间已经过期的数据不再恢复
+				continue
+			case kv.ExpiresAt > 0:
+				err = db.SetWithTTL(kv.Key, kv.Value, int64(kv.ExpiresAt))
+			default:
+				err = db.Set(kv.Key, kv.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,186 @@
+package edatabase
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src, closeSrc := openTempBadger(t)
+	defer closeSrc()
+
+	if err := src.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var full bytes.Buffer
+	since, err := src.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = src.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = src.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	var incr bytes.Buffer
+	if _, err = src.Backup(&incr, since+1); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, closeDst := openTempBadger(t)
+	defer closeDst()
+
+	if err = dst.Restore(&full); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("after full restore a = %s, %v", v, err)
+	}
+	if err = dst.Restore(&incr); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Has([]byte("a")) {
+		t.Fatal("delete not restored from incremental backup")
+	}
+	if v, err := dst.Get([]byte("b")); err != nil || string(v) != "2" {
+		t.Fatalf("after incremental restore b = %s, %v", v, err)
+	}
+}
+
+func TestBackupRestoreAcrossEngines(t *testing.T) {
+	src, closeSrc := openTempBadger(t)
+	defer closeSrc()
+
+	// badger的备份流中包含每个key的全部版本
+	for _, v := range []string{"v1", "v2"} {
+		if err := src.Set([]byte("k"), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = src.Set([]byte("gone"), []byte("1"))
+	_ = src.Delete([]byte("gone"))
+
+	var buf bytes.Buffer
+	if _, err := src.Backup(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	dst, _ := OpenDatabase("memory", "")
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.Get([]byte("k")); err != nil || string(v) != "v2" {
+		t.Fatalf("k = %s, %v, want the newest version", v, err)
+	}
+	if dst.Has([]byte("gone")) {
+		t.Fatal("deleted key restored from an older version")
+	}
+}
+
+func TestMemoryTombstoneGC(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+	md := db.(*memoryDb)
+
+	// 没有备份过时墓碑直接回收
+	_ = db.Set([]byte("a"), []byte("1"))
+	_ = db.Delete([]byte("a"))
+	if n, _ := db.RunGC(0.5); n != 1 || len(md.data) != 0 {
+		t.Fatalf("RunGC removed %d, %d entries left", n, len(md.data))
+	}
+
+	_ = db.Set([]byte("b"), []byte("2"))
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 备份之后的墓碑留给下一次增量备份
+	_ = db.Delete([]byte("b"))
+	if n, _ := db.RunGC(0.5); n != 0 {
+		t.Fatalf("RunGC removed %d tombstones not yet backed up", n)
+	}
+	var incr bytes.Buffer
+	if _, err = db.Backup(&incr, since+1); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.RunGC(0.5); n != 1 || len(md.data) != 0 {
+		t.Fatalf("RunGC removed %d, %d entries left", n, len(md.data))
+	}
+
+	dst, _ := OpenDatabase("memory", "")
+	defer dst.Close()
+	if err = dst.Restore(&full); err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.Restore(&incr); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Has([]byte("b")) {
+		t.Fatal("delete not restored from incremental backup")
+	}
+}
+
+func TestNamespaceBackupRestore(t *testing.T) {
+	db, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	src := db.Namespace("src")
+	if err := src.BatchSet([][]byte{[]byte("x"), []byte("y")}, [][]byte{[]byte("1"), []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := src.Backup(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := src.Backup(&bytes.Buffer{}, 1); err == nil {
+		t.Fatal("namespace should reject incremental backup")
+	}
+
+	dst := db.Namespace("dst")
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := dst.IterDB(func(k, v []byte) error { return nil }); n != 2 {
+		t.Fatalf("restored %d keys into dst, want 2", n)
+	}
+	if v, err := dst.Get([]byte("y")); err != nil || string(v) != "2" {
+		t.Fatalf("dst y = %s, %v", v, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	if err := db.Set([]byte("k"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	if err = db.Set([]byte("k"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := snap.Get([]byte("k")); err != nil || string(v) != "old" {
+		t.Fatalf("snapshot k = %s, %v", v, err)
+	}
+	if snap.Has([]byte("k2")) {
+		t.Fatal("write after snapshot is visible")
+	}
+	if v, err := db.Get([]byte("k")); err != nil || string(v) != "new" {
+		t.Fatalf("db k = %s, %v", v, err)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -39,6 +42,84 @@ func prepareData(n int) src {
 	return src{Data: data, Checksum: hex.EncodeToString(checksum[:])}
 }
 
+// openTempBadger 在临时目录中打开一个badger数据库，返回的函数负责关闭并清理
+func openTempBadger(t *testing.T) (Database, func()) {
+	dir, err := ioutil.TempDir("", "edatabase-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase("badger", filepath.Join(dir, "db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// checkDatabase 所有Database实现都应通过的基本功能检查
+func checkDatabase(t *testing.T, db Database) {
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get a = %s, %v", v, err)
+	}
+	if _, err := db.Get([]byte("missing")); err != ErrKeyNotFound {
+		t.Fatalf("Get missing key got err %v, want ErrKeyNotFound", err)
+	}
+
+	keys := [][]byte{[]byte("p/1"), []byte("p/2"), []byte("q/1")}
+	values := [][]byte{[]byte("x"), []byte("y"), []byte("z")}
+	if err := db.BatchSet(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := db.BatchGet(keys)
+	for i := range keys {
+		if string(got[i]) != string(values[i]) {
+			t.Fatalf("BatchGet %s = %s, want %s", keys[i], got[i], values[i])
+		}
+	}
+
+	prefixed := make([]string, 0)
+	db.IterPrefix([]byte("p/"), func(k, v []byte) error {
+		prefixed = append(prefixed, string(k))
+		return nil
+	})
+	if len(prefixed) != 2 || prefixed[0] != "p/1" || prefixed[1] != "p/2" {
+		t.Fatalf("IterPrefix got %v", prefixed)
+	}
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	if err := db.SetWithTTL([]byte("ttl"), []byte("t"), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Has([]byte("ttl")) {
+		t.Fatal("key with ttl not found")
+	}
+
+	if err := db.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Has([]byte("a")) {
+		t.Fatal("deleted key still exists")
+	}
+	if err := db.BatchDelete(keys); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.IterKey(func(k []byte) error { return nil }); n != 1 {
+		t.Fatalf("IterKey counted %d keys, want 1", n)
+	}
+	if err := db.DropPrefix([]byte("ttl")); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.IterDB(func(k, v []byte) error { return nil }); n != 0 {
+		t.Fatalf("IterDB counted %d keys after DropPrefix, want 0", n)
+	}
+}
+
 func writeAndGet(db Database, parallel int) {
 	var writeTime int64
 	var readTime int64
@@ -124,7 +205,10 @@ func batchWriteAndGet(db Database, parallel int) {
 }
 
 func TestBadger(t *testing.T) {
-	badger, _ := OpenDatabase("badger", "tmp/badgerdb")
+	badger, err := OpenDatabase("badger", filepath.Join(t.TempDir(), "badgerdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer badger.Close()
 	fmt.Println("badger opened")
 
@@ -145,6 +229,18 @@ func TestBadger(t *testing.T) {
 	})
 }
 
+func TestMemory(t *testing.T) {
+	db, err := OpenDatabase("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	checkDatabase(t, db)
+	checkDatabase(t, db.Namespace("ns"))
+	writeAndGet(db, 10)
+}
+
 func TestRocks(t *testing.T) {
 	rocks, _ := OpenDatabase("rocks", "/tmp/rocks")
 	writeAndGet(rocks, 1)
@@ -1,76 +1,113 @@
 package edatabase
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"sync/atomic"
 	"time"
 
+	"github.com/azd1997/ego/utils"
 	"github.com/dgraph-io/badger"
 	"github.com/pkg/errors"
 )
 
 type badgerDb struct {
-	db *badger.DB
-}
-
-// 设置Badger选项
-/*var badgerOptions = badger.Options{
-	DoNotCompact:        false,    //LSM tree最主要的性能消耗在于 compaction 过程：多个文件需要读进内存，排序，然后再写回磁盘
-	LevelOneSize:        64 << 20, //第一层大小
-	LevelSizeMultiplier: 10,       //下一层是上一层的多少倍
-	MaxLevels:           7,        //LSM tree最多几层
-	//key存在内存中，values(实际上value指针)存在磁盘中--称为vlog file
-	TableLoadingMode:        options.MemoryMap, //LSM tree完全载入内存
-	ValueLogLoadingMode:     options.FileIO,    //使用FileIO而非MemoryMap可以节省大量内存
-	MaxTableSize:            4 << 20,           //4M
-	NumCompactors:           8,                 //compaction线程数
-	NumLevelZeroTables:      4,
-	NumLevelZeroTablesStall: 10,
-	NumMemtables:            4,     //写操作立即反应在MemTable上，当MemTable达到一定的大小时，它被刷新到磁盘，作为一个不可变的SSTable
-	SyncWrites:              false, //异步写磁盘。即实时地去写内存中的LSM tree，当数据量达到MaxTableSize时，才对数据进行compaction然后写入磁盘。当调用Close时也会把内存中的数据flush到磁盘
-	NumVersionsToKeep:       1,
-	ValueLogFileSize:        64 << 20, //单位：字节。vlog文件超过这么大时就分裂文件。64M
-	ValueLogMaxEntries:      100000,
-	ValueThreshold:          32,
-	Truncate:                false,
-}*/
-
-// 开启Badger数据库
-func openBadgerDb(dbPath string) (Database, error) {
+	db  *badger.DB
+	gc  *gcScheduler // 后台GC，未配置时为nil
+	pub *publisher   // 变更订阅
+}
+
+// maxPendingWrites 恢复备份时允许同时进行的写请求数
+const maxPendingWrites = 256
+
+// 开启Badger数据库。badger v1.6不支持内存模式，opts.InMemory时改用内存引擎
+func openBadgerDb(dbPath string, opts *Options) (Database, error) {
+	if opts.InMemory {
+		return openMemoryDb(dbPath, opts)
+	}
+
 	if err := os.MkdirAll(path.Dir(dbPath), os.ModePerm); err != nil { //如果dbPath对应的文件夹已存在则什么都不做，如果dbPath对应的文件已存在则返回错误
 		return nil, err
 	}
 
-	badgerOptions := badger.DefaultOptions(dbPath)
+	badgerOptions, err := opts.badgerOptions(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		// 只读模式不会创建数据库，提前给出明确的错误
+		if exists, err := badgerExists(dbPath); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, dbPath)
+		}
+	}
 
-	db, err := badger.Open(badgerOptions) //文件只能被一个进程使用，如果不调用Close则下次无法Open。手动释放锁的办法：把LOCK文件删掉
+	db, err := badger.Open(badgerOptions) //文件只能被一个进程使用，如果不调用Close则下次无法Open。进程异常退出残留的LOCK文件见OpenDatabaseWithRetry
 	if err != nil {
-		log.Fatal(err)
+		return nil, classifyBadgerError(dbPath, err)
 	}
 
-	return &badgerDb{db}, err
+	bd := &badgerDb{db: db, pub: newPublisher()}
+	bd.gc = startGC(bd, opts)
+	return bd, nil
 }
 
-func (bd *badgerDb) CheckAndGC() {
-	lsmSize1, vlogSize1 := bd.db.Size()
-	for {
-		if err := bd.db.RunValueLogGC(0.5); err == badger.ErrNoRewrite || err == badger.ErrRejected {
-			break
-		}
+// badgerExists 检查badger数据库是否存在：路径为目录且其中有MANIFEST文件
+func badgerExists(dbPath string) (bool, error) {
+
+	// 当读取文件信息无错且文件非路径名时，说明我们确实找到了这个MANIFEST，数据库确实存在
+	// 1.先检查数据库存放的路径存不存在，存在则还要求必须为Dir
+	exists, err := utils.DirExists(dbPath)
+	if err != nil {
+		return false, fmt.Errorf("检查路径是否存在时发生未知错误：%s", err)
 	}
-	lsmSize2, vlogSize2 := bd.db.Size()
-	if vlogSize2 < vlogSize1 {
-		fmt.Printf("badger before GC, LSM %d, vlog %d. after GC, LSM %d, vlog %d\n", lsmSize1, vlogSize1, lsmSize2, vlogSize2)
-	} else {
-		fmt.Println("collect zero garbage")
+	if !exists {
+		return false, nil
+	}
+
+	// 确保了数据库指定的路径存在后，检查数据库MANIFEST文件是否存在
+	exists, err = utils.FileExists(filepath.Join(dbPath, "MANIFEST"))
+	if err != nil {
+		return false, fmt.Errorf("检查数据库MANIFEST文件是否存在时发生未知错误：%s", err)
 	}
+	// MANIFEST不存在属于正常情况，程序应返回结果，让调用程序继续向下执行
+	return exists, nil
 }
 
-func (bd *badgerDb) Size() (int64, int64) {
-	return bd.db.Size()
+// afterSets 写入完成后统计写入量并推送变更，locked为写入前pub.begin的返回值
+func (bd *badgerDb) afterSets(locked bool, err error, keys, values [][]byte, expireAts []int64) {
+	bd.gc.noteWrites(len(keys))
+	var kvs []*KV
+	if locked && err == nil {
+		kvs = setKVs(keys, values, expireAts)
+	}
+	bd.pub.end(locked, kvs)
+}
+
+// afterDeletes 删除完成后统计写入量并推送变更，locked为删除前pub.begin的返回值
+func (bd *badgerDb) afterDeletes(locked bool, err error, keys [][]byte) {
+	bd.gc.noteWrites(len(keys))
+	var kvs []*KV
+	if locked && err == nil {
+		kvs = deleteKVs(keys)
+	}
+	bd.pub.end(locked, kvs)
+}
+
+// afterBulk DropPrefix与Restore完成后推送以prefix开头的数据被批量修改的变更
+func (bd *badgerDb) afterBulk(locked bool, err error, prefix []byte) {
+	var kvs []*KV
+	if locked && err == nil {
+		kvs = bulkKVs(prefix)
+	}
+	bd.pub.end(locked, kvs)
 }
 
 /*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
@@ -78,9 +115,11 @@ func (bd *badgerDb) Size() (int64, int64) {
 //Set 为单个写操作开一个事务
 func (bd *badgerDb) Set(k, v []byte) error {
 
+	locked := bd.pub.begin()
 	err := bd.db.Update(func(txn *badger.Txn) error { //db.Update相当于打开了一个读写事务:db.NewTransaction(true)。用db.Update的好处在于不用显式调用Txn.Commit()了
 		return txn.Set(k, v)
 	})
+	bd.afterSets(locked, err, [][]byte{k}, [][]byte{v}, nil)
 	return err
 
 }
@@ -92,6 +131,7 @@ func (bd *badgerDb) BatchSet(keys, values [][]byte) error {
 		return errors.New("key value not the same length")
 	}
 	var err error
+	locked := bd.pub.begin()
 	txn := bd.db.NewTransaction(true)
 	for i, key := range keys {
 		value := values[i]
@@ -102,17 +142,20 @@ func (bd *badgerDb) BatchSet(keys, values [][]byte) error {
 		}
 	}
 	_ = txn.Commit()
+	bd.afterSets(locked, err, keys, values, nil)
 	return err
 }
 
 //Set 为单个写操作开一个事务
 func (bd *badgerDb) SetWithTTL(k, v []byte, expireAt int64) error {
 
+	locked := bd.pub.begin()
 	err := bd.db.Update(func(txn *badger.Txn) error { //db.Update相当于打开了一个读写事务:db.NewTransaction(true)。用db.Update的好处在于不用显式调用Txn.Commit()了
 		duration := time.Duration(expireAt-time.Now().Unix()) * time.Second // duration是数据存活时长
 		e := badger.NewEntry(k, v).WithTTL(duration)
 		return txn.SetEntry(e)
 	})
+	bd.afterSets(locked, err, [][]byte{k}, [][]byte{v}, []int64{expireAt})
 	return err
 
 }
@@ -126,6 +169,7 @@ func (bd *badgerDb) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) er
 	var err error
 	var duration time.Duration
 	var e *badger.Entry
+	locked := bd.pub.begin()
 	txn := bd.db.NewTransaction(true)
 	for i, key := range keys {
 		duration = time.Duration(expireAts[i]-time.Now().Unix()) * time.Second
@@ -137,6 +181,7 @@ func (bd *badgerDb) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) er
 		}
 	}
 	_ = txn.Commit()
+	bd.afterSets(locked, err, keys, values, expireAts)
 	return err
 }
 
@@ -189,15 +234,18 @@ func (bd *badgerDb) BatchGet(keys [][]byte) ([][]byte, error) {
 
 func (bd *badgerDb) Delete(k []byte) error {
 
+	locked := bd.pub.begin()
 	err := bd.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete(k)
 	})
+	bd.afterDeletes(locked, err, [][]byte{k})
 	return err
 }
 
 func (bd *badgerDb) BatchDelete(keys [][]byte) error {
 
 	var err error
+	locked := bd.pub.begin()
 	txn := bd.db.NewTransaction(true)
 	for _, key := range keys {
 		if err = txn.Delete(key); err != nil {
@@ -207,6 +255,7 @@ func (bd *badgerDb) BatchDelete(keys [][]byte) error {
 		}
 	}
 	_ = txn.Commit()
+	bd.afterDeletes(locked, err, keys)
 	return err
 }
 
@@ -279,10 +328,303 @@ func (bd *badgerDb) IterKey(fn func(k []byte) error) int64 {
 	return atomic.LoadInt64(&total)
 }
 
-//Close 把内存中的数据flush到磁盘，同时释放文件锁
+//IterPrefix 只遍历以prefix开头的键值对，利用badger的前缀迭代跳过无关的SSTable
+func (bd *badgerDb) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+
+	return bd.iterRange(prefix, prefix, nil, fn)
+}
+
+//iterRange 从start开始遍历以prefix开头的键值对，遇到不小于end的key时停止，end为nil表示遍历到前缀结束
+func (bd *badgerDb) iterRange(prefix, start, end []byte, fn func(k, v []byte) error) int64 {
+
+	var total int64
+	_ = bd.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if end != nil && bytes.Compare(key, end) >= 0 {
+				break
+			}
+			_ = item.Value(func(val []byte) error {
+				if err := fn(key, val); err != nil {
+					return err
+				}
+				atomic.AddInt64(&total, 1)
+				return nil
+			})
+		}
+		return nil
+	})
+	return atomic.LoadInt64(&total)
+}
+
+//DropPrefix 删除以prefix开头的所有键值对。badger执行期间会短暂阻塞写入
+func (bd *badgerDb) DropPrefix(prefix []byte) error {
+
+	locked := bd.pub.begin()
+	err := bd.db.DropPrefix(prefix)
+	bd.afterBulk(locked, err, prefix)
+	return err
+}
+
+//Namespace 返回命名空间视图
+func (bd *badgerDb) Namespace(name string) Database {
+
+	return newNamespace(bd, name)
+}
+
+//Backup 在线备份，不影响并发读写。since为0时为全量备份，否则只备份版本号不小于since的数据(包括删除标记)
+func (bd *badgerDb) Backup(w io.Writer, since uint64) (uint64, error) {
+
+	return bd.db.Backup(w, since)
+}
+
+//Restore 从备份流恢复。badger要求恢复期间不要有其他并发事务。恢复的数据不逐条推送，订阅者收到一次整个数据库的批量变更
+func (bd *badgerDb) Restore(r io.Reader) error {
+
+	locked := bd.pub.begin()
+	err := bd.db.Load(r, maxPendingWrites)
+	bd.afterBulk(locked, err, nil)
+	return err
+}
+
+//Snapshot 用一个长期存活的只读事务作为快照。快照存续期间value log GC无法回收其可见的数据，用完应尽快Release
+func (bd *badgerDb) Snapshot() (Snapshot, error) {
+
+	return &badgerSnapshot{txn: bd.db.NewTransaction(false)}, nil
+}
+
+//Size 返回LSM tree与value log的大小。badger每分钟更新一次，不是实时值
+func (bd *badgerDb) Size() (int64, int64) {
+
+	return bd.db.Size()
+}
+
+//RunGC 反复执行value log GC直到没有可重写的文件，返回重写的文件数
+func (bd *badgerDb) RunGC(discardRatio float64) (int, error) {
+
+	rewrites := 0
+	for {
+		err := bd.db.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected { //没有可回收的文件，或者已有GC在运行
+			return rewrites, nil
+		}
+		if err != nil {
+			return rewrites, err
+		}
+		rewrites++
+	}
+}
+
+//Update 在读写事务中执行fn，遇到事务冲突时自动重试。
+//fn执行期间不持有任何锁，只有提交与推送变更在提交锁内进行，fn中可以再读写本数据库
+func (bd *badgerDb) Update(fn func(txn Txn) error) error {
+
+	for i := 0; i < maxTxnRetries; i++ {
+		err := bd.updateOnce(fn)
+		if err == badger.ErrConflict { //有其他事务修改了本事务读过的key，退避后重新执行
+			time.Sleep(txnBackoff(i))
+			continue
+		}
+		return err
+	}
+	return ErrTxnConflict
+}
+
+//updateOnce 执行一次事务。fn返回后才获取提交锁，提交成功后按提交顺序推送事务中的写入
+func (bd *badgerDb) updateOnce(fn func(txn Txn) error) error {
+
+	txn := bd.db.NewTransaction(true)
+	defer txn.Discard()
+	bt := &badgerTxn{txn: txn, recorder: &txnRecorder{}}
+	if err := fn(bt); err != nil {
+		return err
+	}
+
+	locked := bd.pub.begin()
+	err := txn.Commit()
+	var kvs []*KV
+	if err == nil {
+		bd.gc.noteWrites(bt.writes)
+		kvs = bt.recorder.kvs
+	}
+	bd.pub.end(locked, kvs)
+	return err
+}
+
+func (bd *badgerDb) CompareAndSwap(k, old, new []byte) (bool, error) {
+
+	return compareAndSwap(bd, k, old, new)
+}
+
+func (bd *badgerDb) Increment(k []byte, delta int64) (int64, error) {
+
+	return increment(bd, k, delta)
+}
+
+func (bd *badgerDb) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+
+	return merge(bd, k, v, fn)
+}
+
+//Subscribe 订阅以prefix开头的key的变更。DropPrefix与Restore以一次批量变更(KV.Bulk)推送
+func (bd *badgerDb) Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+
+	return bd.pub.subscribe(ctx, prefix, fn)
+}
+
+//Close 先停止后台GC与变更订阅，再把内存中的数据flush到磁盘，同时释放文件锁
 func (bd *badgerDb) Close() error {
 
+	bd.gc.close()
+	bd.pub.close()
 	return bd.db.Close()
 }
 
 /*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// badgerSnapshot 基于badger只读事务的快照，实现Snapshot接口
+type badgerSnapshot struct {
+	txn *badger.Txn
+}
+
+func (bs *badgerSnapshot) Get(k []byte) ([]byte, error) {
+
+	item, err := bs.txn.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil) //快照可能长期存活，必须拷贝出value
+}
+
+func (bs *badgerSnapshot) BatchGet(keys [][]byte) ([][]byte, error) {
+
+	var err error
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		var v []byte
+		if v, err = bs.Get(key); err != nil {
+			v = []byte{}
+		}
+		values[i] = v
+	}
+	return values, err
+}
+
+func (bs *badgerSnapshot) Has(k []byte) bool {
+
+	_, err := bs.txn.Get(k)
+	return err == nil
+}
+
+func (bs *badgerSnapshot) IterDB(fn func(k, v []byte) error) int64 {
+
+	return bs.IterPrefix(nil, fn)
+}
+
+func (bs *badgerSnapshot) IterKey(fn func(k []byte) error) int64 {
+
+	var total int64
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := bs.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := fn(it.Item().Key()); err == nil {
+			total++
+		}
+	}
+	return total
+}
+
+func (bs *badgerSnapshot) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+
+	var total int64
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := bs.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		err := item.Value(func(val []byte) error {
+			return fn(key, val)
+		})
+		if err == nil {
+			total++
+		}
+	}
+	return total
+}
+
+//Release 结束只读事务
+func (bs *badgerSnapshot) Release() {
+
+	bs.txn.Discard()
+}
+
+// badgerTxn 对badger读写事务的包装，实现Txn接口
+type badgerTxn struct {
+	txn      *badger.Txn
+	writes   int
+	recorder *txnRecorder // 记录写入，提交时有订阅者则推送
+}
+
+func (bt *badgerTxn) Get(k []byte) ([]byte, error) {
+
+	item, err := bt.txn.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (bt *badgerTxn) Has(k []byte) bool {
+
+	_, err := bt.txn.Get(k)
+	return err == nil
+}
+
+func (bt *badgerTxn) ExpireAt(k []byte) (int64, error) {
+
+	item, err := bt.txn.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	return int64(item.ExpiresAt()), nil
+}
+
+func (bt *badgerTxn) Set(k, v []byte) error {
+
+	bt.writes++
+	if bt.recorder != nil {
+		bt.recorder.set(k, v)
+	}
+	return bt.txn.Set(k, v)
+}
+
+func (bt *badgerTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+
+	bt.writes++
+	if bt.recorder != nil {
+		bt.recorder.setWithTTL(k, v, expireAt)
+	}
+	if expireAt == 0 { //0表示永不过期，与内存引擎一致
+		return bt.txn.Set(k, v)
+	}
+	duration := time.Duration(expireAt-time.Now().Unix()) * time.Second
+	return bt.txn.SetEntry(badger.NewEntry(k, v).WithTTL(duration))
+}
+
+func (bt *badgerTxn) Delete(k []byte) error {
+
+	bt.writes++
+	if bt.recorder != nil {
+		bt.recorder.delete(k)
+	}
+	return bt.txn.Delete(k)
+}
@@ -0,0 +1,481 @@
+package edatabase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/pb"
+)
+
+/*db-memory.go 纯内存数据库引擎，适用于测试和不需要持久化的场景*/
+
+// ErrReadOnly 在只读模式下写入
+var ErrReadOnly = errors.New("database is opened in read-only mode")
+
+// memEntry 内存引擎中的一条记录。删除后保留为墓碑，以便下一次增量备份能带上删除操作，
+// 已经写入过备份的墓碑由RunGC回收
+type memEntry struct {
+	value    []byte
+	expireAt int64 // 过期时间(unix秒)，0表示永不过期
+	version  uint64
+	deleted  bool
+}
+
+func (e *memEntry) alive(now int64) bool {
+	return !e.deleted && (e.expireAt == 0 || e.expireAt > now)
+}
+
+// memKV 遍历时使用的键值对拷贝
+type memKV struct {
+	key   []byte
+	value []byte
+}
+
+type memoryDb struct {
+	mu       sync.RWMutex
+	data     map[string]*memEntry
+	version  uint64 // 最近一次写入的版本号，每次写入加1
+	backedUp uint64 // 最近一次Backup返回的版本号，不大于它的墓碑已经写入过备份
+	readOnly bool
+	pub      *publisher
+}
+
+// 开启内存数据库，path被忽略
+func openMemoryDb(path string, opts *Options) (Database, error) {
+	return &memoryDb{
+		data:     make(map[string]*memEntry),
+		readOnly: opts.ReadOnly,
+		pub:      newPublisher(),
+	}, nil
+}
+
+// put 写入一条记录，调用者需持有写锁
+func (md *memoryDb) put(k, v []byte, expireAt int64) {
+	md.version++
+	md.data[string(k)] = &memEntry{
+		value:    append([]byte{}, v...),
+		expireAt: expireAt,
+		version:  md.version,
+	}
+}
+
+// remove 删除一条记录，调用者需持有写锁
+func (md *memoryDb) remove(k []byte) {
+	md.version++
+	md.data[string(k)] = &memEntry{version: md.version, deleted: true}
+}
+
+// get 读取一条记录，调用者需持有读锁
+func (md *memoryDb) get(k []byte) ([]byte, error) {
+	e, ok := md.data[string(k)]
+	if !ok || !e.alive(time.Now().Unix()) {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, e.value...), nil
+}
+
+// sortedKVs 按key的字典序拷贝出以prefix开头的有效记录。拷贝后再回调，回调中可以安全地读写数据库
+func (md *memoryDb) sortedKVs(prefix []byte) []memKV {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	now := time.Now().Unix()
+	kvs := make([]memKV, 0)
+	for k, e := range md.data {
+		if e.alive(now) && bytes.HasPrefix([]byte(k), prefix) {
+			kvs = append(kvs, memKV{key: []byte(k), value: e.value})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return bytes.Compare(kvs[i].key, kvs[j].key) < 0
+	})
+	return kvs
+}
+
+// afterWrite 写入完成后按提交顺序推送变更并释放提交锁，locked为写入前pub.begin的返回值。
+// 提交锁总是在数据锁之后获取；推送放在数据锁外，订阅者的回调中可以再读写数据库
+func (md *memoryDb) afterWrite(locked bool, changes func() []*KV) {
+	var kvs []*KV
+	if locked {
+		kvs = changes()
+	}
+	md.pub.end(locked, kvs)
+}
+
+/*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
+
+func (md *memoryDb) Set(k, v []byte) error {
+	return md.SetWithTTL(k, v, 0)
+}
+
+func (md *memoryDb) BatchSet(keys, values [][]byte) error {
+	return md.BatchSetWithTTL(keys, values, make([]int64, len(keys)))
+}
+
+// SetWithTTL expireAt为0表示永不过期
+func (md *memoryDb) SetWithTTL(k, v []byte, expireAt int64) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	md.mu.Lock()
+	locked := md.pub.begin()
+	md.put(k, v, expireAt)
+	md.mu.Unlock()
+
+	md.afterWrite(locked, func() []*KV { return setKVs([][]byte{k}, [][]byte{v}, []int64{expireAt}) })
+	return nil
+}
+
+func (md *memoryDb) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	if len(keys) != len(values) || len(keys) != len(expireAts) {
+		return errors.New("key value not the same length")
+	}
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	md.mu.Lock()
+	locked := md.pub.begin()
+	for i, key := range keys {
+		md.put(key, values[i], expireAts[i])
+	}
+	md.mu.Unlock()
+
+	md.afterWrite(locked, func() []*KV { return setKVs(keys, values, expireAts) })
+	return nil
+}
+
+func (md *memoryDb) Get(k []byte) ([]byte, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	return md.get(k)
+}
+
+// BatchGet 与badger引擎一致，不存在的key对应空数组
+func (md *memoryDb) BatchGet(keys [][]byte) ([][]byte, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	var err error
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		var v []byte
+		if v, err = md.get(key); err != nil {
+			v = []byte{}
+		}
+		values[i] = v
+	}
+	return values, err
+}
+
+func (md *memoryDb) Delete(k []byte) error {
+	return md.BatchDelete([][]byte{k})
+}
+
+func (md *memoryDb) BatchDelete(keys [][]byte) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	md.mu.Lock()
+	locked := md.pub.begin()
+	for _, key := range keys {
+		md.remove(key)
+	}
+	md.mu.Unlock()
+
+	md.afterWrite(locked, func() []*KV { return deleteKVs(keys) })
+	return nil
+}
+
+func (md *memoryDb) Has(k []byte) bool {
+	_, err := md.Get(k)
+	return err == nil
+}
+
+func (md *memoryDb) IterDB(fn func(k, v []byte) error) int64 {
+	return md.IterPrefix(nil, fn)
+}
+
+func (md *memoryDb) IterKey(fn func(k []byte) error) int64 {
+	var total int64
+	for _, kv := range md.sortedKVs(nil) {
+		if err := fn(kv.key); err == nil {
+			total++
+		}
+	}
+	return total
+}
+
+func (md *memoryDb) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	var total int64
+	for _, kv := range md.sortedKVs(prefix) {
+		if err := fn(kv.key, kv.value); err == nil {
+			total++
+		}
+	}
+	return total
+}
+
+// DropPrefix 与badger一致，被删除的数据不会留下墓碑
+func (md *memoryDb) DropPrefix(prefix []byte) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	md.mu.Lock()
+	locked := md.pub.begin()
+	for k := range md.data {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			delete(md.data, k)
+		}
+	}
+	md.mu.Unlock()
+
+	md.afterWrite(locked, func() []*KV { return bulkKVs(prefix) })
+	return nil
+}
+
+func (md *memoryDb) Namespace(name string) Database {
+	return newNamespace(md, name)
+}
+
+// Backup 备份版本号不小于since的记录，删除操作以删除标记的形式写出
+func (md *memoryDb) Backup(w io.Writer, since uint64) (uint64, error) {
+	md.mu.RLock()
+	now := time.Now().Unix()
+	list := &pb.KVList{}
+	var maxVersion uint64
+	for k, e := range md.data {
+		if e.version < since || (!e.deleted && !e.alive(now)) {
+			continue
+		}
+		kv := &pb.KV{
+			Key:       []byte(k),
+			Value:     e.value,
+			Version:   e.version,
+			ExpiresAt: uint64(e.expireAt),
+		}
+		if e.deleted {
+			kv.Meta = []byte{kvMetaDelete}
+		}
+		list.Kv = append(list.Kv, kv)
+		if e.version > maxVersion {
+			maxVersion = e.version
+		}
+	}
+	md.mu.RUnlock()
+
+	// 按版本号排序，保证恢复时先写入的操作先执行
+	sort.Slice(list.Kv, func(i, j int) bool {
+		return list.Kv[i].Version < list.Kv[j].Version
+	})
+	for start := 0; start < len(list.Kv); start += backupBatchSize {
+		end := start + backupBatchSize
+		if end > len(list.Kv) {
+			end = len(list.Kv)
+		}
+		if err := writeKVList(w, &pb.KVList{Kv: list.Kv[start:end]}); err != nil {
+			return 0, err
+		}
+	}
+
+	// 备份完整写出后，其中的墓碑才可以回收
+	md.mu.Lock()
+	if maxVersion > md.backedUp {
+		md.backedUp = maxVersion
+	}
+	md.mu.Unlock()
+	return maxVersion, nil
+}
+
+func (md *memoryDb) Restore(r io.Reader) error {
+	return restoreByWrite(md, r)
+}
+
+// Snapshot 拷贝一份当前的全部有效数据
+func (md *memoryDb) Snapshot() (Snapshot, error) {
+	snap := &memoryDb{data: make(map[string]*memEntry), readOnly: true, pub: newPublisher()}
+	for _, kv := range md.sortedKVs(nil) {
+		snap.data[string(kv.key)] = &memEntry{value: kv.value}
+	}
+	return &memorySnapshot{db: snap}, nil
+}
+
+// Size 返回全部记录的key与value总字节数，内存引擎没有value log
+func (md *memoryDb) Size() (int64, int64) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	var size int64
+	for k, e := range md.data {
+		size += int64(len(k) + len(e.value))
+	}
+	return size, 0
+}
+
+// RunGC 清理已经过期的记录与已经写入过备份的墓碑，返回清理的条数。
+// 最近一次备份之后产生的墓碑留给下一次增量备份，从没有备份过时全部回收(此时的备份都是全量备份)。
+// 因此增量备份的since应当接着最近一次备份，从更早的since开始的增量备份可能缺少被回收的删除操作
+func (md *memoryDb) RunGC(discardRatio float64) (int, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	now := time.Now().Unix()
+	removed := 0
+	for k, e := range md.data {
+		if e.deleted && (md.backedUp == 0 || e.version <= md.backedUp) || !e.deleted && !e.alive(now) {
+			delete(md.data, k)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Update 内存引擎持有写锁执行fn，事务之间完全串行，不会发生冲突。fn中不能再调用本数据库的方法，否则会死锁
+func (md *memoryDb) Update(fn func(txn Txn) error) error {
+	if md.readOnly {
+		return ErrReadOnly
+	}
+	md.mu.Lock()
+	mt := &memoryTxn{db: md, pending: make(map[string]*memEntry)}
+	if err := fn(mt); err != nil {
+		md.mu.Unlock()
+		return err
+	}
+	locked := md.pub.begin()
+	recorder := &txnRecorder{}
+	for _, k := range mt.order {
+		if e := mt.pending[k]; e.deleted {
+			md.remove([]byte(k))
+			recorder.delete([]byte(k))
+		} else {
+			md.put([]byte(k), e.value, e.expireAt)
+			recorder.setWithTTL([]byte(k), e.value, e.expireAt)
+		}
+	}
+	md.mu.Unlock()
+
+	md.afterWrite(locked, func() []*KV { return recorder.kvs })
+	return nil
+}
+
+func (md *memoryDb) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return compareAndSwap(md, k, old, new)
+}
+
+func (md *memoryDb) Increment(k []byte, delta int64) (int64, error) {
+	return increment(md, k, delta)
+}
+
+func (md *memoryDb) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+	return merge(md, k, v, fn)
+}
+
+// Subscribe 订阅以prefix开头的key的变更。DropPrefix以一次批量变更(KV.Bulk)推送，Restore逐条推送，RunGC清理的过期数据不会推送
+func (md *memoryDb) Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+	return md.pub.subscribe(ctx, prefix, fn)
+}
+
+// Close 通知订阅者退出并释放全部数据
+func (md *memoryDb) Close() error {
+	md.pub.close()
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.data = make(map[string]*memEntry)
+	return nil
+}
+
+/*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// memorySnapshot 内存引擎的快照，内部是一份只读的数据拷贝
+type memorySnapshot struct {
+	db *memoryDb
+}
+
+func (ms *memorySnapshot) Get(k []byte) ([]byte, error) {
+	return ms.db.Get(k)
+}
+
+func (ms *memorySnapshot) BatchGet(keys [][]byte) ([][]byte, error) {
+	return ms.db.BatchGet(keys)
+}
+
+func (ms *memorySnapshot) Has(k []byte) bool {
+	return ms.db.Has(k)
+}
+
+func (ms *memorySnapshot) IterDB(fn func(k, v []byte) error) int64 {
+	return ms.db.IterDB(fn)
+}
+
+func (ms *memorySnapshot) IterKey(fn func(k []byte) error) int64 {
+	return ms.db.IterKey(fn)
+}
+
+func (ms *memorySnapshot) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return ms.db.IterPrefix(prefix, fn)
+}
+
+func (ms *memorySnapshot) Release() {
+	ms.db.Close()
+}
+
+// memoryTxn 内存引擎的事务，写入先缓存在pending中，Update成功返回前统一生效
+type memoryTxn struct {
+	db      *memoryDb
+	pending map[string]*memEntry
+	order   []string // key第一次写入的顺序，保证生效顺序与写入顺序一致
+}
+
+func (mt *memoryTxn) Get(k []byte) ([]byte, error) {
+	if e, ok := mt.pending[string(k)]; ok {
+		if e.deleted {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte{}, e.value...), nil
+	}
+	return mt.db.get(k)
+}
+
+func (mt *memoryTxn) Has(k []byte) bool {
+	_, err := mt.Get(k)
+	return err == nil
+}
+
+func (mt *memoryTxn) ExpireAt(k []byte) (int64, error) {
+	e, ok := mt.pending[string(k)]
+	if !ok {
+		e, ok = mt.db.data[string(k)]
+	}
+	if !ok || !e.alive(time.Now().Unix()) {
+		return 0, ErrKeyNotFound
+	}
+	return e.expireAt, nil
+}
+
+func (mt *memoryTxn) Set(k, v []byte) error {
+	mt.write(k, &memEntry{value: append([]byte{}, v...)})
+	return nil
+}
+
+func (mt *memoryTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+	mt.write(k, &memEntry{value: append([]byte{}, v...), expireAt: expireAt})
+	return nil
+}
+
+func (mt *memoryTxn) Delete(k []byte) error {
+	mt.write(k, &memEntry{deleted: true})
+	return nil
+}
+
+func (mt *memoryTxn) write(k []byte, e *memEntry) {
+	if _, ok := mt.pending[string(k)]; !ok {
+		mt.order = append(mt.order, string(k))
+	}
+	mt.pending[string(k)] = e
+}
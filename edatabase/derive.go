@@ -0,0 +1,41 @@
+package edatabase
+
+import "io"
+
+/*derive.go 由Database的基本操作(Get/Set/Update等)派生出的通用实现，
+供其他包中的Database实现复用，例如raftdb*/
+
+// Derived 基于db的基本操作实现的Namespace、Restore与原子操作
+type Derived struct {
+	db Database
+}
+
+// Derive 返回基于db的通用实现
+func Derive(db Database) Derived {
+	return Derived{db: db}
+}
+
+// Namespace 在db上创建命名空间视图
+func (d Derived) Namespace(name string) Database {
+	return newNamespace(d.db, name)
+}
+
+// Restore 把备份流逐条写回db
+func (d Derived) Restore(r io.Reader) error {
+	return restoreByWrite(d.db, r)
+}
+
+// CompareAndSwap 基于Update的CompareAndSwap
+func (d Derived) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return compareAndSwap(d.db, k, old, new)
+}
+
+// Increment 基于Update的Increment
+func (d Derived) Increment(k []byte, delta int64) (int64, error) {
+	return increment(d.db, k, delta)
+}
+
+// Merge 基于Update的Merge
+func (d Derived) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+	return merge(d.db, k, v, fn)
+}
@@ -0,0 +1,733 @@
+package edatabase
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/pb"
+)
+
+/*encrypt.go 静态加密：在任意Database之上透明地加解密，落盘的数据都是密文。
+value使用AES-GCM加密，每次写入随机nonce；key可选确定性加密(nonce由HMAC(key)派生)，相同的明文key总是得到相同的密文，因此仍可按key查找*/
+
+// 密文value的格式：版本(1字节) + 密钥编号(4字节大端) + nonce(12字节) + AES-GCM密文
+const (
+	encValueVersion   byte = 1
+	encValueHeaderLen      = 1 + 4
+	encNonceSize           = 12
+)
+
+// ErrDecrypt 数据无法解密：密钥不对、数据被篡改或者不是加密数据
+var ErrDecrypt = errors.New("decryption failed")
+
+// KeyProvider 提供加解密所用的密钥，支持轮换：新数据总是用CurrentKey加密，旧数据按写入时记录的编号用Key取回密钥解密。
+// 同一个编号必须始终对应同一个密钥，密钥长度为16、24或32字节(AES-128/192/256)
+type KeyProvider interface {
+	// CurrentKey 返回当前用于加密的密钥及其编号
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key 返回编号为id的密钥
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing 内存中的KeyProvider实现，并发安全
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyRing 以编号为id的密钥创建KeyRing，该密钥即为当前密钥
+func NewKeyRing(id uint32, key []byte) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[uint32][]byte)}
+	if err := kr.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// AddKey 添加一个只用于解密旧数据的密钥
+func (kr *KeyRing) AddKey(id uint32, key []byte) error {
+	if err := checkAESKey(key); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if old, ok := kr.keys[id]; ok && !bytes.Equal(old, key) {
+		return fmt.Errorf("key %d already exists", id)
+	}
+	kr.keys[id] = append([]byte{}, key...)
+	return nil
+}
+
+// Rotate 添加密钥并把它设为当前密钥，此后的写入都使用它加密。旧密钥保留，用于解密旧数据
+func (kr *KeyRing) Rotate(id uint32, key []byte) error {
+	if err := kr.AddKey(id, key); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	kr.current = id
+	kr.mu.Unlock()
+	return nil
+}
+
+// RemoveKey 移除不再需要的旧密钥(例如ReEncrypt之后)。当前密钥不能移除
+func (kr *KeyRing) RemoveKey(id uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if id == kr.current {
+		return fmt.Errorf("cannot remove current key %d", id)
+	}
+	delete(kr.keys, id)
+	return nil
+}
+
+func (kr *KeyRing) CurrentKey() (uint32, []byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *KeyRing) Key(id uint32) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+	return key, nil
+}
+
+// checkAESKey 检查密钥长度
+func checkAESKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("invalid AES key length %d, want 16, 24 or 32", len(key))
+	}
+}
+
+// EncryptionOptions 静态加密配置
+type EncryptionOptions struct {
+	// KeyProvider 密钥来源，必填
+	KeyProvider KeyProvider
+	// EncryptKeys 是否同时加密key。加密key后前缀遍历需要解密并筛选全部key，开销随数据量线性增长
+	EncryptKeys bool
+	// KeyEncryptionKeyID 加密key使用的密钥编号。key的密文必须保持不变才能查找，因此不随轮换改变，对应的密钥不能移除
+	KeyEncryptionKeyID uint32
+}
+
+// keyCipher key的确定性加密器
+type keyCipher struct {
+	aead cipher.AEAD
+	mac  []byte // 派生nonce的HMAC密钥
+}
+
+// encryptedDb 加密视图，实现Database接口
+type encryptedDb struct {
+	db       Database
+	provider KeyProvider
+	keyEnc   *keyCipher // 为nil表示不加密key
+
+	mu    sync.RWMutex
+	aeads map[uint32]cipher.AEAD // 按密钥编号缓存的value加密器
+}
+
+// NewEncryptedDatabase 在db之上创建加密视图。视图接管db，关闭视图时db一并关闭
+func NewEncryptedDatabase(db Database, opts *EncryptionOptions) (Database, error) {
+	if opts == nil || opts.KeyProvider == nil {
+		return nil, errors.New("encryption requires a KeyProvider")
+	}
+	ed := &encryptedDb{
+		db:       db,
+		provider: opts.KeyProvider,
+		aeads:    make(map[uint32]cipher.AEAD),
+	}
+	if _, err := ed.currentAEAD(); err != nil {
+		return nil, err
+	}
+	if opts.EncryptKeys {
+		key, err := opts.KeyProvider.Key(opts.KeyEncryptionKeyID)
+		if err != nil {
+			return nil, err
+		}
+		if ed.keyEnc, err = newKeyCipher(key); err != nil {
+			return nil, err
+		}
+	}
+	return ed, nil
+}
+
+// newKeyCipher 从密钥派生出加密key用的AES密钥与HMAC密钥，避免与value加密共用同一把密钥
+func newKeyCipher(key []byte) (*keyCipher, error) {
+	derive := func(label string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(label))
+		return h.Sum(nil)
+	}
+	aead, err := newAEAD(derive("edatabase key encryption")[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	return &keyCipher{aead: aead, mac: derive("edatabase key nonce")}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if err := checkAESKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aead 取编号为id的value加密器
+func (ed *encryptedDb) aead(id uint32) (cipher.AEAD, error) {
+	ed.mu.RLock()
+	aead, ok := ed.aeads[id]
+	ed.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := ed.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	ed.mu.Lock()
+	ed.aeads[id] = aead
+	ed.mu.Unlock()
+	return aead, nil
+}
+
+// currentAEAD 取当前密钥的编号与加密器
+func (ed *encryptedDb) currentAEAD() (uint32, error) {
+	id, _, err := ed.provider.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+	_, err = ed.aead(id)
+	return id, err
+}
+
+// encryptKey 确定性加密key：nonce + 密文
+func (ed *encryptedDb) encryptKey(k []byte) []byte {
+	if ed.keyEnc == nil {
+		return k
+	}
+	h := hmac.New(sha256.New, ed.keyEnc.mac)
+	h.Write(k)
+	nonce := h.Sum(nil)[:encNonceSize]
+	return ed.keyEnc.aead.Seal(nonce, nonce, k, nil)
+}
+
+func (ed *encryptedDb) encryptKeys(ks [][]byte) [][]byte {
+	if ed.keyEnc == nil {
+		return ks
+	}
+	res := make([][]byte, len(ks))
+	for i, k := range ks {
+		res[i] = ed.encryptKey(k)
+	}
+	return res
+}
+
+// decryptKey 解密落盘的key
+func (ed *encryptedDb) decryptKey(stored []byte) ([]byte, error) {
+	if ed.keyEnc == nil {
+		return stored, nil
+	}
+	if len(stored) < encNonceSize {
+		return nil, ErrDecrypt
+	}
+	k, err := ed.keyEnc.aead.Open(nil, stored[:encNonceSize], stored[encNonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return k, nil
+}
+
+// encryptValue 用当前密钥加密value。明文key作为附加数据，防止密文被挪到其他key下使用
+func (ed *encryptedDb) encryptValue(k, v []byte) ([]byte, error) {
+	id, err := ed.currentAEAD()
+	if err != nil {
+		return nil, err
+	}
+	aead, _ := ed.aead(id)
+
+	out := make([]byte, encValueHeaderLen+encNonceSize, encValueHeaderLen+encNonceSize+len(v)+aead.Overhead())
+	out[0] = encValueVersion
+	binary.BigEndian.PutUint32(out[1:encValueHeaderLen], id)
+	nonce := out[encValueHeaderLen:]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, v, k), nil
+}
+
+func (ed *encryptedDb) encryptValues(keys, values [][]byte) ([][]byte, error) {
+	if len(keys) != len(values) {
+		return nil, errors.New("keys and values length mismatch")
+	}
+	res := make([][]byte, len(values))
+	for i, v := range values {
+		var err error
+		if res[i], err = ed.encryptValue(keys[i], v); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// valueKeyID 读出密文value使用的密钥编号
+func valueKeyID(stored []byte) (uint32, error) {
+	if len(stored) < encValueHeaderLen+encNonceSize || stored[0] != encValueVersion {
+		return 0, ErrDecrypt
+	}
+	return binary.BigEndian.Uint32(stored[1:encValueHeaderLen]), nil
+}
+
+// decryptValue 解密value，k为明文key
+func (ed *encryptedDb) decryptValue(k, stored []byte) ([]byte, error) {
+	id, err := valueKeyID(stored)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ed.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := stored[encValueHeaderLen : encValueHeaderLen+encNonceSize]
+	v, err := aead.Open(nil, nonce, stored[encValueHeaderLen+encNonceSize:], k)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v, nil
+}
+
+// iterPrefix 遍历底层数据库中明文key以prefix开头的键值对，iter为底层的IterPrefix。
+// 只加密value时直接按前缀遍历；加密key时遍历全部数据，解密后筛选并按明文key排序，保证与其他引擎相同的遍历顺序。
+// 无法解密的数据被跳过
+func (ed *encryptedDb) iterPrefix(iter func(prefix []byte, fn func(k, v []byte) error) int64, prefix []byte, fn func(k, v []byte) error) int64 {
+	if ed.keyEnc == nil {
+		return iter(prefix, func(k, v []byte) error {
+			plain, err := ed.decryptValue(k, v)
+			if err != nil {
+				return err
+			}
+			return fn(k, plain)
+		})
+	}
+
+	type kv struct{ k, v []byte }
+	matched := make([]kv, 0)
+	iter(nil, func(stored, v []byte) error {
+		k, err := ed.decryptKey(stored)
+		if err != nil || !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		plain, err := ed.decryptValue(k, v)
+		if err != nil {
+			return nil
+		}
+		matched = append(matched, kv{k, plain})
+		return nil
+	})
+	sort.Slice(matched, func(i, j int) bool {
+		return bytes.Compare(matched[i].k, matched[j].k) < 0
+	})
+
+	var total int64
+	for _, item := range matched {
+		if fn(item.k, item.v) == nil {
+			total++
+		}
+	}
+	return total
+}
+
+/*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
+
+func (ed *encryptedDb) Set(k, v []byte) error {
+	ev, err := ed.encryptValue(k, v)
+	if err != nil {
+		return err
+	}
+	return ed.db.Set(ed.encryptKey(k), ev)
+}
+
+func (ed *encryptedDb) BatchSet(keys, values [][]byte) error {
+	evs, err := ed.encryptValues(keys, values)
+	if err != nil {
+		return err
+	}
+	return ed.db.BatchSet(ed.encryptKeys(keys), evs)
+}
+
+func (ed *encryptedDb) SetWithTTL(k, v []byte, expireAt int64) error {
+	ev, err := ed.encryptValue(k, v)
+	if err != nil {
+		return err
+	}
+	return ed.db.SetWithTTL(ed.encryptKey(k), ev, expireAt)
+}
+
+func (ed *encryptedDb) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	evs, err := ed.encryptValues(keys, values)
+	if err != nil {
+		return err
+	}
+	return ed.db.BatchSetWithTTL(ed.encryptKeys(keys), evs, expireAts)
+}
+
+func (ed *encryptedDb) Get(k []byte) ([]byte, error) {
+	v, err := ed.db.Get(ed.encryptKey(k))
+	if err != nil {
+		return nil, err
+	}
+	return ed.decryptValue(k, v)
+}
+
+// BatchGet 与底层引擎一致，不存在的key对应空数组
+func (ed *encryptedDb) BatchGet(keys [][]byte) ([][]byte, error) {
+	values, err := ed.db.BatchGet(ed.encryptKeys(keys))
+	for i, v := range values {
+		if len(v) == 0 { // 密文不可能为空，空数组表示key不存在
+			continue
+		}
+		plain, decErr := ed.decryptValue(keys[i], v)
+		if decErr != nil {
+			values[i], err = []byte{}, decErr
+			continue
+		}
+		values[i] = plain
+	}
+	return values, err
+}
+
+func (ed *encryptedDb) Delete(k []byte) error {
+	return ed.db.Delete(ed.encryptKey(k))
+}
+
+func (ed *encryptedDb) BatchDelete(keys [][]byte) error {
+	return ed.db.BatchDelete(ed.encryptKeys(keys))
+}
+
+func (ed *encryptedDb) Has(k []byte) bool {
+	return ed.db.Has(ed.encryptKey(k))
+}
+
+func (ed *encryptedDb) IterDB(fn func(k, v []byte) error) int64 {
+	return ed.IterPrefix(nil, fn)
+}
+
+func (ed *encryptedDb) IterKey(fn func(k []byte) error) int64 {
+	return ed.IterPrefix(nil, func(k, v []byte) error {
+		return fn(k)
+	})
+}
+
+func (ed *encryptedDb) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return ed.iterPrefix(ed.db.IterPrefix, prefix, fn)
+}
+
+// DropPrefix 加密key时无法按密文前缀删除，改为找出匹配的key后批量删除
+func (ed *encryptedDb) DropPrefix(prefix []byte) error {
+	if ed.keyEnc == nil {
+		return ed.db.DropPrefix(prefix)
+	}
+	keys := make([][]byte, 0)
+	ed.IterPrefix(prefix, func(k, v []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if len(keys) == 0 {
+		return nil
+	}
+	return ed.BatchDelete(keys)
+}
+
+func (ed *encryptedDb) Namespace(name string) Database {
+	return newNamespace(ed, name)
+}
+
+// Backup 备份底层数据库，备份流中的数据保持加密
+func (ed *encryptedDb) Backup(w io.Writer, since uint64) (uint64, error) {
+	return ed.db.Backup(w, since)
+}
+
+// Restore 恢复Backup产生的加密备份，需要使用相同的密钥
+func (ed *encryptedDb) Restore(r io.Reader) error {
+	return ed.db.Restore(r)
+}
+
+func (ed *encryptedDb) Snapshot() (Snapshot, error) {
+	snap, err := ed.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedSnapshot{snap: snap, ed: ed}, nil
+}
+
+func (ed *encryptedDb) Size() (int64, int64) {
+	return ed.db.Size()
+}
+
+func (ed *encryptedDb) RunGC(discardRatio float64) (int, error) {
+	return ed.db.RunGC(discardRatio)
+}
+
+func (ed *encryptedDb) Update(fn func(txn Txn) error) error {
+	return ed.db.Update(func(txn Txn) error {
+		return fn(&encryptedTxn{txn: txn, ed: ed})
+	})
+}
+
+func (ed *encryptedDb) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return compareAndSwap(ed, k, old, new)
+}
+
+func (ed *encryptedDb) Increment(k []byte, delta int64) (int64, error) {
+	return increment(ed, k, delta)
+}
+
+func (ed *encryptedDb) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+	return merge(ed, k, v, fn)
+}
+
+// Subscribe 推送解密后的变更。加密key时订阅全部变更，解密后再按prefix筛选
+func (ed *encryptedDb) Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+	innerPrefix := prefix
+	if ed.keyEnc != nil {
+		innerPrefix = nil
+	}
+	return ed.db.Subscribe(ctx, innerPrefix, func(kv *KV) {
+		if kv.Bulk {
+			bulk := *kv
+			if ed.keyEnc != nil {
+				// 加密后的key无法还原出前缀，视为整个数据库被修改
+				bulk.Key = nil
+			}
+			if prefixOverlap(bulk.Key, prefix) {
+				fn(&bulk)
+			}
+			return
+		}
+		k, err := ed.decryptKey(kv.Key)
+		if err != nil || !bytes.HasPrefix(k, prefix) {
+			return
+		}
+		plain := *kv
+		plain.Key = k
+		if !kv.Deleted {
+			if plain.Value, err = ed.decryptValue(k, kv.Value); err != nil {
+				return
+			}
+		}
+		fn(&plain)
+	})
+}
+
+// Close 关闭底层数据库
+func (ed *encryptedDb) Close() error {
+	return ed.db.Close()
+}
+
+/*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// Unwrap 返回被包装的数据库
+func (ed *encryptedDb) Unwrap() Database {
+	return ed.db
+}
+
+// ReEncrypt 把不是用当前密钥加密的value用当前密钥重新加密，返回重写的条数。
+// 密钥轮换后执行，完成后旧密钥即可移除。TTL会被保留；重写期间对同一key的并发写入可能被覆盖，应在业务低峰执行。
+// db可以是加密数据库之上的视图(通过Unwrapper逐层查找)，此时重写的是整个加密数据库，
+// 途经的BulkObserver(如指标视图)会收到一次ReEncrypt操作
+func ReEncrypt(db Database) (count int, err error) {
+	start := time.Now()
+	var observers []BulkObserver
+	size := 0
+	defer func() {
+		for _, o := range observers {
+			o.ObserveBulk("ReEncrypt", start, size, err)
+		}
+	}()
+
+	ed, ok := db.(*encryptedDb)
+	for !ok {
+		if o, isObserver := db.(BulkObserver); isObserver {
+			observers = append(observers, o)
+		}
+		u, isWrapper := db.(Unwrapper)
+		if !isWrapper {
+			return 0, errors.New("ReEncrypt: not an encrypted database")
+		}
+		db = u.Unwrap()
+		ed, ok = db.(*encryptedDb)
+	}
+	current, err := ed.currentAEAD()
+	if err != nil {
+		return 0, err
+	}
+
+	// 借助底层数据库的备份流读出包含TTL的全部数据。
+	// badger的备份流中同一key的多个版本按从新到旧排列，只有每个key的第一条是当前值
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := ed.db.Backup(pw, 0)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	now := uint64(time.Now().Unix())
+	seen := make(map[string]struct{})
+	err = readKVLists(pr, func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			if _, ok := seen[string(kv.Key)]; ok {
+				continue
+			}
+			seen[string(kv.Key)] = struct{}{}
+			if len(kv.Meta) > 0 && kv.Meta[0]&kvMetaDelete != 0 {
+				continue
+			}
+			if kv.ExpiresAt > 0 && kv.ExpiresAt <= now {
+				continue
+			}
+			id, err := valueKeyID(kv.Value)
+			if err != nil || id == current {
+				continue
+			}
+			k, err := ed.decryptKey(kv.Key)
+			if err != nil {
+				continue
+			}
+			v, err := ed.decryptValue(k, kv.Value)
+			if err != nil {
+				return fmt.Errorf("ReEncrypt %q: %w", k, err)
+			}
+			if kv.ExpiresAt > 0 {
+				err = ed.SetWithTTL(k, v, int64(kv.ExpiresAt))
+			} else {
+				err = ed.Set(k, v)
+			}
+			if err != nil {
+				return err
+			}
+			count++
+			size += len(k) + len(v)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// encryptedSnapshot 加密视图上的快照
+type encryptedSnapshot struct {
+	snap Snapshot
+	ed   *encryptedDb
+}
+
+func (es *encryptedSnapshot) Get(k []byte) ([]byte, error) {
+	v, err := es.snap.Get(es.ed.encryptKey(k))
+	if err != nil {
+		return nil, err
+	}
+	return es.ed.decryptValue(k, v)
+}
+
+func (es *encryptedSnapshot) BatchGet(keys [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	var err error
+	for i, k := range keys {
+		var getErr error
+		if values[i], getErr = es.Get(k); getErr != nil {
+			values[i], err = []byte{}, getErr
+		}
+	}
+	return values, err
+}
+
+func (es *encryptedSnapshot) Has(k []byte) bool {
+	return es.snap.Has(es.ed.encryptKey(k))
+}
+
+func (es *encryptedSnapshot) IterDB(fn func(k, v []byte) error) int64 {
+	return es.IterPrefix(nil, fn)
+}
+
+func (es *encryptedSnapshot) IterKey(fn func(k []byte) error) int64 {
+	return es.IterPrefix(nil, func(k, v []byte) error {
+		return fn(k)
+	})
+}
+
+func (es *encryptedSnapshot) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return es.ed.iterPrefix(es.snap.IterPrefix, prefix, fn)
+}
+
+func (es *encryptedSnapshot) Release() {
+	es.snap.Release()
+}
+
+// encryptedTxn 加密视图上的事务
+type encryptedTxn struct {
+	txn Txn
+	ed  *encryptedDb
+}
+
+func (et *encryptedTxn) Get(k []byte) ([]byte, error) {
+	v, err := et.txn.Get(et.ed.encryptKey(k))
+	if err != nil {
+		return nil, err
+	}
+	return et.ed.decryptValue(k, v)
+}
+
+func (et *encryptedTxn) Has(k []byte) bool {
+	return et.txn.Has(et.ed.encryptKey(k))
+}
+
+func (et *encryptedTxn) ExpireAt(k []byte) (int64, error) {
+	return txnExpireAt(et.txn, et.ed.encryptKey(k))
+}
+
+func (et *encryptedTxn) Set(k, v []byte) error {
+	ev, err := et.ed.encryptValue(k, v)
+	if err != nil {
+		return err
+	}
+	return et.txn.Set(et.ed.encryptKey(k), ev)
+}
+
+func (et *encryptedTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+	ev, err := et.ed.encryptValue(k, v)
+	if err != nil {
+		return err
+	}
+	return et.txn.SetWithTTL(et.ed.encryptKey(k), ev, expireAt)
+}
+
+func (et *encryptedTxn) Delete(k []byte) error {
+	return et.txn.Delete(et.ed.encryptKey(k))
+}
@@ -0,0 +1,215 @@
+package edatabase
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/pb"
+)
+
+func testKeyRing(t *testing.T) *KeyRing {
+	kr, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestEncryptedMemory(t *testing.T) {
+	for _, encryptKeys := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Encryption = &EncryptionOptions{KeyProvider: testKeyRing(t), EncryptKeys: encryptKeys, KeyEncryptionKeyID: 1}
+		db, err := OpenDatabaseWithOptions("memory", "", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkDatabase(t, db)
+		checkDatabase(t, db.Namespace("ns"))
+		checkAtomic(t, db)
+		checkSubscribe(t, db)
+		writeAndGet(db, 10)
+		db.Close()
+	}
+}
+
+func TestEncryptedBadger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edatabase-encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Encryption = &EncryptionOptions{KeyProvider: testKeyRing(t), EncryptKeys: true, KeyEncryptionKeyID: 1}
+	db, err := OpenDatabaseWithOptions("badger", filepath.Join(dir, "db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	checkDatabase(t, db)
+	checkAtomic(t, db)
+	checkSubscribe(t, db)
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	raw, _ := OpenDatabase("memory", "")
+	db, err := NewEncryptedDatabase(raw, &EncryptionOptions{KeyProvider: testKeyRing(t), EncryptKeys: true, KeyEncryptionKeyID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Set([]byte("secret-key"), []byte("secret-value")); err != nil {
+		t.Fatal(err)
+	}
+	raw.IterDB(func(k, v []byte) error {
+		if bytes.Contains(k, []byte("secret")) || bytes.Contains(v, []byte("secret")) {
+			t.Fatalf("plaintext stored: %q => %q", k, v)
+		}
+		return nil
+	})
+
+	// 密文被挪到其他key下无法解密
+	var stored []byte
+	raw.IterDB(func(k, v []byte) error {
+		stored = append([]byte{}, v...)
+		return nil
+	})
+	plain, _ := NewEncryptedDatabase(raw, &EncryptionOptions{KeyProvider: testKeyRing(t)})
+	_ = raw.Set([]byte("other"), stored)
+	if _, err = plain.Get([]byte("other")); err != ErrDecrypt {
+		t.Fatalf("moved ciphertext got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	raw, _ := OpenDatabase("memory", "")
+	checkKeyRotation(t, raw)
+
+	dir, err := ioutil.TempDir("", "edatabase-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	raw, err = OpenDatabase("badger", filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeyRotation(t, raw)
+}
+
+// checkKeyRotation 在raw上检查密钥轮换与ReEncrypt，结束时关闭raw
+func checkKeyRotation(t *testing.T, raw Database) {
+	kr := testKeyRing(t)
+	db, err := NewEncryptedDatabase(raw, &EncryptionOptions{KeyProvider: kr, EncryptKeys: true, KeyEncryptionKeyID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	// a有两个版本，重写后必须保留新值
+	_ = db.Set([]byte("a"), []byte("0"))
+	_ = db.Set([]byte("a"), []byte("1"))
+	_ = db.SetWithTTL([]byte("b"), []byte("2"), expireAt)
+
+	if err = kr.Rotate(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err = kr.RemoveKey(2); err == nil {
+		t.Fatal("current key should not be removable")
+	}
+	_ = db.Set([]byte("c"), []byte("3"))
+
+	// 旧数据仍用旧密钥解密
+	if v, err := db.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("a = %s, %v", v, err)
+	}
+
+	n, err := ReEncrypt(db)
+	if err != nil || n != 2 {
+		t.Fatalf("ReEncrypt rewrote %d, %v, want 2", n, err)
+	}
+	if v, err := db.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("a after ReEncrypt = %s, %v", v, err)
+	}
+	raw.IterDB(func(k, v []byte) error {
+		if id, _ := valueKeyID(v); id != 2 {
+			t.Fatalf("value still encrypted with key %d", id)
+		}
+		return nil
+	})
+
+	// TTL在重写后保留
+	var backup bytes.Buffer
+	if _, err = raw.Backup(&backup, 0); err != nil {
+		t.Fatal(err)
+	}
+	withTTL := 0
+	seen := make(map[string]bool)
+	_ = readKVLists(&backup, func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			// 只看每个key的当前版本
+			if seen[string(kv.Key)] {
+				continue
+			}
+			seen[string(kv.Key)] = true
+			if int64(kv.ExpiresAt) == expireAt {
+				withTTL++
+			}
+		}
+		return nil
+	})
+	if withTTL != 1 {
+		t.Fatalf("%d entries keep the ttl, want 1", withTTL)
+	}
+	if v, err := db.Get([]byte("b")); err != nil || string(v) != "2" {
+		t.Fatalf("b = %s, %v", v, err)
+	}
+}
+
+func TestReEncryptThroughViews(t *testing.T) {
+	kr := testKeyRing(t)
+	raw, _ := OpenDatabase("memory", "")
+	enc, err := NewEncryptedDatabase(raw, &EncryptionOptions{KeyProvider: kr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := NewIndexedDatabase(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewMetricsRegistry("", nil)
+	db, err := NewMetricsDatabase(indexed, &MetricsOptions{Metrics: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ns := db.Namespace("ns")
+	_ = ns.Set([]byte("a"), []byte("1"))
+	if err = kr.Rotate(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 从最上层的命名空间视图逐层找到加密数据库
+	if n, err := ReEncrypt(ns); err != nil || n == 0 {
+		t.Fatalf("ReEncrypt through views rewrote %d, %v", n, err)
+	}
+	if v, err := ns.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("a = %s, %v", v, err)
+	}
+	if st := findStats(registry.Stats(), "ReEncrypt"); st.Count != 1 || st.Bytes == 0 {
+		t.Fatalf("ReEncrypt stats = %+v", st)
+	}
+
+	if _, err = ReEncrypt(raw.Namespace("ns")); err == nil {
+		t.Fatal("ReEncrypt on an unencrypted database should fail")
+	}
+}
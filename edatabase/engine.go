@@ -0,0 +1,90 @@
+package edatabase
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/*engine.go 数据库引擎注册表。内置badger与memory引擎，其他引擎可以在自己的包中通过RegisterEngine注册，无需修改本包*/
+
+// Engine 数据库引擎
+type Engine interface {
+	// Open 打开或创建path处的数据库
+	Open(path string, opts *Options) (Database, error)
+	// Exists 检查path处是否已经存在本引擎的数据库。检查过程出错时返回错误
+	Exists(path string) (bool, error)
+}
+
+var (
+	enginesMu sync.RWMutex
+	engines   = map[string]Engine{
+		"badger": badgerEngine{},
+		"memory": memoryEngine{},
+		//"bolt":   boltEngine{},
+		//"couch":  couchEngine{},
+		//"level":  levelEngine{},
+		//"rocks":  rocksEngine{},
+		//"sqlite": sqliteEngine{},
+	}
+)
+
+// RegisterEngine 注册名为name的引擎，此后可以通过OpenDatabase(name, path)打开。
+// 与database/sql.Register一样，通常在init中调用，name重复或engine为nil时panic
+func RegisterEngine(name string, engine Engine) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if engine == nil {
+		panic("edatabase: RegisterEngine engine is nil")
+	}
+	if _, dup := engines[name]; dup {
+		panic("edatabase: RegisterEngine called twice for engine " + name)
+	}
+	engines[name] = engine
+}
+
+// Engines 返回已注册的引擎名，按字母序排列
+func Engines() []string {
+	enginesMu.RLock()
+	defer enginesMu.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupEngine 按名字查找引擎
+func lookupEngine(name string) (Engine, error) {
+	enginesMu.RLock()
+	engine, exists := engines[name]
+	enginesMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unsupported storage engine: %v", name)
+	}
+	return engine, nil
+}
+
+// badgerEngine 内置的badger引擎
+type badgerEngine struct{}
+
+func (badgerEngine) Open(path string, opts *Options) (Database, error) {
+	return openBadgerDb(path, opts)
+}
+
+func (badgerEngine) Exists(path string) (bool, error) {
+	return badgerExists(path)
+}
+
+// memoryEngine 内置的内存引擎，数据不落盘
+type memoryEngine struct{}
+
+func (memoryEngine) Open(path string, opts *Options) (Database, error) {
+	return openMemoryDb(path, opts)
+}
+
+// Exists 内存数据库不会留下任何文件，总是返回false
+func (memoryEngine) Exists(path string) (bool, error) {
+	return false, nil
+}
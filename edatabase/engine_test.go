@@ -0,0 +1,81 @@
+package edatabase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// markerEngine 测试用引擎：数据存在内存中，path下有marker文件即视为数据库存在
+type markerEngine struct{}
+
+func (markerEngine) Open(path string, opts *Options) (Database, error) {
+	if err := ioutil.WriteFile(filepath.Join(path, "marker"), nil, 0644); err != nil {
+		return nil, err
+	}
+	return openMemoryDb(path, opts)
+}
+
+func (markerEngine) Exists(path string) (bool, error) {
+	_, err := os.Stat(filepath.Join(path, "marker"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unregisterEngine 撤销测试中注册的引擎，使测试可以重复运行
+func unregisterEngine(name string) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	delete(engines, name)
+}
+
+func TestRegisterEngine(t *testing.T) {
+	RegisterEngine("marker", markerEngine{})
+	t.Cleanup(func() { unregisterEngine("marker") })
+
+	found := false
+	for _, name := range Engines() {
+		found = found || name == "marker"
+	}
+	if !found {
+		t.Fatalf("Engines() = %v, missing marker", Engines())
+	}
+
+	dir, err := ioutil.TempDir("", "edatabase-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if exists, err := DbExists("marker", dir); exists || err != nil {
+		t.Fatalf("DbExists before open got %v, %v", exists, err)
+	}
+	db, err := OpenDatabase("marker", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkDatabase(t, db)
+	if exists, err := DbExists("marker", dir); !exists || err != nil {
+		t.Fatalf("DbExists after open got %v, %v", exists, err)
+	}
+
+	// badger的MANIFEST检查只对badger引擎生效
+	if exists, _ := DbExists("badger", dir); exists {
+		t.Fatal("marker database detected as badger")
+	}
+
+	if _, err = DbExists("unknown", dir); err == nil {
+		t.Fatal("DbExists of unknown engine should fail")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering an engine twice should panic")
+		}
+	}()
+	RegisterEngine("marker", markerEngine{})
+}
@@ -0,0 +1,44 @@
+package edatabase
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// 打开数据库时可能返回的错误，可以用errors.Is判断
+var (
+	// ErrLocked 数据库正被另一个存活的进程使用
+	ErrLocked = errors.New("database is locked by another process")
+	// ErrNotFound 数据库不存在
+	ErrNotFound = errors.New("database not found")
+	// ErrCorrupt 数据库文件损坏
+	ErrCorrupt = errors.New("database is corrupt")
+)
+
+// 用于识别badger打开错误的关键字。badger v1.6没有导出这些错误，只能按错误信息匹配
+var (
+	badgerLockedMarkers  = []string{"Cannot acquire directory lock", "Cannot create pid lock file"}
+	badgerCorruptMarkers = []string{"bad magic", "checksum", "corrupt", "Unable to replay", "MANIFEST removed"}
+)
+
+// classifyBadgerError 把badger.Open返回的错误归类为ErrLocked/ErrCorrupt，原始错误信息保留在错误描述中
+func classifyBadgerError(path string, err error) error {
+	if err == badger.ErrTruncateNeeded {
+		return fmt.Errorf("%w: %s: %v", ErrCorrupt, path, err)
+	}
+	msg := err.Error()
+	for _, marker := range badgerLockedMarkers {
+		if strings.Contains(msg, marker) {
+			return fmt.Errorf("%w: %s: %v", ErrLocked, path, err)
+		}
+	}
+	for _, marker := range badgerCorruptMarkers {
+		if strings.Contains(msg, marker) {
+			return fmt.Errorf("%w: %s: %v", ErrCorrupt, path, err)
+		}
+	}
+	return err
+}
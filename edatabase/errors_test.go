@@ -0,0 +1,72 @@
+package edatabase
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestOpenLockedDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edatabase-locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db")
+	db, err := OpenDatabase("badger", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 同一进程仍持有数据库，retry不能删除锁文件
+	if _, err := OpenDatabaseWithRetry("badger", path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("open locked database got %v, want ErrLocked", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "LOCK")); err != nil {
+		t.Fatalf("LOCK of a live process was removed: %v", err)
+	}
+}
+
+func TestOpenNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edatabase-notfound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	if _, err = OpenDatabaseWithOptions("badger", filepath.Join(dir, "db"), opts); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("read-only open of missing database got %v, want ErrNotFound", err)
+	}
+	if exists, err := DbExists("badger", filepath.Join(dir, "db")); exists || err != nil {
+		t.Fatalf("DbExists got %v, %v", exists, err)
+	}
+}
+
+func TestRetryRemovesStaleLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edatabase-stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 找一个不存在的pid写入锁文件，模拟异常退出的进程
+	pid := 1 << 22
+	for processAlive(pid) {
+		pid++
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "LOCK"), []byte(strconv.Itoa(pid)+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err := retry("badger", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
@@ -0,0 +1,160 @@
+package edatabase
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/*gc.go 后台维护协程：定时以及在写入达到一定量后回收value log，避免磁盘占用无限增长*/
+
+// DefaultGCDiscardRatio 默认的丢弃比例：value log文件中至少一半是垃圾时才重写
+const DefaultGCDiscardRatio = 0.5
+
+// 触发GC的原因
+const (
+	GCTriggerInterval = "interval" // 定时触发
+	GCTriggerWrites   = "writes"   // 写入量达到阈值触发
+)
+
+// Duration 可以从配置文件中以"10m"、"1h30m"形式读取的时长，也接受纳秒整数
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		dur, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dur)
+	default:
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	return nil
+}
+
+// GCStats 一次GC的结果，通过Options.OnGC上报
+type GCStats struct {
+	Trigger    string        // 触发原因
+	Runs       uint64        // 启动以来累计的GC次数(含本次)
+	Rewrites   int           // 本次重写的value log文件数
+	Duration   time.Duration // 本次GC耗时
+	LSMBefore  int64         // GC前LSM tree大小(字节)
+	VlogBefore int64         // GC前value log大小(字节)
+	LSMAfter   int64         // GC后LSM tree大小(字节)
+	VlogAfter  int64         // GC后value log大小(字节)
+	Err        error         // GC出错时的错误
+}
+
+// gcScheduler 后台GC调度器
+type gcScheduler struct {
+	db             Database
+	interval       time.Duration
+	discardRatio   float64
+	writeThreshold int64
+	onGC           func(GCStats)
+
+	writes int64  // 上次GC以来的写入条数
+	runs   uint64 // 累计GC次数
+
+	kick chan struct{} // 写入达到阈值时的触发信号
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startGC 按配置启动后台GC。既没有配置间隔也没有配置写入阈值时返回nil
+func startGC(db Database, opts *Options) *gcScheduler {
+	if opts.ReadOnly || (opts.GCInterval <= 0 && opts.GCWriteThreshold <= 0) {
+		return nil
+	}
+	discardRatio := opts.GCDiscardRatio
+	if discardRatio <= 0 || discardRatio >= 1 {
+		discardRatio = DefaultGCDiscardRatio
+	}
+
+	gc := &gcScheduler{
+		db:             db,
+		interval:       time.Duration(opts.GCInterval),
+		discardRatio:   discardRatio,
+		writeThreshold: opts.GCWriteThreshold,
+		onGC:           opts.OnGC,
+		kick:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go gc.loop()
+	return gc
+}
+
+// noteWrites 记录写入条数，达到阈值时触发一次GC。gc为nil时什么都不做
+func (gc *gcScheduler) noteWrites(n int) {
+	if gc == nil || gc.writeThreshold <= 0 {
+		return
+	}
+	if atomic.AddInt64(&gc.writes, int64(n)) < gc.writeThreshold {
+		return
+	}
+	select {
+	case gc.kick <- struct{}{}:
+	default: // 已经有一次待执行的GC
+	}
+}
+
+func (gc *gcScheduler) loop() {
+	defer close(gc.done)
+
+	var tick <-chan time.Time
+	if gc.interval > 0 {
+		ticker := time.NewTicker(gc.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			gc.run(GCTriggerInterval)
+		case <-gc.kick:
+			gc.run(GCTriggerWrites)
+		case <-gc.stop:
+			return
+		}
+	}
+}
+
+// run 执行一次GC并上报结果
+func (gc *gcScheduler) run(trigger string) {
+	atomic.StoreInt64(&gc.writes, 0)
+
+	stats := GCStats{Trigger: trigger, Runs: atomic.AddUint64(&gc.runs, 1)}
+	stats.LSMBefore, stats.VlogBefore = gc.db.Size()
+	begin := time.Now()
+	stats.Rewrites, stats.Err = gc.db.RunGC(gc.discardRatio)
+	stats.Duration = time.Since(begin)
+	stats.LSMAfter, stats.VlogAfter = gc.db.Size()
+
+	if gc.onGC != nil {
+		gc.onGC(stats)
+	}
+}
+
+// close 停止后台GC并等待正在执行的GC结束。gc为nil时什么都不做
+func (gc *gcScheduler) close() {
+	if gc == nil {
+		return
+	}
+	close(gc.stop)
+	<-gc.done
+}
@@ -0,0 +1,71 @@
+package edatabase
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackgroundGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edatabase-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	statsCh := make(chan GCStats, 16)
+	opts := DefaultOptions()
+	opts.GCWriteThreshold = 10
+	opts.OnGC = func(stats GCStats) {
+		statsCh <- stats
+	}
+	db, err := OpenDatabaseWithOptions("badger", filepath.Join(dir, "db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case stats := <-statsCh:
+		if stats.Trigger != GCTriggerWrites || stats.Runs != 1 || stats.Err != nil {
+			t.Fatalf("unexpected gc stats %+v", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("gc not triggered by writes")
+	}
+
+	// Close需要停止后台GC，之后不再有回调
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case stats := <-statsCh:
+		t.Fatalf("gc ran after Close: %+v", stats)
+	default:
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	var opts Options
+	if err := json.Unmarshal([]byte(`{"gc_interval": "10m"}`), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(opts.GCInterval) != 10*time.Minute {
+		t.Fatalf("gc_interval = %v", time.Duration(opts.GCInterval))
+	}
+	if err := json.Unmarshal([]byte(`{"gc_interval": 1000}`), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(opts.GCInterval) != time.Microsecond {
+		t.Fatalf("gc_interval = %v", time.Duration(opts.GCInterval))
+	}
+}
@@ -0,0 +1,534 @@
+package edatabase
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*index.go 二级索引：按声明的索引函数从value中提取索引值，在写入与删除数据的同一个事务里维护索引项，索引不会与数据脱节。
+索引项与数据存放在同一个数据库中，key为 idxPrefix + uvarint(len(name)) + name + 转义后的索引值 + 结束符 + 主key，value为空。
+索引值的转义保持字典序：0x00转为0x00 0xFF，末尾加结束符0x00 0x01，因此索引项按索引值、再按主key有序*/
+
+// idxPrefix 索引项的保留前缀，以0x00开头，避免与常见的业务key冲突
+var idxPrefix = []byte("\x00idx:")
+
+// ErrReservedKey 写入的key占用了索引的保留前缀
+var ErrReservedKey = errors.New("key uses the reserved index prefix")
+
+// errSkipIndex 遍历时跳过索引项。遍历回调返回错误的条目不计数
+var errSkipIndex = errors.New("skip index entry")
+
+// rangeIterator 能从指定key开始有序遍历、到指定key停止的数据库
+type rangeIterator interface {
+	// iterRange 有序遍历以prefix开头、key位于[start, end)的键值对，end为nil表示遍历到前缀结束
+	iterRange(prefix, start, end []byte, fn func(k, v []byte) error) int64
+}
+
+// iterKeyRange 有序遍历db中以prefix开头、key位于[start, end)的键值对。
+// db实现了rangeIterator时直接定位到start并在end处停止，否则遍历整个前缀并跳过范围外的条目
+func iterKeyRange(db Database, prefix, start, end []byte, fn func(k, v []byte) error) int64 {
+	if ri, ok := db.(rangeIterator); ok {
+		return ri.iterRange(prefix, start, end, fn)
+	}
+	return db.IterPrefix(prefix, func(k, v []byte) error {
+		if bytes.Compare(k, start) < 0 || (end != nil && bytes.Compare(k, end) >= 0) {
+			return errSkipIndex
+		}
+		return fn(k, v)
+	})
+}
+
+// IndexFunc 从一条数据中提取索引值。返回空表示该条数据不进入索引；返回多个值时该条数据出现在每个索引值之下。
+// IndexFunc可能因事务冲突被重复调用，不应有副作用
+type IndexFunc func(k, v []byte) [][]byte
+
+// Index 索引定义
+type Index struct {
+	Name string
+	Fn   IndexFunc
+}
+
+// IndexedDatabase 带二级索引的数据库，实现Database接口。通过它写入的数据会自动维护索引
+type IndexedDatabase struct {
+	db      Database
+	indexes []Index
+	byName  map[string]*Index
+}
+
+// NewIndexedDatabase 在db之上创建带索引的视图。视图接管db，关闭视图时db一并关闭。
+// 在已有数据的数据库上新增索引后，需调用RebuildIndex为已有数据建立索引
+func NewIndexedDatabase(db Database, indexes ...Index) (*IndexedDatabase, error) {
+	idb := &IndexedDatabase{
+		db:      db,
+		indexes: make([]Index, len(indexes)),
+		byName:  make(map[string]*Index, len(indexes)),
+	}
+	copy(idb.indexes, indexes)
+	for i := range idb.indexes {
+		index := &idb.indexes[i]
+		if index.Name == "" || index.Fn == nil {
+			return nil, errors.New("index requires a name and an IndexFunc")
+		}
+		if _, dup := idb.byName[index.Name]; dup {
+			return nil, fmt.Errorf("duplicate index %s", index.Name)
+		}
+		idb.byName[index.Name] = index
+	}
+	return idb, nil
+}
+
+// idxNamePrefix 索引name下所有索引项的公共前缀
+func idxNamePrefix(name string) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(name)))
+
+	prefix := make([]byte, 0, len(idxPrefix)+n+len(name))
+	prefix = append(prefix, idxPrefix...)
+	prefix = append(prefix, lenBuf[:n]...)
+	prefix = append(prefix, name...)
+	return prefix
+}
+
+// escapeIndexValue 保持字典序地转义索引值，并加上结束符
+func escapeIndexValue(dst, value []byte) []byte {
+	for _, b := range value {
+		if b == 0x00 {
+			dst = append(dst, 0x00, 0xFF)
+		} else {
+			dst = append(dst, b)
+		}
+	}
+	return append(dst, 0x00, 0x01)
+}
+
+// unescapeIndexValue 从索引项中去掉公共前缀后的部分解出索引值与主key
+func unescapeIndexValue(rest []byte) (value, k []byte, err error) {
+	value = make([]byte, 0, len(rest))
+	for i := 0; i < len(rest); i++ {
+		if rest[i] != 0x00 {
+			value = append(value, rest[i])
+			continue
+		}
+		if i+1 >= len(rest) {
+			break
+		}
+		switch rest[i+1] {
+		case 0x01:
+			return value, rest[i+2:], nil
+		case 0xFF:
+			value = append(value, 0x00)
+			i++
+		default:
+			return nil, nil, fmt.Errorf("malformed index entry %q", rest)
+		}
+	}
+	return nil, nil, fmt.Errorf("malformed index entry %q", rest)
+}
+
+// indexEntry 一条索引项的key
+func indexEntry(name string, value, k []byte) []byte {
+	entry := escapeIndexValue(idxNamePrefix(name), value)
+	return append(entry, k...)
+}
+
+// entries 计算一条数据对应的全部索引项
+func (idb *IndexedDatabase) entries(k, v []byte) [][]byte {
+	res := make([][]byte, 0, len(idb.indexes))
+	for _, index := range idb.indexes {
+		for _, value := range index.Fn(k, v) {
+			res = append(res, indexEntry(index.Name, value, k))
+		}
+	}
+	return res
+}
+
+func (idb *IndexedDatabase) index(name string) (*Index, error) {
+	index, ok := idb.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown index %s", name)
+	}
+	return index, nil
+}
+
+// QueryIndex 返回索引name中索引值等于value的全部主key，按主key排序
+func (idb *IndexedDatabase) QueryIndex(name string, value []byte) ([][]byte, error) {
+	if _, err := idb.index(name); err != nil {
+		return nil, err
+	}
+	prefix := escapeIndexValue(idxNamePrefix(name), value)
+	keys := make([][]byte, 0)
+	idb.db.IterPrefix(prefix, func(entry, v []byte) error {
+		keys = append(keys, append([]byte{}, entry[len(prefix):]...))
+		return nil
+	})
+	return keys, nil
+}
+
+// QueryIndexRange 按索引值有序地遍历索引name中索引值位于[start, end)的条目，start或end为nil表示不限。
+// 回调返回错误的条目不计数，返回遍历的条目数
+func (idb *IndexedDatabase) QueryIndexRange(name string, start, end []byte, fn func(value, k []byte) error) (int64, error) {
+	if _, err := idb.index(name); err != nil {
+		return 0, err
+	}
+	// 转义保持字典序，索引值为start的第一条索引项之前、索引值为end的第一条索引项之后的都不在范围内
+	prefix := idxNamePrefix(name)
+	seek, stop := prefix, []byte(nil)
+	if start != nil {
+		seek = escapeIndexValue(idxNamePrefix(name), start)
+	}
+	if end != nil {
+		stop = escapeIndexValue(idxNamePrefix(name), end)
+	}
+	var err error
+	total := iterKeyRange(idb.db, prefix, seek, stop, func(entry, v []byte) error {
+		value, k, decodeErr := unescapeIndexValue(entry[len(prefix):])
+		if decodeErr != nil {
+			err = decodeErr
+			return decodeErr
+		}
+		return fn(value, append([]byte{}, k...))
+	})
+	return total, err
+}
+
+// batchUpdate 对第[from, to)条数据执行write，每backupBatchSize条一个事务。
+// 与底层引擎的BatchSet一致，整批写入不是原子的；某一批超过事务大小上限时对半拆开重试
+func (idb *IndexedDatabase) batchUpdate(from, to int, write func(txn Txn, i int) error) error {
+	if to-from > backupBatchSize {
+		for start := from; start < to; start += backupBatchSize {
+			end := start + backupBatchSize
+			if end > to {
+				end = to
+			}
+			if err := idb.batchUpdate(start, end, write); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := idb.Update(func(txn Txn) error {
+		for i := from; i < to; i++ {
+			if err := write(txn, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, badger.ErrTxnTooBig) && to-from > 1 {
+		mid := (from + to) / 2
+		if err = idb.batchUpdate(from, mid, write); err != nil {
+			return err
+		}
+		return idb.batchUpdate(mid, to, write)
+	}
+	return err
+}
+
+// RebuildIndex 清空索引name并按现有数据重建，返回建立的索引项数。重建的索引项不带过期时间；重建期间的并发写入可能使索引不完整，应在业务低峰执行
+func (idb *IndexedDatabase) RebuildIndex(name string) (int, error) {
+	index, err := idb.index(name)
+	if err != nil {
+		return 0, err
+	}
+	if err = idb.db.DropPrefix(idxNamePrefix(name)); err != nil {
+		return 0, err
+	}
+
+	entries := make([][]byte, 0, backupBatchSize)
+	count := 0
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		err := idb.db.BatchSet(entries, make([][]byte, len(entries)))
+		count += len(entries)
+		entries = entries[:0]
+		return err
+	}
+	idb.IterDB(func(k, v []byte) error {
+		if err != nil {
+			return err
+		}
+		for _, value := range index.Fn(k, v) {
+			entries = append(entries, indexEntry(name, value, k))
+		}
+		if len(entries) >= backupBatchSize {
+			err = flush()
+		}
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, flush()
+}
+
+/*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
+
+func (idb *IndexedDatabase) Set(k, v []byte) error {
+	return idb.Update(func(txn Txn) error {
+		return txn.Set(k, v)
+	})
+}
+
+func (idb *IndexedDatabase) BatchSet(keys, values [][]byte) error {
+	return idb.BatchSetWithTTL(keys, values, make([]int64, len(keys)))
+}
+
+func (idb *IndexedDatabase) SetWithTTL(k, v []byte, expireAt int64) error {
+	return idb.Update(func(txn Txn) error {
+		return txn.SetWithTTL(k, v, expireAt)
+	})
+}
+
+// BatchSetWithTTL 分批写入数据及其索引项，每条数据与它的索引项总在同一个事务中
+func (idb *IndexedDatabase) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	if len(keys) != len(values) || len(keys) != len(expireAts) {
+		return errors.New("key value not the same length")
+	}
+	return idb.batchUpdate(0, len(keys), func(txn Txn, i int) error {
+		return txn.SetWithTTL(keys[i], values[i], expireAts[i])
+	})
+}
+
+func (idb *IndexedDatabase) Get(k []byte) ([]byte, error) {
+	return idb.db.Get(k)
+}
+
+func (idb *IndexedDatabase) BatchGet(keys [][]byte) ([][]byte, error) {
+	return idb.db.BatchGet(keys)
+}
+
+func (idb *IndexedDatabase) Delete(k []byte) error {
+	return idb.BatchDelete([][]byte{k})
+}
+
+// BatchDelete 分批删除数据及其索引项
+func (idb *IndexedDatabase) BatchDelete(keys [][]byte) error {
+	return idb.batchUpdate(0, len(keys), func(txn Txn, i int) error {
+		return txn.Delete(keys[i])
+	})
+}
+
+func (idb *IndexedDatabase) Has(k []byte) bool {
+	return idb.db.Has(k)
+}
+
+// IterDB 遍历全部数据，索引项不会出现在回调中
+func (idb *IndexedDatabase) IterDB(fn func(k, v []byte) error) int64 {
+	return idb.IterPrefix(nil, fn)
+}
+
+func (idb *IndexedDatabase) IterKey(fn func(k []byte) error) int64 {
+	return idb.IterPrefix(nil, func(k, v []byte) error {
+		return fn(k)
+	})
+}
+
+func (idb *IndexedDatabase) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return idb.db.IterPrefix(prefix, func(k, v []byte) error {
+		if bytes.HasPrefix(k, idxPrefix) {
+			return errSkipIndex
+		}
+		return fn(k, v)
+	})
+}
+
+// DropPrefix 逐批删除以prefix开头的数据，同时删除对应的索引项
+func (idb *IndexedDatabase) DropPrefix(prefix []byte) error {
+	keys := make([][]byte, 0)
+	idb.IterKey(func(k []byte) error {
+		if bytes.HasPrefix(k, prefix) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for start := 0; start < len(keys); start += backupBatchSize {
+		end := start + backupBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := idb.BatchDelete(keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idb *IndexedDatabase) Namespace(name string) Database {
+	return newNamespace(idb, name)
+}
+
+// Backup 备份底层数据库，备份中包含索引项，恢复后无需重建索引
+func (idb *IndexedDatabase) Backup(w io.Writer, since uint64) (uint64, error) {
+	return idb.db.Backup(w, since)
+}
+
+func (idb *IndexedDatabase) Restore(r io.Reader) error {
+	return idb.db.Restore(r)
+}
+
+func (idb *IndexedDatabase) Snapshot() (Snapshot, error) {
+	snap, err := idb.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &indexedSnapshot{snap: snap}, nil
+}
+
+func (idb *IndexedDatabase) Size() (int64, int64) {
+	return idb.db.Size()
+}
+
+func (idb *IndexedDatabase) RunGC(discardRatio float64) (int, error) {
+	return idb.db.RunGC(discardRatio)
+}
+
+// Update 事务中的写入与删除会在同一个事务中维护索引项
+func (idb *IndexedDatabase) Update(fn func(txn Txn) error) error {
+	return idb.db.Update(func(txn Txn) error {
+		return fn(&indexedTxn{txn: txn, idb: idb})
+	})
+}
+
+func (idb *IndexedDatabase) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return compareAndSwap(idb, k, old, new)
+}
+
+func (idb *IndexedDatabase) Increment(k []byte, delta int64) (int64, error) {
+	return increment(idb, k, delta)
+}
+
+func (idb *IndexedDatabase) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+	return merge(idb, k, v, fn)
+}
+
+// Subscribe 订阅数据的变更，索引项的变更不会推送
+func (idb *IndexedDatabase) Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+	return idb.db.Subscribe(ctx, prefix, func(kv *KV) {
+		if !bytes.HasPrefix(kv.Key, idxPrefix) {
+			fn(kv)
+		}
+	})
+}
+
+// Close 关闭底层数据库
+func (idb *IndexedDatabase) Close() error {
+	return idb.db.Close()
+}
+
+/*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// Unwrap 返回被包装的数据库
+func (idb *IndexedDatabase) Unwrap() Database {
+	return idb.db
+}
+
+// indexedTxn 维护索引的事务：写入或删除数据前先删除旧值对应的索引项，再写入新值的索引项
+type indexedTxn struct {
+	txn Txn
+	idb *IndexedDatabase
+}
+
+func (it *indexedTxn) Get(k []byte) ([]byte, error) {
+	return it.txn.Get(k)
+}
+
+func (it *indexedTxn) Has(k []byte) bool {
+	return it.txn.Has(k)
+}
+
+func (it *indexedTxn) ExpireAt(k []byte) (int64, error) {
+	return txnExpireAt(it.txn, k)
+}
+
+func (it *indexedTxn) Set(k, v []byte) error {
+	return it.SetWithTTL(k, v, 0)
+}
+
+// SetWithTTL 索引项与数据使用相同的过期时间，数据过期时索引项一起过期
+func (it *indexedTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+	if err := it.removeEntries(k); err != nil {
+		return err
+	}
+	if err := it.txn.SetWithTTL(k, v, expireAt); err != nil {
+		return err
+	}
+	for _, entry := range it.idb.entries(k, v) {
+		if err := it.txn.SetWithTTL(entry, []byte{}, expireAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *indexedTxn) Delete(k []byte) error {
+	if err := it.removeEntries(k); err != nil {
+		return err
+	}
+	return it.txn.Delete(k)
+}
+
+// removeEntries 删除k当前值对应的索引项
+func (it *indexedTxn) removeEntries(k []byte) error {
+	if bytes.HasPrefix(k, idxPrefix) {
+		return ErrReservedKey
+	}
+	old, found, err := txnGet(it.txn, k)
+	if err != nil || !found {
+		return err
+	}
+	for _, entry := range it.idb.entries(k, old) {
+		if err = it.txn.Delete(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedSnapshot 带索引的数据库上的快照，遍历时跳过索引项
+type indexedSnapshot struct {
+	snap Snapshot
+}
+
+func (is *indexedSnapshot) Get(k []byte) ([]byte, error) {
+	return is.snap.Get(k)
+}
+
+func (is *indexedSnapshot) BatchGet(keys [][]byte) ([][]byte, error) {
+	return is.snap.BatchGet(keys)
+}
+
+func (is *indexedSnapshot) Has(k []byte) bool {
+	return is.snap.Has(k)
+}
+
+func (is *indexedSnapshot) IterDB(fn func(k, v []byte) error) int64 {
+	return is.IterPrefix(nil, fn)
+}
+
+func (is *indexedSnapshot) IterKey(fn func(k []byte) error) int64 {
+	return is.IterPrefix(nil, func(k, v []byte) error {
+		return fn(k)
+	})
+}
+
+func (is *indexedSnapshot) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return is.snap.IterPrefix(prefix, func(k, v []byte) error {
+		if bytes.HasPrefix(k, idxPrefix) {
+			return errSkipIndex
+		}
+		return fn(k, v)
+	})
+}
+
+func (is *indexedSnapshot) Release() {
+	is.snap.Release()
+}
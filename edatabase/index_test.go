@@ -0,0 +1,211 @@
+package edatabase
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// cityIndex 测试用索引：value形如"name|city#tags"，按city建索引
+var cityIndex = Index{Name: "city", Fn: func(k, v []byte) [][]byte {
+	if i := bytes.IndexByte(v, '#'); i >= 0 {
+		v = v[:i]
+	}
+	parts := bytes.SplitN(v, []byte("|"), 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil
+	}
+	return [][]byte{parts[1]}
+}}
+
+// tagIndex 测试用多值索引：value中"#"之后的每个字符都是一个标签
+var tagIndex = Index{Name: "tag", Fn: func(k, v []byte) [][]byte {
+	i := bytes.IndexByte(v, '#')
+	if i < 0 {
+		return nil
+	}
+	tags := make([][]byte, 0)
+	for _, c := range v[i+1:] {
+		tags = append(tags, []byte{c})
+	}
+	return tags
+}}
+
+func openIndexedMemory(t *testing.T) *IndexedDatabase {
+	db, err := OpenDatabase("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idb, err := NewIndexedDatabase(db, cityIndex, tagIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idb
+}
+
+func queryKeys(t *testing.T, idb *IndexedDatabase, name, value string) string {
+	keys, err := idb.QueryIndex(name, []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s", keys)
+}
+
+func TestIndexedDatabase(t *testing.T) {
+	idb := openIndexedMemory(t)
+	defer idb.Close()
+
+	checkDatabase(t, idb)
+	checkDatabase(t, idb.Namespace("ns"))
+	checkAtomic(t, idb)
+
+	badger, closeDb := openTempBadger(t)
+	defer closeDb()
+	bidb, err := NewIndexedDatabase(badger, cityIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, bidb)
+	checkAtomic(t, bidb)
+	if n := badger.IterPrefix(idxPrefix, func(k, v []byte) error { return nil }); n != 0 {
+		t.Fatalf("%d index entries left after all data is removed", n)
+	}
+}
+
+func TestQueryIndex(t *testing.T) {
+	idb := openIndexedMemory(t)
+	defer idb.Close()
+
+	_ = idb.BatchSet(
+		[][]byte{[]byte("u1"), []byte("u2"), []byte("u3"), []byte("u4")},
+		[][]byte{[]byte("alice|paris#ab"), []byte("bob|berlin#b"), []byte("carol|paris"), []byte("dave|")},
+	)
+	if got := queryKeys(t, idb, "city", "paris"); got != "[u1 u3]" {
+		t.Fatalf("paris = %s", got)
+	}
+	if got := queryKeys(t, idb, "tag", "b"); got != "[u1 u2]" {
+		t.Fatalf("tag b = %s", got)
+	}
+
+	// 修改后旧索引项被删除
+	_ = idb.Set([]byte("u1"), []byte("alice|berlin"))
+	if got := queryKeys(t, idb, "city", "paris"); got != "[u3]" {
+		t.Fatalf("paris after update = %s", got)
+	}
+	if got := queryKeys(t, idb, "tag", "a"); got != "[]" {
+		t.Fatalf("tag a after update = %s", got)
+	}
+	_ = idb.Delete([]byte("u2"))
+	if got := queryKeys(t, idb, "city", "berlin"); got != "[u1]" {
+		t.Fatalf("berlin after delete = %s", got)
+	}
+
+	// 事务中的写入同样维护索引
+	_, _ = idb.CompareAndSwap([]byte("u3"), []byte("carol|paris"), []byte("carol|rome"))
+	if got := queryKeys(t, idb, "city", "rome"); got != "[u3]" {
+		t.Fatalf("rome after cas = %s", got)
+	}
+
+	_ = idb.Set([]byte("u5"), []byte("eve|a\x00b"))
+	_ = idb.Set([]byte("u6"), []byte("frank|a"))
+	ranged := make([]string, 0)
+	_, err := idb.QueryIndexRange("city", []byte("a"), []byte("rome"), func(value, k []byte) error {
+		ranged = append(ranged, fmt.Sprintf("%q:%s", value, k))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(ranged); got != `["a":u6 "a\x00b":u5 "berlin":u1]` {
+		t.Fatalf("range = %s", got)
+	}
+
+	if _, err = idb.QueryIndex("missing", nil); err == nil {
+		t.Fatal("query of unknown index should fail")
+	}
+	if err = idb.Set(indexEntry("city", []byte("x"), []byte("k")), nil); err != ErrReservedKey {
+		t.Fatalf("write to reserved prefix got %v", err)
+	}
+
+	snap, _ := idb.Snapshot()
+	defer snap.Release()
+	if n := snap.IterKey(func(k []byte) error { return nil }); n != 5 {
+		t.Fatalf("snapshot iterated %d keys, want 5", n)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+	_ = db.Set([]byte("u1"), []byte("alice|paris"))
+	_ = db.Set([]byte("u2"), []byte("bob|paris"))
+
+	idb, _ := NewIndexedDatabase(db, cityIndex)
+	if got := queryKeys(t, idb, "city", "paris"); got != "[]" {
+		t.Fatalf("paris before rebuild = %s", got)
+	}
+	if n, err := idb.RebuildIndex("city"); err != nil || n != 2 {
+		t.Fatalf("RebuildIndex = %d, %v", n, err)
+	}
+	if got := queryKeys(t, idb, "city", "paris"); got != "[u1 u2]" {
+		t.Fatalf("paris after rebuild = %s", got)
+	}
+}
+
+func TestQueryIndexRangeBadger(t *testing.T) {
+	badger, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	for _, db := range []Database{badger, badger.Namespace("ns")} {
+		idb, err := NewIndexedDatabase(db, cityIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = idb.BatchSet(
+			[][]byte{[]byte("u1"), []byte("u2"), []byte("u3"), []byte("u4"), []byte("u5")},
+			[][]byte{[]byte("alice|berlin"), []byte("bob|a\x00b"), []byte("carol|a"), []byte("dave|rome"), []byte("eve|zurich")},
+		)
+		ranged := make([]string, 0)
+		_, err = idb.QueryIndexRange("city", []byte("a"), []byte("rome"), func(value, k []byte) error {
+			ranged = append(ranged, fmt.Sprintf("%q:%s", value, k))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(ranged); got != `["a":u3 "a\x00b":u2 "berlin":u1]` {
+			t.Fatalf("range = %s", got)
+		}
+		n, err := idb.QueryIndexRange("city", []byte("b"), nil, func(value, k []byte) error { return nil })
+		if err != nil || n != 3 {
+			t.Fatalf("open-ended range = %d, %v, want 3", n, err)
+		}
+	}
+}
+
+func TestIndexedBatchSetTooBigForOneTxn(t *testing.T) {
+	badger, closeDb := openTempBadger(t)
+	defer closeDb()
+	idb, err := NewIndexedDatabase(badger, cityIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个key连同索引项写两条，总数超过badger单个事务的上限
+	n := int(badger.(*badgerDb).db.MaxBatchCount())/2 + 1
+	keys, values := make([][]byte, n), make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("u%06d", i))
+		values[i] = []byte("x|paris")
+	}
+	if err = idb.BatchSet(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	cnt, err := idb.QueryIndexRange("city", []byte("paris"), nil, func(value, k []byte) error { return nil })
+	if err != nil || cnt != int64(n) {
+		t.Fatalf("indexed %d keys, %v, want %d", cnt, err, n)
+	}
+	if err = idb.BatchDelete(keys); err != nil {
+		t.Fatal(err)
+	}
+}
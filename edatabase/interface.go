@@ -1,13 +1,19 @@
 package edatabase
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/azd1997/ego/utils"
+	"github.com/dgraph-io/badger"
 )
 
 // TODO: 制定合理的日志记录系统。 参考https://blog.csdn.net/wslyk606/article/details/81670713
@@ -29,75 +35,129 @@ type Database interface {
 	Has(k []byte) bool
 	IterDB(fn func(k, v []byte) error) int64
 	IterKey(fn func(k []byte) error) int64
+	// IterPrefix 只遍历以prefix开头的键值对
+	IterPrefix(prefix []byte, fn func(k, v []byte) error) int64
+	// DropPrefix 批量删除以prefix开头的所有键值对
+	DropPrefix(prefix []byte) error
+	// Namespace 返回名为name的命名空间视图，视图内的key会被透明地加上前缀
+	Namespace(name string) Database
+	// Backup 在线备份，把版本号不小于since的数据写入w，返回本次备份的最大版本号，可作为下次增量备份的since
+	Backup(w io.Writer, since uint64) (uint64, error)
+	// Restore 从Backup产生的备份流中恢复数据
+	Restore(r io.Reader) error
+	// Snapshot 获取一个一致的只读快照，快照存续期间的写入对其不可见
+	Snapshot() (Snapshot, error)
+	// Size 返回LSM tree与value log占用的空间(字节)
+	Size() (lsm, vlog int64)
+	// RunGC 回收垃圾数据，discardRatio为value log文件中垃圾占比的下限，返回回收的文件数
+	RunGC(discardRatio float64) (int, error)
+	// Update 在一个读写事务中执行fn，fn返回nil时其中的全部写入原子生效。发生冲突时fn会被重新执行，因此不应有副作用
+	Update(fn func(txn Txn) error) error
+	// CompareAndSwap 当k的当前值等于old时将其设为new，返回是否替换成功。old为nil表示要求k不存在，new为nil表示删除k
+	CompareAndSwap(k, old, new []byte) (bool, error)
+	// Increment 把k中保存的int64计数器(8字节大端)原子地加上delta，返回新值。k不存在时视为0
+	Increment(k []byte, delta int64) (int64, error)
+	// Merge 用合并操作fn把v原子地合并到k的当前值上，返回合并后的值
+	Merge(k, v []byte, fn MergeFunc) ([]byte, error)
+	// Subscribe 阻塞地把以prefix开头的key的每一次写入与删除按提交顺序交给fn，直到ctx结束(返回ctx.Err())、数据库关闭(返回nil)
+	// 或fn消费太慢积压过多(返回ErrSlowSubscriber)。DropPrefix等批量修改以KV.Bulk推送一次
+	Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error
 	Close() error
 }
 
+// Unwrapper 由包装了另一个Database的视图(加密、索引、指标、命名空间等)实现，
+// 供ReEncrypt等需要找到某一层的功能逐层向下查找
+type Unwrapper interface {
+	Unwrap() Database
+}
 
+// BulkObserver 由希望得知整体操作的视图实现。ReEncrypt等绕过上层视图直接作用于下层数据库的功能，
+// 在逐层查找时收集途经的BulkObserver，操作完成后通知它们
+type BulkObserver interface {
+	ObserveBulk(op string, start time.Time, bytes int, err error)
+}
 
-var dbOpenFunction = map[string]func(path string) (Database, error){
-	"badger": openBadgerDb,
-	//"bolt":   OpenBoltDb,
-	//"couch":  OpenCouchDb,
-	//"level":  OpenLevelDb,
-	//"rocks":  OpenRocksDb,
-	//"sqlite": OpenSqlite,
+// Snapshot 数据库在某一时刻的只读视图。用完必须调用Release释放
+type Snapshot interface {
+	Get(k []byte) ([]byte, error)
+	BatchGet(keys [][]byte) ([][]byte, error)
+	Has(k []byte) bool
+	IterDB(fn func(k, v []byte) error) int64
+	IterKey(fn func(k []byte) error) int64
+	IterPrefix(prefix []byte, fn func(k, v []byte) error) int64
+	Release()
 }
 
 
-// OpenDatabase 根据数据库引擎类型和数据库路径开启或创建新的数据库
-func OpenDatabase(dbEngine string, path string) (Database, error) {
-	if fc, exists := dbOpenFunction[dbEngine]; exists {
-		return fc(path)
-	} else {
-		return nil, fmt.Errorf("unsupported storage engine: %v", dbEngine)
-	}
-}
 
+// ErrKeyNotFound Get读取的key不存在。所有引擎统一返回该错误，与badger.ErrKeyNotFound相同
+var ErrKeyNotFound = badger.ErrKeyNotFound
 
-// DbExists 检查数据库是否存在
-// TODO:现在这个数据库存在检测只是badgerdb适用，后期再扩展
-func DbExists(dbEngine string, path string) bool {
 
-	// 当读取文件信息无错且文件非路径名时，说明我们确实找到了这个MANIFEST，数据库确实存在
-	// 1.先检查数据库存放的路径存不存在，存在则还要求必须为Dir
-	exists, err := utils.DirExists(path)
-	if err != nil {
-		log.Fatal("检查路径是否存在时发生未知错误：", err)
+// OpenDatabase 根据数据库引擎类型和数据库路径开启或创建新的数据库，使用默认配置
+func OpenDatabase(dbEngine string, path string) (Database, error) {
+	return OpenDatabaseWithOptions(dbEngine, path, DefaultOptions())
+}
+
+// OpenDatabaseWithOptions 根据数据库引擎类型、数据库路径和引擎配置开启或创建新的数据库
+func OpenDatabaseWithOptions(dbEngine string, path string, opts *Options) (Database, error) {
+	if opts == nil {
+		opts = DefaultOptions()
 	}
-	if !exists {
-		log.Println(path, ": 数据库路径不存在")
-		return false
+	engine, err := lookupEngine(dbEngine)
+	if err != nil {
+		return nil, err
 	}
-
-	// 确保了数据库指定的路径存在后，检查数据库MANIFEST文件是否存在
-	exists, err = utils.FileExists(path + "/MANIFEST")
+	db, err := engine.Open(path, opts)
 	if err != nil {
-		log.Fatal("检查数据库MANIFEST文件是否存在时发生未知错误：", err)
+		return nil, err
 	}
-	if !exists {
-		// 这属于正常情况，程序应返回结果，让调用程序继续向下执行
-		//log.Println(path + "/MANIFEST", ": 数据库文件不存在")
-		return false
+	if opts.Encryption != nil {
+		edb, err := NewEncryptedDatabase(db, opts.Encryption)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db = edb
 	}
+	if opts.Metrics != nil {
+		mdb, err := NewMetricsDatabase(db, opts.Metrics)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db = mdb
+	}
+	return db, nil
+}
 
-	return true
+
+// DbExists 检查dbEngine引擎的数据库是否存在于path。检查过程出错时返回错误，不会退出进程
+func DbExists(dbEngine string, path string) (bool, error) {
+	engine, err := lookupEngine(dbEngine)
+	if err != nil {
+		return false, err
+	}
+	return engine.Exists(path)
 }
 
-// OpenDatabaseWithRetry 打开数据库，不成则retry一次
+// OpenDatabaseWithRetry 打开数据库，遇到ErrLocked时尝试清理残留的锁文件并retry一次。
+// 只有当锁文件中记录的进程已经不存在时才会删除锁文件，绝不会抢占存活进程持有的数据库
 func OpenDatabaseWithRetry(dbEngine string, path string) (Database, error) {
 
 	var (
-		db Database
+		db  Database
 		err error
 	)
 	if db, err = OpenDatabase(dbEngine, path); err != nil {
-		//报错信息包含“LOCK”，则retry
-		if strings.Contains(err.Error(), "LOCK") {
+		if errors.Is(err, ErrLocked) {
 			if db, err := retry(dbEngine, path); err == nil {
-				log.Println("database unlocked, value log truncated")
+				log.Println("stale lock removed, database reopened")
 				return db, nil
+			} else {
+				log.Println("could not unlock database:", err)
+				return nil, err
 			}
-			log.Println("could not unlock database:", err)
 		}
 		return nil, err
 	}
@@ -105,26 +165,29 @@ func OpenDatabaseWithRetry(dbEngine string, path string) (Database, error) {
 	return db, nil
 }
 
-// retry
+// retry 检查锁文件的持有者，确认其已退出后删除锁文件并重新打开
 func retry(dbEngine string, path string) (Database, error) {
 
 	var (
 		lockPath string
-		db Database
-		err error
+		content  []byte
+		pid      int
+		err      error
 	)
 
 	lockPath = filepath.Join(path, "LOCK")
-	if err = os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	if content, err = ioutil.ReadFile(lockPath); err != nil {
+		return nil, fmt.Errorf("%w: reading LOCK: %v", ErrLocked, err)
 	}
-	if db, err = OpenDatabase(dbEngine, path); err != nil {
-		return nil, err
+	if pid, err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil {
+		return nil, fmt.Errorf("%w: LOCK does not contain a pid: %q", ErrLocked, content)
+	}
+	if pid == os.Getpid() || processAlive(pid) {
+		return nil, fmt.Errorf("%w: held by live process %d", ErrLocked, pid)
 	}
 
-	return db, nil
+	if err = os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+	return OpenDatabase(dbEngine, path)
 }
-
-
-// TODO:所有实现Database接口的数据库引擎的配置文件应做配置文件分离，实现外部更改配置文件来修改程序内部的配置文件
-
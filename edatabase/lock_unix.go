@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package edatabase
+
+import (
+	"os"
+	"syscall"
+)
+
+// processAlive 判断pid对应的进程是否存活。发送0号信号只做权限和存在性检查，不会真正打扰目标进程
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	// EPERM说明进程存在，只是属于其他用户
+	return err == nil || err == syscall.EPERM
+}
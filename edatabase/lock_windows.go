@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package edatabase
+
+import "os"
+
+// processAlive 判断pid对应的进程是否存活。windows上FindProcess会打开进程句柄，进程不存在时返回错误
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	proc.Release()
+	return true
+}
@@ -0,0 +1,525 @@
+package edatabase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azd1997/ego/elog2"
+)
+
+/*metrics.go 指标与慢操作日志：在任意Database之上记录每个方法的耗时分布、调用次数、错误次数与读写字节数。
+指标通过Metrics接口上报，可以对接任意监控系统；内置的MetricsRegistry可以输出Prometheus文本格式*/
+
+// Metrics 指标收集接口，实现必须并发安全
+type Metrics interface {
+	// ObserveOp 记录一次操作。db为数据库名，op为方法名，bytes为读写的key与value的总字节数。
+	// err为操作返回的错误，Get等读取返回的ErrKeyNotFound不算错误，此时err为nil
+	ObserveOp(db, op string, d time.Duration, bytes int, err error)
+}
+
+// MetricsOptions 指标配置
+type MetricsOptions struct {
+	// Metrics 指标收集器，必填
+	Metrics Metrics
+	// Name 数据库名，用于区分同一进程中的多个数据库
+	Name string
+	// SlowThreshold 耗时不小于该值的操作记入慢操作日志，0表示不记录
+	SlowThreshold time.Duration
+	// Logger 慢操作日志，SlowThreshold大于0时必填
+	Logger elog2.Interface
+}
+
+// slowKeyLimit 慢操作日志中key最多显示的字节数
+const slowKeyLimit = 64
+
+// metricsDb 记录指标的视图，实现Database接口
+type metricsDb struct {
+	db   Database
+	opts MetricsOptions
+}
+
+// NewMetricsDatabase 在db之上创建记录指标的视图。视图接管db，关闭视图时db一并关闭。
+// 遍历类方法的耗时包含回调fn的执行时间
+func NewMetricsDatabase(db Database, opts *MetricsOptions) (Database, error) {
+	if opts == nil || opts.Metrics == nil {
+		return nil, errors.New("metrics requires a Metrics collector")
+	}
+	if opts.SlowThreshold > 0 && opts.Logger == nil {
+		return nil, errors.New("slow operation logging requires a Logger")
+	}
+	return &metricsDb{db: db, opts: *opts}, nil
+}
+
+// observe 上报一次操作，k为操作涉及的key，只用于慢操作日志
+func (md *metricsDb) observe(op string, start time.Time, bytes int, err error, k []byte) {
+	d := time.Since(start)
+	if err == ErrKeyNotFound {
+		err = nil
+	}
+	md.opts.Metrics.ObserveOp(md.opts.Name, op, d, bytes, err)
+	if md.opts.SlowThreshold <= 0 || d < md.opts.SlowThreshold {
+		return
+	}
+	if len(k) > slowKeyLimit {
+		k = k[:slowKeyLimit]
+	}
+	if err != nil {
+		md.opts.Logger.Warn("slow database operation: db=%s op=%s key=%q took %v, err: %v", md.opts.Name, op, k, d, err)
+	} else {
+		md.opts.Logger.Warn("slow database operation: db=%s op=%s key=%q took %v", md.opts.Name, op, k, d)
+	}
+}
+
+// sizeOf 一组key或value的总字节数
+func sizeOf(bs [][]byte) int {
+	n := 0
+	for _, b := range bs {
+		n += len(b)
+	}
+	return n
+}
+
+// firstKey 批量操作在慢操作日志中显示的key
+func firstKey(keys [][]byte) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[0]
+}
+
+/*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
+
+func (md *metricsDb) Set(k, v []byte) error {
+	start := time.Now()
+	err := md.db.Set(k, v)
+	md.observe("Set", start, len(k)+len(v), err, k)
+	return err
+}
+
+func (md *metricsDb) BatchSet(keys, values [][]byte) error {
+	start := time.Now()
+	err := md.db.BatchSet(keys, values)
+	md.observe("BatchSet", start, sizeOf(keys)+sizeOf(values), err, firstKey(keys))
+	return err
+}
+
+func (md *metricsDb) SetWithTTL(k, v []byte, expireAt int64) error {
+	start := time.Now()
+	err := md.db.SetWithTTL(k, v, expireAt)
+	md.observe("SetWithTTL", start, len(k)+len(v), err, k)
+	return err
+}
+
+func (md *metricsDb) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	start := time.Now()
+	err := md.db.BatchSetWithTTL(keys, values, expireAts)
+	md.observe("BatchSetWithTTL", start, sizeOf(keys)+sizeOf(values), err, firstKey(keys))
+	return err
+}
+
+func (md *metricsDb) Get(k []byte) ([]byte, error) {
+	start := time.Now()
+	v, err := md.db.Get(k)
+	md.observe("Get", start, len(k)+len(v), err, k)
+	return v, err
+}
+
+func (md *metricsDb) BatchGet(keys [][]byte) ([][]byte, error) {
+	start := time.Now()
+	values, err := md.db.BatchGet(keys)
+	md.observe("BatchGet", start, sizeOf(keys)+sizeOf(values), err, firstKey(keys))
+	return values, err
+}
+
+func (md *metricsDb) Delete(k []byte) error {
+	start := time.Now()
+	err := md.db.Delete(k)
+	md.observe("Delete", start, len(k), err, k)
+	return err
+}
+
+func (md *metricsDb) BatchDelete(keys [][]byte) error {
+	start := time.Now()
+	err := md.db.BatchDelete(keys)
+	md.observe("BatchDelete", start, sizeOf(keys), err, firstKey(keys))
+	return err
+}
+
+func (md *metricsDb) Has(k []byte) bool {
+	start := time.Now()
+	ok := md.db.Has(k)
+	md.observe("Has", start, len(k), nil, k)
+	return ok
+}
+
+func (md *metricsDb) IterDB(fn func(k, v []byte) error) int64 {
+	start := time.Now()
+	bytes := 0
+	n := md.db.IterDB(func(k, v []byte) error {
+		bytes += len(k) + len(v)
+		return fn(k, v)
+	})
+	md.observe("IterDB", start, bytes, nil, nil)
+	return n
+}
+
+func (md *metricsDb) IterKey(fn func(k []byte) error) int64 {
+	start := time.Now()
+	bytes := 0
+	n := md.db.IterKey(func(k []byte) error {
+		bytes += len(k)
+		return fn(k)
+	})
+	md.observe("IterKey", start, bytes, nil, nil)
+	return n
+}
+
+func (md *metricsDb) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	start := time.Now()
+	bytes := 0
+	n := md.db.IterPrefix(prefix, func(k, v []byte) error {
+		bytes += len(k) + len(v)
+		return fn(k, v)
+	})
+	md.observe("IterPrefix", start, bytes, nil, prefix)
+	return n
+}
+
+func (md *metricsDb) DropPrefix(prefix []byte) error {
+	start := time.Now()
+	err := md.db.DropPrefix(prefix)
+	md.observe("DropPrefix", start, len(prefix), err, prefix)
+	return err
+}
+
+func (md *metricsDb) Namespace(name string) Database {
+	return newNamespace(md, name)
+}
+
+func (md *metricsDb) Backup(w io.Writer, since uint64) (uint64, error) {
+	start := time.Now()
+	cw := &countingWriter{w: w}
+	version, err := md.db.Backup(cw, since)
+	md.observe("Backup", start, int(cw.n), err, nil)
+	return version, err
+}
+
+func (md *metricsDb) Restore(r io.Reader) error {
+	start := time.Now()
+	cr := &countingReader{r: r}
+	err := md.db.Restore(cr)
+	md.observe("Restore", start, int(cr.n), err, nil)
+	return err
+}
+
+func (md *metricsDb) Snapshot() (Snapshot, error) {
+	start := time.Now()
+	snap, err := md.db.Snapshot()
+	md.observe("Snapshot", start, 0, err, nil)
+	return snap, err
+}
+
+func (md *metricsDb) Size() (int64, int64) {
+	return md.db.Size()
+}
+
+func (md *metricsDb) RunGC(discardRatio float64) (int, error) {
+	start := time.Now()
+	n, err := md.db.RunGC(discardRatio)
+	md.observe("RunGC", start, 0, err, nil)
+	return n, err
+}
+
+// Update 整个事务记为一次操作，字节数为事务中读写的总字节数
+func (md *metricsDb) Update(fn func(txn Txn) error) error {
+	start := time.Now()
+	var mt *metricsTxn
+	err := md.db.Update(func(txn Txn) error {
+		mt = &metricsTxn{txn: txn}
+		return fn(mt)
+	})
+	bytes := 0
+	if mt != nil {
+		bytes = mt.bytes
+	}
+	md.observe("Update", start, bytes, err, nil)
+	return err
+}
+
+func (md *metricsDb) CompareAndSwap(k, old, new []byte) (bool, error) {
+	start := time.Now()
+	swapped, err := md.db.CompareAndSwap(k, old, new)
+	md.observe("CompareAndSwap", start, len(k)+len(old)+len(new), err, k)
+	return swapped, err
+}
+
+func (md *metricsDb) Increment(k []byte, delta int64) (int64, error) {
+	start := time.Now()
+	n, err := md.db.Increment(k, delta)
+	md.observe("Increment", start, len(k)+8, err, k)
+	return n, err
+}
+
+func (md *metricsDb) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+	start := time.Now()
+	merged, err := md.db.Merge(k, v, fn)
+	md.observe("Merge", start, len(k)+len(v)+len(merged), err, k)
+	return merged, err
+}
+
+// Subscribe 订阅会一直阻塞，不记录指标
+func (md *metricsDb) Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+	return md.db.Subscribe(ctx, prefix, fn)
+}
+
+// Close 关闭底层数据库
+func (md *metricsDb) Close() error {
+	return md.db.Close()
+}
+
+/*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// Unwrap 返回被包装的数据库
+func (md *metricsDb) Unwrap() Database {
+	return md.db
+}
+
+// ObserveBulk 记录绕过本视图直接作用于下层数据库的整体操作(如ReEncrypt)
+func (md *metricsDb) ObserveBulk(op string, start time.Time, bytes int, err error) {
+	md.observe(op, start, bytes, err, nil)
+}
+
+// metricsTxn 统计事务中读写的字节数
+type metricsTxn struct {
+	txn   Txn
+	bytes int
+}
+
+func (mt *metricsTxn) Get(k []byte) ([]byte, error) {
+	v, err := mt.txn.Get(k)
+	mt.bytes += len(k) + len(v)
+	return v, err
+}
+
+func (mt *metricsTxn) Has(k []byte) bool {
+	mt.bytes += len(k)
+	return mt.txn.Has(k)
+}
+
+func (mt *metricsTxn) ExpireAt(k []byte) (int64, error) {
+	mt.bytes += len(k)
+	return txnExpireAt(mt.txn, k)
+}
+
+func (mt *metricsTxn) Set(k, v []byte) error {
+	mt.bytes += len(k) + len(v)
+	return mt.txn.Set(k, v)
+}
+
+func (mt *metricsTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+	mt.bytes += len(k) + len(v)
+	return mt.txn.SetWithTTL(k, v, expireAt)
+}
+
+func (mt *metricsTxn) Delete(k []byte) error {
+	mt.bytes += len(k)
+	return mt.txn.Delete(k)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// DefaultLatencyBuckets 默认的耗时分桶上界(秒)，从100微秒到10秒
+var DefaultLatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// OpStats 一个数据库上一种操作的累计指标
+type OpStats struct {
+	DB     string
+	Op     string
+	Count  uint64
+	Errors uint64
+	Bytes  uint64
+	Total  time.Duration // 累计耗时
+	// Buckets 耗时分布，Buckets[i]为耗时不超过MetricsRegistry分桶上界[i]的操作数(累计值)
+	Buckets []uint64
+}
+
+// opSeries 一种操作的指标，用原子操作更新
+type opSeries struct {
+	db, op  string
+	errors  uint64
+	bytes   uint64
+	nanos   uint64
+	buckets []uint64 // 非累计的分桶计数，最后一个为+Inf
+}
+
+// MetricsRegistry 内置的Metrics实现，在内存中累计指标，可以输出Prometheus文本格式。
+// 同时实现了http.Handler，可以直接挂到/metrics上
+type MetricsRegistry struct {
+	prefix string
+	bounds []float64
+	mu     sync.RWMutex
+	series map[[2]string]*opSeries
+}
+
+// NewMetricsRegistry 创建指标注册表。prefix为指标名前缀，为空时使用edatabase；buckets为耗时分桶上界(秒)，为nil时使用DefaultLatencyBuckets
+func NewMetricsRegistry(prefix string, buckets []float64) *MetricsRegistry {
+	if prefix == "" {
+		prefix = "edatabase"
+	}
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	bounds := append([]float64{}, buckets...)
+	sort.Float64s(bounds)
+	return &MetricsRegistry{
+		prefix: prefix,
+		bounds: bounds,
+		series: make(map[[2]string]*opSeries),
+	}
+}
+
+func (mr *MetricsRegistry) ObserveOp(db, op string, d time.Duration, bytes int, err error) {
+	key := [2]string{db, op}
+	mr.mu.RLock()
+	s, ok := mr.series[key]
+	mr.mu.RUnlock()
+	if !ok {
+		mr.mu.Lock()
+		if s, ok = mr.series[key]; !ok {
+			s = &opSeries{db: db, op: op, buckets: make([]uint64, len(mr.bounds)+1)}
+			mr.series[key] = s
+		}
+		mr.mu.Unlock()
+	}
+
+	i := sort.SearchFloat64s(mr.bounds, d.Seconds()) // 第一个不小于耗时的上界
+	atomic.AddUint64(&s.buckets[i], 1)
+	atomic.AddUint64(&s.nanos, uint64(d))
+	atomic.AddUint64(&s.bytes, uint64(bytes))
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+}
+
+// Stats 返回全部累计指标，按数据库名与操作名排序
+func (mr *MetricsRegistry) Stats() []OpStats {
+	mr.mu.RLock()
+	stats := make([]OpStats, 0, len(mr.series))
+	for _, s := range mr.series {
+		st := OpStats{
+			DB:      s.db,
+			Op:      s.op,
+			Errors:  atomic.LoadUint64(&s.errors),
+			Bytes:   atomic.LoadUint64(&s.bytes),
+			Total:   time.Duration(atomic.LoadUint64(&s.nanos)),
+			Buckets: make([]uint64, len(mr.bounds)),
+		}
+		// 总次数由分桶累加得到，保证+Inf桶不小于最后一个有限桶
+		var cum uint64
+		for i := range mr.bounds {
+			cum += atomic.LoadUint64(&s.buckets[i])
+			st.Buckets[i] = cum
+		}
+		st.Count = cum + atomic.LoadUint64(&s.buckets[len(mr.bounds)])
+		stats = append(stats, st)
+	}
+	mr.mu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].DB != stats[j].DB {
+			return stats[i].DB < stats[j].DB
+		}
+		return stats[i].Op < stats[j].Op
+	})
+	return stats
+}
+
+// WritePrometheus 以Prometheus文本格式输出全部指标
+func (mr *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	stats := mr.Stats()
+	labels := func(st *OpStats) string {
+		return fmt.Sprintf(`db="%s",op="%s"`, labelEscaper.Replace(st.DB), labelEscaper.Replace(st.Op))
+	}
+
+	name := mr.prefix + "_op_duration_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Latency of database operations.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+	for i := range stats {
+		st := &stats[i]
+		for j, bound := range mr.bounds {
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels(st), formatFloat(bound), st.Buckets[j])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(st), st.Count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels(st), formatFloat(st.Total.Seconds()))
+		if _, err := fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(st), st.Count); err != nil {
+			return err
+		}
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(st *OpStats) uint64
+	}{
+		{"_op_errors_total", "Number of failed database operations.", func(st *OpStats) uint64 { return st.Errors }},
+		{"_op_bytes_total", "Bytes of keys and values read or written by database operations.", func(st *OpStats) uint64 { return st.Bytes }},
+	}
+	for _, c := range counters {
+		name = mr.prefix + c.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name); err != nil {
+			return err
+		}
+		for i := range stats {
+			if _, err := fmt.Fprintf(w, "%s{%s} %d\n", name, labels(&stats[i]), c.value(&stats[i])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ServeHTTP 输出Prometheus文本格式的指标
+func (mr *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mr.WritePrometheus(w)
+}
+
+// labelEscaper 按Prometheus文本格式转义标签值
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
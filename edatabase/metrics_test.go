@@ -0,0 +1,192 @@
+package edatabase
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureLogger 记录Warn日志的elog2.Interface
+type captureLogger struct {
+	mu    sync.Mutex
+	warns []string
+}
+
+func (cl *captureLogger) SetLevel(level int)                       {}
+func (cl *captureLogger) Debug(format string, args ...interface{}) {}
+func (cl *captureLogger) Trace(format string, args ...interface{}) {}
+func (cl *captureLogger) Info(format string, args ...interface{})  {}
+func (cl *captureLogger) Error(format string, args ...interface{}) {}
+func (cl *captureLogger) Fatal(format string, args ...interface{}) {}
+func (cl *captureLogger) Close()                                   {}
+
+func (cl *captureLogger) Warn(format string, args ...interface{}) {
+	cl.mu.Lock()
+	cl.warns = append(cl.warns, fmt.Sprintf(format, args...))
+	cl.mu.Unlock()
+}
+
+func findStats(stats []OpStats, op string) OpStats {
+	for _, st := range stats {
+		if st.Op == op {
+			return st
+		}
+	}
+	return OpStats{}
+}
+
+func TestMetricsDatabase(t *testing.T) {
+	registry := NewMetricsRegistry("", nil)
+	opts := DefaultOptions()
+	opts.Metrics = &MetricsOptions{Metrics: registry, Name: "main"}
+	db, err := OpenDatabaseWithOptions("memory", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkDatabase(t, db)
+
+	if err = db.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get([]byte("missing")); err != ErrKeyNotFound {
+		t.Fatalf("Get missing = %v", err)
+	}
+	if err = db.BatchSet([][]byte{[]byte("k")}, nil); err == nil {
+		t.Fatal("BatchSet with mismatched lengths should fail")
+	}
+	if _, err = db.Increment([]byte("counter"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := registry.Stats()
+	set := findStats(stats, "Set")
+	if set.DB != "main" || set.Count == 0 || set.Bytes < uint64(len("key")+len("value")) || set.Errors != 0 {
+		t.Fatalf("Set stats = %+v", set)
+	}
+	if get := findStats(stats, "Get"); get.Count == 0 || get.Errors != 0 {
+		t.Fatalf("Get stats = %+v, ErrKeyNotFound must not count as an error", get)
+	}
+	if batch := findStats(stats, "BatchSet"); batch.Errors != 1 {
+		t.Fatalf("BatchSet stats = %+v", batch)
+	}
+	if inc := findStats(stats, "Increment"); inc.Count != 1 {
+		t.Fatalf("Increment stats = %+v", inc)
+	}
+	for _, st := range stats {
+		if n := st.Buckets[len(st.Buckets)-1]; n > st.Count {
+			t.Fatalf("%s: bucket count %d exceeds total %d", st.Op, n, st.Count)
+		}
+	}
+
+	// 命名空间中的操作同样被记录
+	before := findStats(registry.Stats(), "Set").Count
+	if err = db.Namespace("ns").Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if after := findStats(registry.Stats(), "Set").Count; after <= before {
+		t.Fatalf("namespace Set not recorded: %d -> %d", before, after)
+	}
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	registry := NewMetricsRegistry("app_db", []float64{0.001, 0.01})
+	registry.ObserveOp("users", "Get", 5*time.Millisecond, 10, nil)
+	registry.ObserveOp("users", "Get", 20*time.Millisecond, 6, ErrCorrupt)
+	registry.ObserveOp(`we"ird`, "Set", time.Microsecond, 1, nil)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE app_db_op_duration_seconds histogram",
+		`app_db_op_duration_seconds_bucket{db="users",op="Get",le="0.001"} 0`,
+		`app_db_op_duration_seconds_bucket{db="users",op="Get",le="0.01"} 1`,
+		`app_db_op_duration_seconds_bucket{db="users",op="Get",le="+Inf"} 2`,
+		`app_db_op_duration_seconds_sum{db="users",op="Get"} 0.025`,
+		`app_db_op_duration_seconds_count{db="users",op="Get"} 2`,
+		"# TYPE app_db_op_errors_total counter",
+		`app_db_op_errors_total{db="users",op="Get"} 1`,
+		`app_db_op_bytes_total{db="users",op="Get"} 16`,
+		`app_db_op_bytes_total{db="we\"ird",op="Set"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, out)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+}
+
+func TestMetricsSlowLog(t *testing.T) {
+	if _, err := NewMetricsDatabase(newTestMemoryDb(t), &MetricsOptions{Metrics: NewMetricsRegistry("", nil), SlowThreshold: time.Second}); err == nil {
+		t.Fatal("SlowThreshold without Logger should fail")
+	}
+
+	logger := &captureLogger{}
+	db, err := NewMetricsDatabase(newTestMemoryDb(t), &MetricsOptions{
+		Metrics:       NewMetricsRegistry("", nil),
+		Name:          "slow",
+		SlowThreshold: time.Nanosecond,
+		Logger:        logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Set(bytes.Repeat([]byte("k"), 100), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.warns) != 1 {
+		t.Fatalf("got %d slow logs, want 1", len(logger.warns))
+	}
+	if w := logger.warns[0]; !strings.Contains(w, "op=Set") || !strings.Contains(w, "db=slow") || strings.Contains(w, strings.Repeat("k", slowKeyLimit+1)) {
+		t.Fatalf("slow log = %q", w)
+	}
+}
+
+func newTestMemoryDb(t *testing.T) Database {
+	db, err := openMemoryDb("", DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMetricsStatsConsistent(t *testing.T) {
+	reg := NewMetricsRegistry("", []float64{0.001})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					reg.ObserveOp("db", "Get", time.Microsecond, 0, nil)
+				}
+			}
+		}()
+	}
+
+	// 并发写入时读到的Count不小于最后一个有限桶
+	for i := 0; i < 1000; i++ {
+		for _, st := range reg.Stats() {
+			if last := st.Buckets[len(st.Buckets)-1]; st.Count < last {
+				close(stop)
+				wg.Wait()
+				t.Fatalf("Count %d below last bucket %d", st.Count, last)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,342 @@
+package edatabase
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+/*namespace.go 在同一个Database上划分出多个互不干扰的命名空间(类似列族)*/
+
+// 命名空间相关的保留前缀。以0x00开头，避免与常见的业务key冲突
+var (
+	nsDataPrefix     = []byte("\x00ns:")    // 命名空间数据：nsDataPrefix + uvarint(len(name)) + name + key
+	nsRegistryPrefix = []byte("\x00nsreg:") // 命名空间登记：nsRegistryPrefix + name
+)
+
+// nsKeyPrefix 命名空间name下所有key的公共前缀。名字长度以uvarint编码在前，保证"a"与"ab"的前缀互不包含
+func nsKeyPrefix(name string) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(name)))
+
+	prefix := make([]byte, 0, len(nsDataPrefix)+n+len(name))
+	prefix = append(prefix, nsDataPrefix...)
+	prefix = append(prefix, lenBuf[:n]...)
+	prefix = append(prefix, name...)
+	return prefix
+}
+
+// nsRegistryKey 命名空间name的登记key
+func nsRegistryKey(name string) []byte {
+	return concat(nsRegistryPrefix, []byte(name))
+}
+
+// concat 拼接两个字节切片，返回新切片，不会修改a的底层数组
+func concat(a, b []byte) []byte {
+	res := make([]byte, len(a)+len(b))
+	copy(res, a)
+	copy(res[len(a):], b)
+	return res
+}
+
+// namespaceDb 命名空间视图，实现Database接口。所有key在落盘前加上命名空间前缀，读出时去掉前缀
+type namespaceDb struct {
+	db         Database
+	name       string
+	prefix     []byte
+	registered int32 // 是否已经在底层数据库中登记过该命名空间
+}
+
+// newNamespace 在db上创建名为name的命名空间视图。db本身也可以是命名空间视图，从而形成嵌套
+func newNamespace(db Database, name string) Database {
+	return &namespaceDb{
+		db:     db,
+		name:   name,
+		prefix: nsKeyPrefix(name),
+	}
+}
+
+// ListNamespaces 列出db上已经写入过数据的命名空间
+func ListNamespaces(db Database) ([]string, error) {
+	names := make([]string, 0)
+	db.IterPrefix(nsRegistryPrefix, func(k, v []byte) error {
+		names = append(names, string(k[len(nsRegistryPrefix):]))
+		return nil
+	})
+	return names, nil
+}
+
+// DropNamespace 批量删除命名空间name下的全部数据及其登记信息。
+// 删除前创建的视图对象不会再次登记，若删除后还要继续使用该命名空间，应重新调用Namespace获取视图
+func DropNamespace(db Database, name string) error {
+	if err := db.DropPrefix(nsKeyPrefix(name)); err != nil {
+		return err
+	}
+	return db.Delete(nsRegistryKey(name))
+}
+
+// register 第一次写入时在底层数据库登记命名空间，供ListNamespaces使用
+func (nd *namespaceDb) register() error {
+	if atomic.LoadInt32(&nd.registered) == 1 {
+		return nil
+	}
+	regKey := nsRegistryKey(nd.name)
+	if !nd.db.Has(regKey) {
+		if err := nd.db.Set(regKey, []byte{}); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&nd.registered, 1)
+	return nil
+}
+
+func (nd *namespaceDb) key(k []byte) []byte {
+	return concat(nd.prefix, k)
+}
+
+func (nd *namespaceDb) keys(ks [][]byte) [][]byte {
+	res := make([][]byte, len(ks))
+	for i, k := range ks {
+		res[i] = nd.key(k)
+	}
+	return res
+}
+
+/*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
+
+func (nd *namespaceDb) Set(k, v []byte) error {
+	if err := nd.register(); err != nil {
+		return err
+	}
+	return nd.db.Set(nd.key(k), v)
+}
+
+func (nd *namespaceDb) BatchSet(keys, values [][]byte) error {
+	if err := nd.register(); err != nil {
+		return err
+	}
+	return nd.db.BatchSet(nd.keys(keys), values)
+}
+
+func (nd *namespaceDb) SetWithTTL(k, v []byte, expireAt int64) error {
+	if err := nd.register(); err != nil {
+		return err
+	}
+	return nd.db.SetWithTTL(nd.key(k), v, expireAt)
+}
+
+func (nd *namespaceDb) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	if err := nd.register(); err != nil {
+		return err
+	}
+	return nd.db.BatchSetWithTTL(nd.keys(keys), values, expireAts)
+}
+
+func (nd *namespaceDb) Get(k []byte) ([]byte, error) {
+	return nd.db.Get(nd.key(k))
+}
+
+func (nd *namespaceDb) BatchGet(keys [][]byte) ([][]byte, error) {
+	return nd.db.BatchGet(nd.keys(keys))
+}
+
+func (nd *namespaceDb) Delete(k []byte) error {
+	return nd.db.Delete(nd.key(k))
+}
+
+func (nd *namespaceDb) BatchDelete(keys [][]byte) error {
+	return nd.db.BatchDelete(nd.keys(keys))
+}
+
+func (nd *namespaceDb) Has(k []byte) bool {
+	return nd.db.Has(nd.key(k))
+}
+
+// IterDB 只遍历本命名空间，回调拿到的key不含命名空间前缀
+func (nd *namespaceDb) IterDB(fn func(k, v []byte) error) int64 {
+	return nd.IterPrefix(nil, fn)
+}
+
+func (nd *namespaceDb) IterKey(fn func(k []byte) error) int64 {
+	return nd.db.IterPrefix(nd.prefix, func(k, v []byte) error {
+		return fn(k[len(nd.prefix):])
+	})
+}
+
+func (nd *namespaceDb) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return nd.db.IterPrefix(nd.key(prefix), func(k, v []byte) error {
+		return fn(k[len(nd.prefix):], v)
+	})
+}
+
+func (nd *namespaceDb) DropPrefix(prefix []byte) error {
+	return nd.db.DropPrefix(nd.key(prefix))
+}
+
+func (nd *namespaceDb) Namespace(name string) Database {
+	return newNamespace(nd, name)
+}
+
+// Backup 只备份本命名空间的数据，key不含命名空间前缀。视图不记录版本号，只支持全量备份(since为0)
+func (nd *namespaceDb) Backup(w io.Writer, since uint64) (uint64, error) {
+	return backupByIter(nd, w, since)
+}
+
+// Restore 把备份数据恢复到本命名空间
+func (nd *namespaceDb) Restore(r io.Reader) error {
+	return restoreByWrite(nd, r)
+}
+
+func (nd *namespaceDb) Snapshot() (Snapshot, error) {
+	snap, err := nd.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceSnapshot{snap: snap, prefix: nd.prefix}, nil
+}
+
+// Size 命名空间与底层数据库共享存储，返回底层数据库的大小
+func (nd *namespaceDb) Size() (int64, int64) {
+	return nd.db.Size()
+}
+
+// RunGC 对底层数据库执行GC
+func (nd *namespaceDb) RunGC(discardRatio float64) (int, error) {
+	return nd.db.RunGC(discardRatio)
+}
+
+// Update 事务中读写的key同样限定在本命名空间
+func (nd *namespaceDb) Update(fn func(txn Txn) error) error {
+	if err := nd.register(); err != nil {
+		return err
+	}
+	return nd.db.Update(func(txn Txn) error {
+		return fn(&namespaceTxn{txn: txn, prefix: nd.prefix})
+	})
+}
+
+func (nd *namespaceDb) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return compareAndSwap(nd, k, old, new)
+}
+
+func (nd *namespaceDb) Increment(k []byte, delta int64) (int64, error) {
+	return increment(nd, k, delta)
+}
+
+func (nd *namespaceDb) Merge(k, v []byte, fn MergeFunc) ([]byte, error) {
+	return merge(nd, k, v, fn)
+}
+
+// Subscribe 订阅本命名空间内以prefix开头的key的变更，推送的key不含命名空间前缀
+func (nd *namespaceDb) Subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+	return nd.db.Subscribe(ctx, nd.key(prefix), func(kv *KV) {
+		nsKV := *kv
+		if len(kv.Key) < len(nd.prefix) {
+			// 覆盖了整个命名空间的批量变更
+			nsKV.Key = nil
+		} else {
+			nsKV.Key = kv.Key[len(nd.prefix):]
+		}
+		fn(&nsKV)
+	})
+}
+
+// Close 视图不持有底层数据库，关闭视图什么都不做，底层数据库需由打开者关闭
+func (nd *namespaceDb) Close() error {
+	return nil
+}
+
+/*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// Unwrap 返回被包装的数据库
+func (nd *namespaceDb) Unwrap() Database {
+	return nd.db
+}
+
+// iterRange 在底层数据库上按范围遍历本命名空间，底层数据库不支持时退回到遍历前缀
+func (nd *namespaceDb) iterRange(prefix, start, end []byte, fn func(k, v []byte) error) int64 {
+	var innerEnd []byte
+	if end != nil {
+		innerEnd = nd.key(end)
+	}
+	return iterKeyRange(nd.db, nd.key(prefix), nd.key(start), innerEnd, func(k, v []byte) error {
+		return fn(k[len(nd.prefix):], v)
+	})
+}
+
+// namespaceSnapshot 命名空间视图上的快照
+type namespaceSnapshot struct {
+	snap   Snapshot
+	prefix []byte
+}
+
+func (ns *namespaceSnapshot) key(k []byte) []byte {
+	return concat(ns.prefix, k)
+}
+
+func (ns *namespaceSnapshot) Get(k []byte) ([]byte, error) {
+	return ns.snap.Get(ns.key(k))
+}
+
+func (ns *namespaceSnapshot) BatchGet(keys [][]byte) ([][]byte, error) {
+	nsKeys := make([][]byte, len(keys))
+	for i, k := range keys {
+		nsKeys[i] = ns.key(k)
+	}
+	return ns.snap.BatchGet(nsKeys)
+}
+
+func (ns *namespaceSnapshot) Has(k []byte) bool {
+	return ns.snap.Has(ns.key(k))
+}
+
+func (ns *namespaceSnapshot) IterDB(fn func(k, v []byte) error) int64 {
+	return ns.IterPrefix(nil, fn)
+}
+
+func (ns *namespaceSnapshot) IterKey(fn func(k []byte) error) int64 {
+	return ns.snap.IterPrefix(ns.prefix, func(k, v []byte) error {
+		return fn(k[len(ns.prefix):])
+	})
+}
+
+func (ns *namespaceSnapshot) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	return ns.snap.IterPrefix(ns.key(prefix), func(k, v []byte) error {
+		return fn(k[len(ns.prefix):], v)
+	})
+}
+
+func (ns *namespaceSnapshot) Release() {
+	ns.snap.Release()
+}
+
+// namespaceTxn 命名空间视图上的事务
+type namespaceTxn struct {
+	txn    Txn
+	prefix []byte
+}
+
+func (nt *namespaceTxn) Get(k []byte) ([]byte, error) {
+	return nt.txn.Get(concat(nt.prefix, k))
+}
+
+func (nt *namespaceTxn) Has(k []byte) bool {
+	return nt.txn.Has(concat(nt.prefix, k))
+}
+
+func (nt *namespaceTxn) ExpireAt(k []byte) (int64, error) {
+	return txnExpireAt(nt.txn, concat(nt.prefix, k))
+}
+
+func (nt *namespaceTxn) Set(k, v []byte) error {
+	return nt.txn.Set(concat(nt.prefix, k), v)
+}
+
+func (nt *namespaceTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+	return nt.txn.SetWithTTL(concat(nt.prefix, k), v, expireAt)
+}
+
+func (nt *namespaceTxn) Delete(k []byte) error {
+	return nt.txn.Delete(concat(nt.prefix, k))
+}
@@ -0,0 +1,69 @@
+package edatabase
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	db, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	blocks := db.Namespace("blocks")
+	txs := db.Namespace("txs")
+
+	err := blocks.Set([]byte("k1"), []byte("block1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blocks.Set([]byte("k2"), []byte("block2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = txs.Set([]byte("k1"), []byte("tx1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同名key在不同命名空间互不干扰
+	if v, err := blocks.Get([]byte("k1")); err != nil || !bytes.Equal(v, []byte("block1")) {
+		t.Fatalf("blocks k1 = %s, %v", v, err)
+	}
+	if v, err := txs.Get([]byte("k1")); err != nil || !bytes.Equal(v, []byte("tx1")) {
+		t.Fatalf("txs k1 = %s, %v", v, err)
+	}
+	if db.Has([]byte("k1")) {
+		t.Fatal("namespaced key leaked into root keyspace")
+	}
+
+	// 遍历只限于本命名空间，且key不带前缀
+	keys := make([]string, 0)
+	blocks.IterDB(func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if len(keys) != 2 || keys[0] != "k1" || keys[1] != "k2" {
+		t.Fatalf("blocks IterDB got %v", keys)
+	}
+
+	names, err := ListNamespaces(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "blocks" || names[1] != "txs" {
+		t.Fatalf("ListNamespaces got %v", names)
+	}
+
+	if err = DropNamespace(db, "blocks"); err != nil {
+		t.Fatal(err)
+	}
+	if blocks.Has([]byte("k1")) || blocks.Has([]byte("k2")) {
+		t.Fatal("blocks not dropped")
+	}
+	if !txs.Has([]byte("k1")) {
+		t.Fatal("txs dropped together with blocks")
+	}
+	if names, _ = ListNamespaces(db); len(names) != 1 || names[0] != "txs" {
+		t.Fatalf("ListNamespaces after drop got %v", names)
+	}
+}
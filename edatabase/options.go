@@ -0,0 +1,212 @@
+package edatabase
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/azd1997/ego/econf"
+	"github.com/azd1997/ego/elog2"
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
+)
+
+/*options.go 数据库引擎的配置。取代原先写死在代码里的badger.DefaultOptions*/
+
+// Logger 数据库引擎使用的日志接口，与badger.Logger一致
+type Logger interface {
+	Errorf(string, ...interface{})
+	Warningf(string, ...interface{})
+	Infof(string, ...interface{})
+	Debugf(string, ...interface{})
+}
+
+// 文件加载方式，对应badger的options.FileLoadingMode
+const (
+	LoadingModeFileIO = "fileio" // 标准文件IO，最省内存
+	LoadingModeMmap   = "mmap"   // mmap映射
+	LoadingModeRAM    = "ram"    // 完全载入内存
+)
+
+// 压缩算法
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+	CompressionZSTD   = "zstd"
+)
+
+// Options 数据库引擎配置。字段的零值表示沿用引擎自身的默认值（bool字段除外，以DefaultOptions为准）
+type Options struct {
+	// SyncWrites 每次写入都同步落盘。关闭后写入更快，但宕机可能丢失最近的写入
+	SyncWrites bool `json:"sync_writes"`
+	// ReadOnly 只读打开，可以与另一个读写进程共享同一个数据库目录
+	ReadOnly bool `json:"read_only"`
+	// InMemory 纯内存模式，不读写磁盘，关闭后数据丢失。badger v1.6不支持内存模式，此时改用memory引擎
+	InMemory bool `json:"in_memory"`
+
+	// ValueLogFileSize 单个value log文件的大小(字节)，超过则切分新文件
+	ValueLogFileSize int64 `json:"value_log_file_size"`
+	// ValueLogMaxEntries 单个value log文件最多容纳的条目数
+	ValueLogMaxEntries uint32 `json:"value_log_max_entries"`
+	// MaxTableSize 单个SSTable的大小(字节)
+	MaxTableSize int64 `json:"max_table_size"`
+	// NumMemtables 内存表个数
+	NumMemtables int `json:"num_memtables"`
+	// NumCompactors compaction协程数
+	NumCompactors int `json:"num_compactors"`
+	// TableLoadingMode LSM tree的加载方式：fileio / mmap / ram
+	TableLoadingMode string `json:"table_loading_mode"`
+	// ValueLogLoadingMode value log的加载方式：fileio / mmap
+	ValueLogLoadingMode string `json:"value_log_loading_mode"`
+
+	// Compression 数据块压缩算法：none / snappy / zstd。badger v1.6不支持压缩，只接受none
+	Compression string `json:"compression"`
+	// BlockCacheSize 数据块缓存大小(字节)。badger v1.6没有独立的块缓存，只接受0
+	BlockCacheSize int64 `json:"block_cache_size"`
+	// IndexCacheSize 索引缓存大小(字节)。badger v1.6没有独立的索引缓存，只接受0
+	IndexCacheSize int64 `json:"index_cache_size"`
+
+	// GCInterval 后台value log GC的间隔，0表示不定时GC
+	GCInterval Duration `json:"gc_interval"`
+	// GCWriteThreshold 距上次GC累计写入多少条后触发一次GC，0表示不按写入量触发
+	GCWriteThreshold int64 `json:"gc_write_threshold"`
+	// GCDiscardRatio value log文件中垃圾占比超过该值才重写，取值(0,1)，0表示使用DefaultGCDiscardRatio
+	GCDiscardRatio float64 `json:"gc_discard_ratio"`
+	// OnGC 每次后台GC结束后回调，用于上报指标。不从配置文件读取
+	OnGC func(GCStats) `json:"-"`
+
+	// Logger 引擎日志，为nil时使用引擎默认日志。不从配置文件读取
+	Logger Logger `json:"-"`
+
+	// Encryption 静态加密配置，不为nil时打开的数据库会被包装为加密视图。密钥不应出现在配置文件中，因此不从配置文件读取
+	Encryption *EncryptionOptions `json:"-"`
+
+	// Metrics 指标配置，不为nil时打开的数据库会被包装为记录指标的视图，指标包含加密的开销。不从配置文件读取
+	Metrics *MetricsOptions `json:"-"`
+}
+
+// DefaultOptions 默认配置，与原先openBadgerDb的行为一致
+func DefaultOptions() *Options {
+	return &Options{
+		SyncWrites:     true,
+		Compression:    CompressionNone,
+		GCDiscardRatio: DefaultGCDiscardRatio,
+	}
+}
+
+// LoadOptions 从econf配置文件中读取key对应的配置段，未出现的字段沿用DefaultOptions。key为空表示整个文件。
+// conf没有实现econf.IUnmarshaler时，把Get(key)得到的配置段经json转换到Options
+func LoadOptions(conf econf.IConfig, key string) (*Options, error) {
+	opts := DefaultOptions()
+	if u, ok := conf.(econf.IUnmarshaler); ok {
+		if err := u.Unmarshal(key, opts); err != nil {
+			return nil, fmt.Errorf("LoadOptions: %s", err)
+		}
+		return opts, nil
+	}
+	value := conf.Get(key)
+	if value == nil {
+		return opts, nil
+	}
+	content, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(content, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LoadOptions: %s", err)
+	}
+	return opts, nil
+}
+
+// LoadOptionsFile 从json配置文件中读取key对应的配置段
+func LoadOptionsFile(path string, key string) (*Options, error) {
+	conf, err := econf.NewJsonConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadOptions(conf, key)
+}
+
+// toLoadingMode 把配置中的字符串转换为badger的加载方式
+func toLoadingMode(mode string) (options.FileLoadingMode, error) {
+	switch mode {
+	case LoadingModeFileIO:
+		return options.FileIO, nil
+	case LoadingModeMmap:
+		return options.MemoryMap, nil
+	case LoadingModeRAM:
+		return options.LoadToRAM, nil
+	default:
+		return 0, fmt.Errorf("unknown loading mode: %s", mode)
+	}
+}
+
+// badgerOptions 把Options转换为badger.Options
+func (opts *Options) badgerOptions(dbPath string) (badger.Options, error) {
+	bo := badger.DefaultOptions(dbPath)
+	bo.SyncWrites = opts.SyncWrites
+	bo.ReadOnly = opts.ReadOnly
+
+	if opts.Compression != "" && opts.Compression != CompressionNone {
+		return bo, fmt.Errorf("badger v1.6 does not support compression: %s", opts.Compression)
+	}
+	if opts.BlockCacheSize != 0 || opts.IndexCacheSize != 0 {
+		return bo, fmt.Errorf("badger v1.6 does not support block or index cache")
+	}
+
+	if opts.ValueLogFileSize > 0 {
+		bo.ValueLogFileSize = opts.ValueLogFileSize
+	}
+	if opts.ValueLogMaxEntries > 0 {
+		bo.ValueLogMaxEntries = opts.ValueLogMaxEntries
+	}
+	if opts.MaxTableSize > 0 {
+		bo.MaxTableSize = opts.MaxTableSize
+	}
+	if opts.NumMemtables > 0 {
+		bo.NumMemtables = opts.NumMemtables
+	}
+	if opts.NumCompactors > 0 {
+		bo.NumCompactors = opts.NumCompactors
+	}
+	var err error
+	if opts.TableLoadingMode != "" {
+		if bo.TableLoadingMode, err = toLoadingMode(opts.TableLoadingMode); err != nil {
+			return bo, err
+		}
+	}
+	if opts.ValueLogLoadingMode != "" {
+		if bo.ValueLogLoadingMode, err = toLoadingMode(opts.ValueLogLoadingMode); err != nil {
+			return bo, err
+		}
+	}
+	if opts.Logger != nil {
+		bo.Logger = opts.Logger
+	}
+	return bo, nil
+}
+
+// elogLogger 把elog2日志适配为引擎日志
+type elogLogger struct {
+	l elog2.Interface
+}
+
+// NewELogLogger 使用elog2日志作为引擎日志
+func NewELogLogger(l elog2.Interface) Logger {
+	return &elogLogger{l: l}
+}
+
+func (el *elogLogger) Errorf(format string, args ...interface{}) {
+	el.l.Error(format, args...)
+}
+
+func (el *elogLogger) Warningf(format string, args ...interface{}) {
+	el.l.Warn(format, args...)
+}
+
+func (el *elogLogger) Infof(format string, args ...interface{}) {
+	el.l.Info(format, args...)
+}
+
+func (el *elogLogger) Debugf(format string, args ...interface{}) {
+	el.l.Debug(format, args...)
+}
@@ -0,0 +1,85 @@
+package edatabase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOptionsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edatabase-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confPath := filepath.Join(dir, "conf.json")
+	content := `{"database": {"sync_writes": false, "value_log_file_size": 67108864, "table_loading_mode": "mmap"}}`
+	if err = ioutil.WriteFile(confPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := LoadOptionsFile(confPath, "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.SyncWrites || opts.ValueLogFileSize != 64<<20 || opts.TableLoadingMode != LoadingModeMmap {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	if opts.Compression != CompressionNone {
+		t.Fatalf("default compression not kept, got %q", opts.Compression)
+	}
+
+	db, err := OpenDatabaseWithOptions("badger", filepath.Join(dir, "db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, db)
+	db.Close()
+
+	opts.Compression = CompressionZSTD
+	if _, err = OpenDatabaseWithOptions("badger", filepath.Join(dir, "db"), opts); err == nil {
+		t.Fatal("badger accepted unsupported compression")
+	}
+}
+
+// mapConfig 只实现了econf.IConfig的配置器
+type mapConfig map[string]interface{}
+
+func (mc mapConfig) Get(key string) interface{}              { return mc[key] }
+func (mc mapConfig) Put(key string, value interface{}) error { mc[key] = value; return nil }
+func (mc mapConfig) Reload() error                           { return nil }
+
+func TestLoadOptionsPlainConfig(t *testing.T) {
+	conf := mapConfig{"database": map[string]interface{}{"sync_writes": false, "in_memory": true}}
+	opts, err := LoadOptions(conf, "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.SyncWrites || !opts.InMemory || opts.Compression != CompressionNone {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	if opts, err = LoadOptions(conf, "missing"); err != nil || !opts.SyncWrites {
+		t.Fatalf("missing section = %+v, %v, want defaults", opts, err)
+	}
+}
+
+func TestInMemoryOption(t *testing.T) {
+	opts := DefaultOptions()
+	opts.InMemory = true
+	db, err := OpenDatabaseWithOptions("badger", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.(*memoryDb); !ok {
+		t.Fatalf("InMemory opened %T, want *memoryDb", db)
+	}
+
+	opts.ReadOnly = true
+	ro, _ := OpenDatabaseWithOptions("memory", "", opts)
+	if err = ro.Set([]byte("k"), []byte("v")); err != ErrReadOnly {
+		t.Fatalf("write on read-only database got %v", err)
+	}
+}
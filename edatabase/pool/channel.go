@@ -7,42 +7,58 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Config 连接池相关配置
-type Config struct {
-	InitialCap int  // 连接池拥有的最小连接数
-	MaxCap int  // 最大连接数
-	Factory func() (interface{}, error)		// 生成连接的方法
-	Close func(interface{}) error	// 关闭连接的方法
-	Ping func(interface{}) error  // 检查链接是否有效的方法
-	IdleTimeout time.Duration  // 连接最大空闲时间，超时则连接断开
+// Config 连接池相关配置，T为连接的类型
+type Config[T any] struct {
+	InitialCap  int               // 连接池拥有的最小连接数
+	MaxCap      int               // 最大空闲连接数
+	MaxActive   int               // 最大活跃连接数(使用中+空闲)，0表示不限制。达到上限后Get会等待其他连接归还
+	Factory     func() (T, error) // 生成连接的方法
+	Close       func(T) error     // 关闭连接的方法
+	Ping        func(T) error     // 检查链接是否有效的方法
+	IdleTimeout time.Duration     // 连接最大空闲时间，超时则连接断开。大于0时后台会定期清理超时的空闲连接
 }
 
 // channel Pool 存放连接信息
-type channelPool struct {
-	mu sync.Mutex
-	conns chan *idleConn
-	factory func() (interface{}, error)		// 生成连接的方法
-	close func(interface{}) error	// 关闭连接的方法
-	ping func(interface{}) error  // 检查链接是否有效的方法
-	idleTimeout time.Duration  // 连接最大空闲时间，超时则连接断开
+type channelPool[T any] struct {
+	mu          sync.Mutex
+	conns       chan *idleConn[T] // 空闲连接
+	slots       chan struct{}     // 活跃连接名额，每个打开的连接占一个；MaxActive为0时为nil
+	factory     func() (T, error) // 生成连接的方法
+	close       func(T) error     // 关闭连接的方法
+	ping        func(T) error     // 检查链接是否有效的方法
+	idleTimeout time.Duration     // 连接最大空闲时间，超时则连接断开
+	maxActive   int
+
+	closed chan struct{} // Release时关闭，唤醒所有等待者并停止后台清理
+	done   chan struct{} // 后台清理协程退出
+
+	inUse        int64 // 使用中的连接数
+	active       int64 // 打开的连接数
+	waitCount    int64 // 累计等待次数
+	waitDuration int64 // 累计等待时长(纳秒)
 }
 
-type idleConn struct {
-	conn interface{}
+type idleConn[T any] struct {
+	conn T
 	t    time.Time
 }
 
 // NewChannelPool 初始化连接
-func NewChannelPool(poolConfig *Config) (Pool, error) {
+func NewChannelPool[T any](poolConfig *Config[T]) (Pool[T], error) {
 	if poolConfig.InitialCap < 0 || poolConfig.MaxCap <= 0 || poolConfig.InitialCap > poolConfig.MaxCap {
 		return nil, errors.New("invalid capacity settings")
 	}
+	if poolConfig.MaxActive < 0 || (poolConfig.MaxActive > 0 && poolConfig.MaxCap > poolConfig.MaxActive) {
+		return nil, errors.New("invalid max active settings")
+	}
 	if poolConfig.Factory == nil {
 		return nil, errors.New("invalid factory func settings")
 	}
@@ -50,11 +66,17 @@ func NewChannelPool(poolConfig *Config) (Pool, error) {
 		return nil, errors.New("invalid close func settings")
 	}
 
-	c := &channelPool{
-		conns:       make(chan *idleConn, poolConfig.MaxCap),
+	c := &channelPool[T]{
+		conns:       make(chan *idleConn[T], poolConfig.MaxCap),
 		factory:     poolConfig.Factory,
 		close:       poolConfig.Close,
 		idleTimeout: poolConfig.IdleTimeout,
+		maxActive:   poolConfig.MaxActive,
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if poolConfig.MaxActive > 0 {
+		c.slots = make(chan struct{}, poolConfig.MaxActive)
 	}
 
 	if poolConfig.Ping != nil {
@@ -62,137 +84,283 @@ func NewChannelPool(poolConfig *Config) (Pool, error) {
 	}
 
 	for i := 0; i < poolConfig.InitialCap; i++ {
-		conn, err := c.factory()
+		c.acquireSlot()
+		conn, err := c.create()
 		if err != nil {
+			// 后台清理协程还没有启动，先标记其已退出，否则Release会一直等待
+			close(c.done)
 			c.Release()
 			return nil, fmt.Errorf("factory is not able to fill the pool: %s", err)
 		}
-		c.conns <- &idleConn{conn: conn, t: time.Now()}
+		c.conns <- &idleConn[T]{conn: conn, t: time.Now()}
+	}
+
+	if c.idleTimeout > 0 {
+		go c.evictLoop()
+	} else {
+		close(c.done)
 	}
 
 	return c, nil
 }
 
-// getConns 获取所有连接
-func (c *channelPool) getConns() chan *idleConn {
-	c.mu.Lock()
-	conns := c.conns
-	c.mu.Unlock()
-	return conns
+// acquireSlot 不阻塞地占用一个活跃连接名额，没有名额时返回false
+func (c *channelPool[T]) acquireSlot() bool {
+	if c.slots == nil {
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
 }
 
-// Get 从pool中取一个连接
-func (c *channelPool) Get() (interface{}, error) {
-	conns := c.getConns()
-	if conns == nil {
-		return nil, ErrClosed
+// releaseSlot 归还一个活跃连接名额
+func (c *channelPool[T]) releaseSlot() {
+	if c.slots != nil {
+		<-c.slots
 	}
+}
+
+// create 调用factory新建连接，调用者需已占用名额。失败时归还名额
+func (c *channelPool[T]) create() (T, error) {
+	conn, err := c.factory()
+	if err != nil {
+		c.releaseSlot()
+		var zero T
+		return zero, err
+	}
+	atomic.AddInt64(&c.active, 1)
+	return conn, nil
+}
+
+// destroy 关闭连接并归还其名额
+func (c *channelPool[T]) destroy(conn T) error {
+	atomic.AddInt64(&c.active, -1)
+	c.releaseSlot()
+	return c.close(conn)
+}
+
+// isClosed 连接池是否已经Release
+func (c *channelPool[T]) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkIdle 检查空闲连接是否仍然可用，不可用时关闭它
+func (c *channelPool[T]) checkIdle(wrapConn *idleConn[T]) bool {
+	//判断是否超时，超时则丢弃
+	if timeout := c.idleTimeout; timeout > 0 {
+		if wrapConn.t.Add(timeout).Before(time.Now()) {
+			//丢弃并关闭该连接
+			_ = c.destroy(wrapConn.conn)
+			return false
+		}
+	}
+	//判断是否失效，失效则关闭丢弃，如果用户没有设定 ping 方法，就不检查
+	if c.ping != nil {
+		if err := c.ping(wrapConn.conn); err != nil {
+			_ = c.destroy(wrapConn.conn)
+			return false
+		}
+	}
+	return true
+}
+
+// Get 从pool中取一个连接。没有空闲连接且活跃连接数已达MaxActive时阻塞等待，直到有连接归还或ctx结束
+func (c *channelPool[T]) Get(ctx context.Context) (T, error) {
+	var zero T
+	var waitStart time.Time
+	defer func() {
+		if !waitStart.IsZero() {
+			atomic.AddInt64(&c.waitCount, 1)
+			atomic.AddInt64(&c.waitDuration, int64(time.Since(waitStart)))
+		}
+	}()
+
 	for {
+		if c.isClosed() {
+			return zero, ErrClosed
+		}
+
+		// 1. 优先复用空闲连接
 		select {
-		case wrapConn := <-conns:
-			if wrapConn == nil {
-				return nil, ErrClosed
-			}
-			//判断是否超时，超时则丢弃
-			if timeout := c.idleTimeout; timeout > 0 {
-				if wrapConn.t.Add(timeout).Before(time.Now()) {
-					//丢弃并关闭该连接
-					c.Close(wrapConn.conn)
-					continue
-				}
-			}
-			//判断是否失效，失效则丢弃，如果用户没有设定 ping 方法，就不检查
-			if c.ping != nil {
-				if err := c.Ping(wrapConn.conn); err != nil {
-					fmt.Println("conn is not able to be connected: ", err)
-					continue
-				}
+		case wrapConn := <-c.conns:
+			if !c.checkIdle(wrapConn) {
+				continue
 			}
+			atomic.AddInt64(&c.inUse, 1)
 			return wrapConn.conn, nil
 		default:
-			c.mu.Lock()
-			if c.factory == nil {
-				c.mu.Unlock()
+		}
+
+		// 2. 还有名额则新建连接
+		if c.acquireSlot() {
+			conn, err := c.create()
+			if err != nil {
+				return zero, err
+			}
+			atomic.AddInt64(&c.inUse, 1)
+			return conn, nil
+		}
+
+		// 3. 等待连接归还或名额释放
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+		}
+		select {
+		case wrapConn := <-c.conns:
+			if !c.checkIdle(wrapConn) {
 				continue
 			}
-			conn, err := c.factory()
-			c.mu.Unlock()
+			atomic.AddInt64(&c.inUse, 1)
+			return wrapConn.conn, nil
+		case c.slots <- struct{}{}:
+			conn, err := c.create()
 			if err != nil {
-				return nil, err
+				return zero, err
 			}
-
+			atomic.AddInt64(&c.inUse, 1)
 			return conn, nil
+		case <-c.closed:
+			return zero, ErrClosed
+		case <-ctx.Done():
+			return zero, ctx.Err()
 		}
 	}
 }
 
 // Put 将连接放回pool中
-func (c *channelPool) Put(conn interface{}) error {
-	if conn == nil {
+func (c *channelPool[T]) Put(conn T) error {
+	if isNil(conn) {
 		return errors.New("connection is nil. rejecting")
 	}
+	atomic.AddInt64(&c.inUse, -1)
 
 	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if c.conns == nil {
-		c.mu.Unlock()
-		return c.Close(conn)
+	if c.isClosed() {
+		return c.destroy(conn)
 	}
 
 	select {
-	case c.conns <- &idleConn{conn: conn, t: time.Now()}:
-		c.mu.Unlock()
+	case c.conns <- &idleConn[T]{conn: conn, t: time.Now()}:
 		return nil
 	default:
-		c.mu.Unlock()
-		//连接池已满，直接关闭该连接
-		return c.Close(conn)
+		//空闲连接已满，直接关闭该连接
+		return c.destroy(conn)
 	}
 }
 
-// Close 关闭单条连接
-func (c *channelPool) Close(conn interface{}) error {
-	if conn == nil {
+// Close 关闭一条从Get取出的连接，不再放回pool，同时释放其活跃名额
+func (c *channelPool[T]) Close(conn T) error {
+	if isNil(conn) {
 		return errors.New("connection is nil. rejecting")
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.close == nil {
-		return nil
-	}
-	return c.close(conn)
+	atomic.AddInt64(&c.inUse, -1)
+	return c.destroy(conn)
 }
 
 // Ping 检查单条连接是否有效
-func (c *channelPool) Ping(conn interface{}) error {
-	if conn == nil {
+func (c *channelPool[T]) Ping(conn T) error {
+	if isNil(conn) {
 		return errors.New("connection is nil. rejecting")
 	}
+	if c.ping == nil {
+		return nil
+	}
 	return c.ping(conn)
 }
 
-// Release 释放连接池中所有连接
-func (c *channelPool) Release() {
+// evictLoop 定期关闭空闲超时的连接，直到Release
+func (c *channelPool[T]) evictLoop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.evict()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// evict 检查当前所有空闲连接一遍，关闭超时的，其余放回
+func (c *channelPool[T]) evict() {
 	c.mu.Lock()
-	conns := c.conns
-	c.conns = nil
-	c.factory = nil
-	c.ping = nil
-	closeFun := c.close
-	c.close = nil
-	c.mu.Unlock()
+	defer c.mu.Unlock()
 
-	if conns == nil {
+	now := time.Now()
+	for n := len(c.conns); n > 0; n-- {
+		var wrapConn *idleConn[T]
+		select {
+		case wrapConn = <-c.conns:
+		default:
+			return
+		}
+		if wrapConn.t.Add(c.idleTimeout).Before(now) {
+			_ = c.destroy(wrapConn.conn)
+			continue
+		}
+		select {
+		case c.conns <- wrapConn:
+		default:
+			_ = c.destroy(wrapConn.conn)
+		}
+	}
+}
+
+// Release 释放连接池中所有空闲连接，唤醒所有等待者。使用中的连接在Put时被关闭
+func (c *channelPool[T]) Release() {
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
 		return
 	}
+	close(c.closed)
+	c.mu.Unlock()
+	<-c.done
 
-	close(conns)
-	for wrapConn := range conns {
-		closeFun(wrapConn.conn)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		select {
+		case wrapConn := <-c.conns:
+			_ = c.destroy(wrapConn.conn)
+		default:
+			return
+		}
 	}
 }
 
-// Len 连接池中已有的连接
-func (c *channelPool) Len() int {
-	return len(c.getConns())
-}
\ No newline at end of file
+// Len 连接池中空闲的连接数
+func (c *channelPool[T]) Len() int {
+	return len(c.conns)
+}
+
+// Stats 连接池的统计信息
+func (c *channelPool[T]) Stats() Stats {
+	return Stats{
+		MaxActive:    c.maxActive,
+		Active:       int(atomic.LoadInt64(&c.active)),
+		InUse:        int(atomic.LoadInt64(&c.inUse)),
+		Idle:         len(c.conns),
+		WaitCount:    atomic.LoadInt64(&c.waitCount),
+		WaitDuration: time.Duration(atomic.LoadInt64(&c.waitDuration)),
+	}
+}
+
+// isNil 连接为nil接口时不能放回连接池
+func isNil(conn interface{}) bool {
+	return conn == nil
+}
@@ -0,0 +1,188 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	id     int64
+	closed int32
+	broken bool
+}
+
+func newTestPool(t *testing.T, conf *Config[*testConn]) (Pool[*testConn], *int64, *int64) {
+	var created, closed int64
+	conf.Factory = func() (*testConn, error) {
+		return &testConn{id: atomic.AddInt64(&created, 1)}, nil
+	}
+	conf.Close = func(v *testConn) error {
+		atomic.StoreInt32(&v.closed, 1)
+		atomic.AddInt64(&closed, 1)
+		return nil
+	}
+	p, err := NewChannelPool(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &created, &closed
+}
+
+func TestMaxActive(t *testing.T) {
+	p, created, _ := newTestPool(t, &Config[*testConn]{MaxCap: 2, MaxActive: 2})
+	defer p.Release()
+
+	c1, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 达到上限，超时返回
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = p.Get(ctx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	// 归还后等待者拿到同一个连接
+	got := make(chan *testConn)
+	go func() {
+		c, err := p.Get(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- c
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err = p.Put(c1); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-got; c != c1 {
+		t.Fatal("waiter should reuse the returned connection")
+	}
+	if n := atomic.LoadInt64(created); n != 2 {
+		t.Fatalf("expect 2 connections created, got %d", n)
+	}
+
+	stats := p.Stats()
+	if stats.InUse != 2 || stats.Active != 2 || stats.Idle != 0 || stats.WaitCount != 2 || stats.WaitDuration <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCloseFreesSlot(t *testing.T) {
+	p, _, closed := newTestPool(t, &Config[*testConn]{MaxCap: 1, MaxActive: 1})
+	defer p.Release()
+
+	c, _ := p.Get(context.Background())
+	if err := p.Close(c); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(closed) != 1 {
+		t.Fatal("connection should be closed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != nil {
+		t.Fatal("slot should be released after Close:", err)
+	}
+}
+
+func TestFactoryFailureDuringFill(t *testing.T) {
+	var created, closed int64
+	conf := &Config[*testConn]{InitialCap: 2, MaxCap: 2, MaxActive: 2, IdleTimeout: time.Minute}
+	conf.Factory = func() (*testConn, error) {
+		if atomic.AddInt64(&created, 1) > 1 {
+			return nil, errors.New("dial failed")
+		}
+		return &testConn{}, nil
+	}
+	conf.Close = func(*testConn) error {
+		atomic.AddInt64(&closed, 1)
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewChannelPool(conf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expect error from failing factory")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewChannelPool did not return after factory failure")
+	}
+	if atomic.LoadInt64(&closed) != 1 {
+		t.Fatal("connections created before the failure should be closed")
+	}
+}
+
+func TestPingFailureClosesConn(t *testing.T) {
+	conf := &Config[*testConn]{MaxCap: 2, MaxActive: 2}
+	conf.Ping = func(v *testConn) error {
+		if v.broken {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	p, _, closed := newTestPool(t, conf)
+	defer p.Release()
+
+	c, _ := p.Get(context.Background())
+	c.broken = true
+	_ = p.Put(c)
+
+	c2, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 == c || atomic.LoadInt32(&c.closed) != 1 || atomic.LoadInt64(closed) != 1 {
+		t.Fatal("broken connection should be closed and replaced")
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+	p, _, closed := newTestPool(t, &Config[*testConn]{InitialCap: 2, MaxCap: 2, IdleTimeout: 10 * time.Millisecond})
+	defer p.Release()
+
+	time.Sleep(50 * time.Millisecond)
+	if p.Len() != 0 || atomic.LoadInt64(closed) != 2 {
+		t.Fatalf("idle connections should be evicted, len=%d closed=%d", p.Len(), atomic.LoadInt64(closed))
+	}
+	if stats := p.Stats(); stats.Active != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReleaseWakesWaiters(t *testing.T) {
+	p, _, closed := newTestPool(t, &Config[*testConn]{MaxCap: 1, MaxActive: 1})
+
+	c, _ := p.Get(context.Background())
+	errCh := make(chan error)
+	go func() {
+		_, err := p.Get(context.Background())
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Release()
+	if err := <-errCh; err != ErrClosed {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+
+	// Release后归还的连接直接关闭
+	_ = p.Put(c)
+	if atomic.LoadInt64(closed) != 1 {
+		t.Fatal("connection put after Release should be closed")
+	}
+}
@@ -0,0 +1,40 @@
+package pool
+
+import (
+	"context"
+)
+
+// PooledConn 从连接池取出的连接。Close时归还连接池，被标记为不可用时则关闭丢弃
+type PooledConn[T any] struct {
+	Conn T
+
+	pool     Pool[T]
+	unusable bool
+	closed   bool
+}
+
+// GetConn 从p取一个连接并包装为PooledConn，用完调用其Close即可归还
+func GetConn[T any](ctx context.Context, p Pool[T]) (*PooledConn[T], error) {
+	conn, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PooledConn[T]{Conn: conn, pool: p}, nil
+}
+
+// MarkUnusable 标记连接不可用(例如读写出错)，Close时将关闭而不是归还
+func (pc *PooledConn[T]) MarkUnusable() {
+	pc.unusable = true
+}
+
+// Close 归还或丢弃连接，重复调用返回ErrClosed
+func (pc *PooledConn[T]) Close() error {
+	if pc.closed {
+		return ErrClosed
+	}
+	pc.closed = true
+	if pc.unusable {
+		return pc.pool.Close(pc.Conn)
+	}
+	return pc.pool.Put(pc.Conn)
+}
@@ -0,0 +1,65 @@
+package pool
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPooledConn(t *testing.T) {
+	var closed []*testConn
+	var id int64
+	p, err := NewChannelPool(&Config[*testConn]{
+		MaxCap:    2,
+		MaxActive: 2,
+		Factory: func() (*testConn, error) {
+			id++
+			return &testConn{id: id}, nil
+		},
+		Close: func(c *testConn) error {
+			closed = append(closed, c)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release()
+
+	// 正常Close归还连接池
+	pc, err := GetConn(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := pc.Conn
+	if err = pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pc.Close() != ErrClosed {
+		t.Fatal("second Close should return ErrClosed")
+	}
+	if p.Len() != 1 || len(closed) != 0 {
+		t.Fatalf("connection should be back in pool, len=%d closed=%d", p.Len(), len(closed))
+	}
+
+	// 标记不可用后Close将关闭连接
+	pc, _ = GetConn(context.Background(), p)
+	if pc.Conn != first {
+		t.Fatal("idle connection should be reused")
+	}
+	pc.MarkUnusable()
+	if err = pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 0 || len(closed) != 1 || closed[0] != first {
+		t.Fatal("unusable connection should be closed")
+	}
+	if stats := p.Stats(); stats.Active != 0 || stats.InUse != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	c, err := p.Get(context.Background())
+	if err != nil || c.id != 2 {
+		t.Fatalf("expect a new connection, got %v %v", c, err)
+	}
+	_ = p.Put(c)
+}
@@ -6,22 +6,39 @@
 
 package pool
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 var (
 	//ErrClosed 连接池已经关闭Error
 	ErrClosed = errors.New("pool is closed")
 )
 
-// Pool 基本方法
-type Pool interface {
-	Get() (interface{}, error)
+// Pool 基本方法，T为连接的类型。需要保存不同类型的连接时可以使用Pool[interface{}]
+type Pool[T any] interface {
+	// Get 取一个连接，活跃连接数达到上限时阻塞，直到有连接归还或ctx结束
+	Get(ctx context.Context) (T, error)
 
-	Put(interface{}) error
+	Put(T) error
 
-	Close(interface{}) error
+	Close(T) error
 
 	Release()
 
 	Len() int
+
+	Stats() Stats
+}
+
+// Stats 连接池统计信息
+type Stats struct {
+	MaxActive    int           // 最大活跃连接数，0表示不限制
+	Active       int           // 打开的连接数(使用中+空闲)
+	InUse        int           // 使用中的连接数
+	Idle         int           // 空闲的连接数
+	WaitCount    int64         // Get累计等待的次数
+	WaitDuration time.Duration // Get累计等待的时长
 }
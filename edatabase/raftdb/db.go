@@ -0,0 +1,552 @@
+package raftdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/azd1997/ego/edatabase"
+)
+
+/*db.go 基于Raft复制的Database：写入经过Raft日志在多数节点落盘后才应用到各节点的状态机，
+读取直接访问本节点的状态机。单个节点宕机不影响读写，只要多数节点存活*/
+
+// errConflict 事务的读检查失败：事务读到的数据在提交前被其他写入修改了
+var errConflict = errors.New("transaction read set changed")
+
+// Peer 集群中的一个节点
+type Peer struct {
+	ID   string
+	Addr string // 节点之间通信的TCP地址
+}
+
+// Config 节点配置
+type Config struct {
+	// ID 本节点ID，必须出现在Peers中
+	ID string
+	// Peers 集群全部节点(包括本节点)，所有节点的配置必须一致
+	Peers []Peer
+	// Listener 本节点监听的连接，为nil时监听Peers中本节点的地址
+	Listener net.Listener
+	// Dir 数据目录，日志保存在Dir/log，状态机保存在Dir/state
+	Dir string
+	// Engine 本地存储引擎，默认为badger
+	Engine string
+	// Options 本地存储引擎的配置，为nil时使用默认配置
+	Options *edatabase.Options
+
+	// HeartbeatInterval leader发送心跳的间隔，默认50ms
+	HeartbeatInterval time.Duration
+	// ElectionTimeout 选举超时的下限，实际超时在[ElectionTimeout, 2*ElectionTimeout)之间随机，默认500ms
+	ElectionTimeout time.Duration
+	// SnapshotThreshold 距上次快照应用了多少条日志后生成新快照并压缩日志，默认10000
+	SnapshotThreshold uint64
+	// ProposeTimeout 一次写入等待提交的最长时间，默认5s
+	ProposeTimeout time.Duration
+}
+
+func (c *Config) withDefaults() (*Config, error) {
+	conf := *c
+	if conf.Engine == "" {
+		conf.Engine = "badger"
+	}
+	if conf.HeartbeatInterval <= 0 {
+		conf.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if conf.ElectionTimeout <= 0 {
+		conf.ElectionTimeout = 500 * time.Millisecond
+	}
+	if conf.SnapshotThreshold == 0 {
+		conf.SnapshotThreshold = 10000
+	}
+	if conf.ProposeTimeout <= 0 {
+		conf.ProposeTimeout = 5 * time.Second
+	}
+
+	addr, ids := "", make(map[string]bool)
+	for _, p := range conf.Peers {
+		if ids[p.ID] {
+			return nil, fmt.Errorf("raftdb: duplicate peer id %q", p.ID)
+		}
+		ids[p.ID] = true
+		if p.ID == conf.ID {
+			addr = p.Addr
+		}
+	}
+	if !ids[conf.ID] {
+		return nil, fmt.Errorf("raftdb: node %q is not in peers", conf.ID)
+	}
+	if conf.Listener == nil {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conf.Listener = l
+	}
+	return &conf, nil
+}
+
+// DB 复制数据库的一个节点，实现edatabase.Database接口。
+// 任意节点都可以写入，follower会把写入转发给leader；读取访问本节点的状态机，可能落后于leader，需要读到最新数据时先调用Sync
+type DB struct {
+	node  *node
+	fsm   *fsm
+	state edatabase.Database // 状态机
+	logs  edatabase.Database // Raft日志与快照
+}
+
+// Open 启动一个节点。节点重启后从本地的快照与日志恢复
+func Open(c *Config) (*DB, error) {
+	conf, err := c.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	logs, err := edatabase.OpenDatabaseWithOptions(conf.Engine, filepath.Join(conf.Dir, "log"), conf.Options)
+	if err != nil {
+		conf.Listener.Close()
+		return nil, err
+	}
+	state, err := edatabase.OpenDatabaseWithOptions(conf.Engine, filepath.Join(conf.Dir, "state"), conf.Options)
+	if err != nil {
+		conf.Listener.Close()
+		logs.Close()
+		return nil, err
+	}
+
+	db := &DB{fsm: &fsm{db: state}, state: state, logs: logs}
+	if db.node, err = newNode(conf, &storage{db: logs}, db.fsm); err != nil {
+		conf.Listener.Close()
+		state.Close()
+		logs.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// ID 本节点ID
+func (db *DB) ID() string {
+	return db.node.id
+}
+
+// IsLeader 本节点当前是否为leader
+func (db *DB) IsLeader() bool {
+	id, _ := db.node.leader()
+	return id == db.node.id
+}
+
+// Leader 本节点所知的leader的ID，未知时为空
+func (db *DB) Leader() string {
+	id, _ := db.node.leader()
+	return id
+}
+
+// Sync 等待本节点的状态机追上leader当前已提交的全部写入，之后的读取能看到Sync调用之前完成的所有写入
+func (db *DB) Sync(ctx context.Context) error {
+	return db.node.sync(ctx)
+}
+
+// submit 提交一条命令并等待其在本集群中生效
+func (db *DB) submit(cmd *command) error {
+	data, err := encode(cmd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.node.conf.ProposeTimeout)
+	defer cancel()
+	return db.node.submit(ctx, data)
+}
+
+// write 把一组写入作为一条日志原子地提交
+func (db *DB) write(writes []write) error {
+	return db.submit(&command{Op: opWrite, Writes: writes})
+}
+
+/*↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓实现Database接口↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓↓*/
+
+func (db *DB) Set(k, v []byte) error {
+	return db.write([]write{{Key: k, Value: v}})
+}
+
+func (db *DB) BatchSet(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.New("key value not the same length")
+	}
+	writes := make([]write, len(keys))
+	for i := range keys {
+		writes[i] = write{Key: keys[i], Value: values[i]}
+	}
+	return db.write(writes)
+}
+
+func (db *DB) SetWithTTL(k, v []byte, expireAt int64) error {
+	return db.write([]write{{Key: k, Value: v, ExpireAt: expireAt}})
+}
+
+func (db *DB) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	if len(keys) != len(values) || len(keys) != len(expireAts) {
+		return errors.New("key value not the same length")
+	}
+	writes := make([]write, len(keys))
+	for i := range keys {
+		writes[i] = write{Key: keys[i], Value: values[i], ExpireAt: expireAts[i]}
+	}
+	return db.write(writes)
+}
+
+func (db *DB) Get(k []byte) ([]byte, error) {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.Get(k)
+}
+
+// expireAt 读取状态机中k的过期时间。本地引擎没有只读事务，借用一个不写入任何数据的Update读取
+func (db *DB) expireAt(k []byte) (int64, error) {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	var expireAt int64
+	err := db.state.Update(func(txn edatabase.Txn) error {
+		et, ok := txn.(edatabase.ExpiryTxn)
+		if !ok {
+			return nil
+		}
+		var err error
+		expireAt, err = et.ExpireAt(k)
+		return err
+	})
+	return expireAt, err
+}
+
+func (db *DB) BatchGet(keys [][]byte) ([][]byte, error) {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.BatchGet(keys)
+}
+
+func (db *DB) Delete(k []byte) error {
+	return db.write([]write{{Key: k, Delete: true}})
+}
+
+func (db *DB) BatchDelete(keys [][]byte) error {
+	writes := make([]write, len(keys))
+	for i := range keys {
+		writes[i] = write{Key: keys[i], Delete: true}
+	}
+	return db.write(writes)
+}
+
+func (db *DB) Has(k []byte) bool {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.Has(k)
+}
+
+func (db *DB) IterDB(fn func(k, v []byte) error) int64 {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.IterDB(fn)
+}
+
+func (db *DB) IterKey(fn func(k []byte) error) int64 {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.IterKey(fn)
+}
+
+func (db *DB) IterPrefix(prefix []byte, fn func(k, v []byte) error) int64 {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.IterPrefix(prefix, fn)
+}
+
+func (db *DB) DropPrefix(prefix []byte) error {
+	return db.submit(&command{Op: opDropPrefix, Prefix: prefix})
+}
+
+func (db *DB) Namespace(name string) edatabase.Database {
+	return edatabase.Derive(db).Namespace(name)
+}
+
+// Backup 备份本节点的状态机
+func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.Backup(w, since)
+}
+
+// Restore 把备份中的数据逐条写入集群
+func (db *DB) Restore(r io.Reader) error {
+	return edatabase.Derive(db).Restore(r)
+}
+
+func (db *DB) Snapshot() (edatabase.Snapshot, error) {
+	db.fsm.mu.RLock()
+	defer db.fsm.mu.RUnlock()
+	return db.state.Snapshot()
+}
+
+// Size 本节点状态机占用的空间，不含Raft日志
+func (db *DB) Size() (lsm, vlog int64) {
+	return db.state.Size()
+}
+
+// RunGC 对本节点的状态机和Raft日志分别回收垃圾
+func (db *DB) RunGC(discardRatio float64) (int, error) {
+	n, err := db.state.RunGC(discardRatio)
+	if err != nil {
+		return n, err
+	}
+	m, err := db.logs.RunGC(discardRatio)
+	return n + m, err
+}
+
+// Update 在本节点的状态机上执行fn，然后把fn读到的数据与写入一起提交。
+// leader在追加日志前检查读到的数据，已经被修改则视为冲突，等本节点追上leader后重新执行fn
+func (db *DB) Update(fn func(txn edatabase.Txn) error) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		txn := &recordTxn{state: db, pending: make(map[string]write)}
+		if err := fn(txn); err != nil {
+			return err
+		}
+		if len(txn.writes) == 0 {
+			return nil
+		}
+		err := db.submit(&command{Op: opWrite, Reads: txn.reads, Writes: txn.writes})
+		if err != errConflict {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), db.node.conf.ProposeTimeout)
+		err = db.Sync(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return edatabase.ErrTxnConflict
+}
+
+func (db *DB) CompareAndSwap(k, old, new []byte) (bool, error) {
+	return edatabase.Derive(db).CompareAndSwap(k, old, new)
+}
+
+func (db *DB) Increment(k []byte, delta int64) (int64, error) {
+	return edatabase.Derive(db).Increment(k, delta)
+}
+
+func (db *DB) Merge(k, v []byte, fn edatabase.MergeFunc) ([]byte, error) {
+	return edatabase.Derive(db).Merge(k, v, fn)
+}
+
+// Subscribe 订阅本节点状态机上的变更，每个节点都能收到全部已提交的写入
+func (db *DB) Subscribe(ctx context.Context, prefix []byte, fn func(kv *edatabase.KV)) error {
+	return db.state.Subscribe(ctx, prefix, fn)
+}
+
+func (db *DB) Close() error {
+	db.node.close()
+	err := db.state.Close()
+	if e := db.logs.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+/*↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑实现Database接口↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑↑*/
+
+// maxUpdateRetries Update因冲突重新执行的最大次数
+const maxUpdateRetries = 100
+
+// 命令类型
+const (
+	opWrite      byte = iota + 1 // 一组写入与删除，可带读检查
+	opDropPrefix                 // 按前缀删除
+)
+
+// command Raft日志中的一条命令，空命令(leader当选时追加)不做任何事
+type command struct {
+	Op     byte
+	Writes []write
+	Reads  []read
+	Prefix []byte
+}
+
+type write struct {
+	Key      []byte
+	Value    []byte
+	ExpireAt int64
+	Delete   bool
+}
+
+// read 事务读到的数据，leader追加日志前检查其是否仍然成立
+type read struct {
+	Key   []byte
+	Value []byte
+	Found bool
+}
+
+// recordTxn 在本节点状态机上执行Update回调，记录读到的数据与写入，写入在提交前只对本事务可见
+type recordTxn struct {
+	state   *DB
+	reads   []read
+	writes  []write
+	pending map[string]write // 本事务已经写过的key
+	seen    map[string]bool  // 已经记录过读检查的key
+}
+
+func (t *recordTxn) Get(k []byte) ([]byte, error) {
+	if w, ok := t.pending[string(k)]; ok {
+		if w.Delete {
+			return nil, edatabase.ErrKeyNotFound
+		}
+		return w.Value, nil
+	}
+	v, err := t.state.Get(k)
+	if err != nil && err != edatabase.ErrKeyNotFound {
+		return nil, err
+	}
+	if t.seen == nil {
+		t.seen = make(map[string]bool)
+	}
+	if !t.seen[string(k)] {
+		t.seen[string(k)] = true
+		t.reads = append(t.reads, read{Key: k, Value: v, Found: err == nil})
+	}
+	return v, err
+}
+
+func (t *recordTxn) Has(k []byte) bool {
+	_, err := t.Get(k)
+	return err == nil
+}
+
+func (t *recordTxn) ExpireAt(k []byte) (int64, error) {
+	if w, ok := t.pending[string(k)]; ok {
+		if w.Delete {
+			return 0, edatabase.ErrKeyNotFound
+		}
+		return w.ExpireAt, nil
+	}
+	return t.state.expireAt(k)
+}
+
+func (t *recordTxn) Set(k, v []byte) error {
+	return t.SetWithTTL(k, v, 0)
+}
+
+func (t *recordTxn) SetWithTTL(k, v []byte, expireAt int64) error {
+	t.add(write{Key: k, Value: v, ExpireAt: expireAt})
+	return nil
+}
+
+func (t *recordTxn) Delete(k []byte) error {
+	t.add(write{Key: k, Delete: true})
+	return nil
+}
+
+func (t *recordTxn) add(w write) {
+	t.writes = append(t.writes, w)
+	t.pending[string(w.Key)] = w
+}
+
+// fsm 状态机，保存在本地引擎中
+type fsm struct {
+	db edatabase.Database
+	mu sync.RWMutex // 载入快照时持写锁，期间不对外提供读取，避免读到清空了一半的数据
+}
+
+// precondition 带读检查的写入需要在leader上确认读到的数据没有被修改。
+// 检查使用leader的时钟判断TTL，结果体现为命令是否进入日志，不会因各节点时钟不同而分叉
+func (f *fsm) precondition(data []byte) (func() error, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var cmd command
+	if err := decode(data, &cmd); err != nil {
+		return nil, err
+	}
+	if len(cmd.Reads) == 0 {
+		return nil, nil
+	}
+	return func() error {
+		return f.checkReads(cmd.Reads)
+	}, nil
+}
+
+// checkReads 检查事务读到的数据是否仍然成立
+func (f *fsm) checkReads(reads []read) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, r := range reads {
+		v, err := f.db.Get(r.Key)
+		if err == edatabase.ErrKeyNotFound {
+			if r.Found {
+				return errConflict
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !r.Found || !bytes.Equal(v, r.Value) {
+			return errConflict
+		}
+	}
+	return nil
+}
+
+// apply 应用命令。读检查已经在追加日志前完成，这里只依赖命令本身，所有节点的结果相同
+func (f *fsm) apply(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var cmd command
+	if err := decode(data, &cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case opDropPrefix:
+		return f.db.DropPrefix(cmd.Prefix)
+	case opWrite:
+		return f.db.Update(func(txn edatabase.Txn) error {
+			for _, w := range cmd.Writes {
+				var err error
+				if w.Delete {
+					err = txn.Delete(w.Key)
+				} else {
+					err = txn.SetWithTTL(w.Key, w.Value, w.ExpireAt)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("raftdb: unknown command op %d", cmd.Op)
+	}
+}
+
+// snapshot 导出状态机的全部数据。使用Backup而不是逐条遍历，以保留过期时间
+func (f *fsm) snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := f.db.Backup(&buf, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *fsm) restore(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.db.DropPrefix(nil); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return f.db.Restore(bytes.NewReader(data))
+}
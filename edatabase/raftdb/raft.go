@@ -0,0 +1,925 @@
+package raftdb
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*raft.go Raft一致性算法：选主、日志复制、提交与应用、快照。
+实现参照论文《In Search of an Understandable Consensus Algorithm》，成员固定，不支持成员变更*/
+
+var (
+	// ErrClosed 节点已经关闭
+	ErrClosed = errors.New("raft node is closed")
+	// ErrTimeout 在超时时间内没能确认写入结果。写入可能已经生效，也可能没有
+	ErrTimeout = errors.New("raft proposal timeout")
+	// ErrLeadershipLost 写入提交前leader发生了切换，写入没有生效
+	ErrLeadershipLost = errors.New("leadership lost before the proposal was committed")
+	// ErrNoLeader 超时时间内没有选出leader
+	ErrNoLeader = errors.New("no leader")
+
+	errNotLeader = errors.New("not the leader")
+)
+
+// maxAppendEntries 一次AppendEntries最多携带的日志条数
+const maxAppendEntries = 512
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// stateMachine 被复制的状态机
+type stateMachine interface {
+	// precondition 返回命令进入日志前需要在leader上通过的检查，不需要检查时返回nil。
+	// 检查在此前的日志全部应用之后执行，返回错误时命令不会进入日志。
+	// 把检查放在追加之前，apply就只依赖日志本身，各节点(包括重启后重放日志的节点)的结果一致
+	precondition(command []byte) (func() error, error)
+	// apply 应用一条已提交的命令，返回的错误会交给发起写入的一方。空命令什么都不做
+	apply(command []byte) error
+	// snapshot 导出状态机的全部数据
+	snapshot() ([]byte, error)
+	// restore 用快照替换状态机的全部数据，data为nil表示清空
+	restore(data []byte) error
+}
+
+// waiter 等待某条日志被应用的写入方
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+type node struct {
+	id    string
+	peers map[string]string // 其他节点：ID -> 地址
+	conf  *Config
+
+	mu               sync.Mutex
+	proposeMu        sync.RWMutex // 带检查的命令持写锁，等待期间不再有新的命令进入日志
+	applyCond        *sync.Cond
+	role             role
+	term             uint64
+	votedFor         string
+	leaderID         string
+	log              []entry // log[0]是哨兵，序号为snapIndex，任期为snapTerm
+	snapIndex        uint64
+	snapTerm         uint64
+	commitIndex      uint64
+	lastApplied      uint64
+	pendingSnapshot  *snapshot // 收到的快照，等待应用协程载入状态机
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	electionDeadline time.Time
+	waiters          map[uint64]*waiter
+	closed           bool
+
+	storage  *storage
+	trans    *transport
+	sm       stateMachine
+	triggers map[string]chan struct{} // 通知复制协程立即发送
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newNode 恢复持久化的状态并启动节点
+func newNode(conf *Config, st *storage, sm stateMachine) (*node, error) {
+	n := &node{
+		id:         conf.ID,
+		peers:      make(map[string]string),
+		conf:       conf,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		waiters:    make(map[uint64]*waiter),
+		storage:    st,
+		sm:         sm,
+		triggers:   make(map[string]chan struct{}),
+		stop:       make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	for _, p := range conf.Peers {
+		if p.ID != conf.ID {
+			n.peers[p.ID] = p.Addr
+			n.triggers[p.ID] = make(chan struct{}, 1)
+		}
+	}
+
+	hs, snap, entries, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+	n.term, n.votedFor = hs.Term, hs.VotedFor
+	n.log = append([]entry{{}}, entries...)
+	// 状态机从快照重建，快照之后的日志在得知提交位置后重新应用
+	if snap != nil {
+		n.snapIndex, n.snapTerm = snap.Index, snap.Term
+		n.log[0].Term = snap.Term
+		n.commitIndex, n.lastApplied = snap.Index, snap.Index
+		err = sm.restore(snap.Data)
+	} else {
+		err = sm.restore(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.resetElectionTimer()
+
+	if n.trans, err = newTransport(conf.Listener, n); err != nil {
+		return nil, err
+	}
+	n.wg.Add(2 + len(n.peers))
+	go n.ticker()
+	go n.applier()
+	for id, addr := range n.peers {
+		go n.replicator(id, addr, n.triggers[id])
+	}
+	return n, nil
+}
+
+func (n *node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.log)) - 1
+}
+
+// termAt 序号为index的日志的任期，index不能小于snapIndex
+func (n *node) termAt(index uint64) uint64 {
+	return n.log[index-n.snapIndex].Term
+}
+
+func (n *node) resetElectionTimer() {
+	timeout := n.conf.ElectionTimeout + time.Duration(rand.Int63n(int64(n.conf.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// persist 保存任期与投票，调用者需持锁
+func (n *node) persist() error {
+	return n.storage.saveHardState(hardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// stepDown 发现更高的任期时转为follower，调用者需持锁
+func (n *node) stepDown(term uint64) error {
+	n.role = follower
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		return n.persist()
+	}
+	return nil
+}
+
+// quorum 构成多数派需要的节点数
+func (n *node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// ticker 检查选举超时
+func (n *node) ticker() {
+	defer n.wg.Done()
+	interval := n.conf.HeartbeatInterval / 2
+	if interval > 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		if n.role != leader && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection 成为候选人并向其他节点拉票，调用者需持锁
+func (n *node) startElection() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.id
+	n.leaderID = ""
+	n.resetElectionTimer()
+	if err := n.persist(); err != nil {
+		return
+	}
+	if len(n.peers) == 0 {
+		n.becomeLeader()
+		return
+	}
+
+	args := &RequestVoteArgs{
+		Term:         n.term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	votes := 1
+	for _, addr := range n.peers {
+		go func(addr string) {
+			reply := &RequestVoteReply{}
+			if err := n.trans.call(addr, "RequestVote", args, reply, n.conf.ElectionTimeout); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				_ = n.stepDown(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(addr)
+	}
+}
+
+// becomeLeader 当选leader，追加一条本任期的空日志以便尽快提交之前任期的日志，调用者需持锁
+func (n *node) becomeLeader() {
+	n.role = leader
+	n.leaderID = n.id
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+	}
+	_, _ = n.appendLocal(nil)
+}
+
+// appendLocal leader追加一条日志并通知复制，返回日志序号，调用者需持锁
+func (n *node) appendLocal(command []byte) (uint64, error) {
+	index := n.lastIndex() + 1
+	e := entry{Term: n.term, Command: command}
+	if err := n.storage.appendEntries(index, []entry{e}); err != nil {
+		return 0, err
+	}
+	n.log = append(n.log, e)
+	n.advanceCommit()
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	return index, nil
+}
+
+// advanceCommit leader根据各节点的复制进度推进提交位置。只有本任期的日志可以通过计数提交，调用者需持锁
+func (n *node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && index > n.snapIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		count := 1
+		for id := range n.peers {
+			if n.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// replicator leader向一个节点复制日志，有新日志时立即发送，否则按心跳间隔发送
+func (n *node) replicator(id, addr string, trigger chan struct{}) {
+	defer n.wg.Done()
+	t := time.NewTicker(n.conf.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-t.C:
+		case <-trigger:
+		}
+
+		n.mu.Lock()
+		if n.role != leader {
+			n.mu.Unlock()
+			continue
+		}
+		if n.nextIndex[id] <= n.snapIndex {
+			n.mu.Unlock()
+			n.sendSnapshot(id, addr)
+			continue
+		}
+		next := n.nextIndex[id]
+		end := n.lastIndex() + 1
+		if end-next > maxAppendEntries {
+			end = next + maxAppendEntries
+		}
+		args := &AppendEntriesArgs{
+			Term:         n.term,
+			LeaderID:     n.id,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  n.termAt(next - 1),
+			Entries:      append([]entry{}, n.log[next-n.snapIndex:end-n.snapIndex]...),
+			LeaderCommit: n.commitIndex,
+		}
+		n.mu.Unlock()
+
+		reply := &AppendEntriesReply{}
+		if err := n.trans.call(addr, "AppendEntries", args, reply, n.conf.ElectionTimeout); err != nil {
+			continue
+		}
+
+		n.mu.Lock()
+		if reply.Term > n.term {
+			_ = n.stepDown(reply.Term)
+		} else if n.role == leader && n.term == args.Term {
+			if reply.Success {
+				match := args.PrevLogIndex + uint64(len(args.Entries))
+				if match > n.matchIndex[id] {
+					n.matchIndex[id] = match
+				}
+				n.nextIndex[id] = match + 1
+				n.advanceCommit()
+			} else {
+				n.nextIndex[id] = n.backtrack(reply)
+			}
+			if n.nextIndex[id] <= n.lastIndex() { // 还有没发完的日志，继续发送
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// backtrack 根据follower返回的冲突信息计算新的nextIndex，调用者需持锁
+func (n *node) backtrack(reply *AppendEntriesReply) uint64 {
+	if reply.ConflictTerm != 0 {
+		for index := n.lastIndex(); index > n.snapIndex; index-- {
+			if n.termAt(index) == reply.ConflictTerm {
+				return index + 1
+			}
+		}
+	}
+	if reply.ConflictIndex == 0 {
+		return 1
+	}
+	return reply.ConflictIndex
+}
+
+// sendSnapshot 节点落后太多，所需日志已经被压缩，改为发送快照
+func (n *node) sendSnapshot(id, addr string) {
+	snap, err := n.storage.loadSnapshot()
+	if err != nil || snap == nil {
+		return
+	}
+	n.mu.Lock()
+	args := &InstallSnapshotArgs{Term: n.term, LeaderID: n.id, Snapshot: *snap}
+	n.mu.Unlock()
+
+	reply := &InstallSnapshotReply{}
+	if err = n.trans.call(addr, "InstallSnapshot", args, reply, n.conf.ElectionTimeout); err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		_ = n.stepDown(reply.Term)
+		return
+	}
+	if n.role == leader && n.term == args.Term && snap.Index > n.matchIndex[id] {
+		n.matchIndex[id] = snap.Index
+		n.nextIndex[id] = snap.Index + 1
+	}
+}
+
+func (n *node) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.term {
+		if err := n.stepDown(args.Term); err != nil {
+			return err
+		}
+	}
+	reply.Term = n.term
+	if args.Term < n.term || (n.votedFor != "" && n.votedFor != args.CandidateID) {
+		return nil
+	}
+	// 候选人的日志至少和自己一样新才投票
+	lastTerm := n.termAt(n.lastIndex())
+	if args.LastLogTerm < lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex < n.lastIndex()) {
+		return nil
+	}
+	n.votedFor = args.CandidateID
+	if err := n.persist(); err != nil {
+		return err
+	}
+	n.resetElectionTimer()
+	reply.VoteGranted = true
+	return nil
+}
+
+func (n *node) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if args.Term > n.term || n.role != follower {
+		if err := n.stepDown(args.Term); err != nil {
+			return err
+		}
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionTimer()
+	reply.Term = n.term
+
+	prev, entries := args.PrevLogIndex, args.Entries
+	if prev < n.snapIndex {
+		// 快照中已经包含的日志都是已提交的，跳过
+		skip := n.snapIndex - prev
+		if skip >= uint64(len(entries)) {
+			reply.Success = true
+			return nil
+		}
+		prev, entries = n.snapIndex, entries[skip:]
+	} else if prev > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return nil
+	} else if term := n.termAt(prev); term != args.PrevLogTerm {
+		reply.ConflictTerm = term
+		first := prev
+		for first > n.snapIndex+1 && n.termAt(first-1) == term {
+			first--
+		}
+		reply.ConflictIndex = first
+		return nil
+	}
+
+	for i, e := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= n.lastIndex() {
+			if n.termAt(index) == e.Term {
+				continue
+			}
+			// 与leader冲突的日志及其之后的日志全部删除
+			if err := n.storage.deleteEntries(index, n.lastIndex()); err != nil {
+				return err
+			}
+			n.log = n.log[:index-n.snapIndex]
+		}
+		if err := n.storage.appendEntries(index, entries[i:]); err != nil {
+			return err
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+
+	reply.Success = true
+	if lastNew := prev + uint64(len(entries)); args.LeaderCommit > n.commitIndex {
+		n.commitIndex = args.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		n.applyCond.Broadcast()
+	}
+	return nil
+}
+
+func (n *node) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if args.Term > n.term || n.role != follower {
+		if err := n.stepDown(args.Term); err != nil {
+			return err
+		}
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionTimer()
+	reply.Term = n.term
+
+	snap := args.Snapshot
+	if snap.Index <= n.snapIndex || snap.Index <= n.lastApplied {
+		return nil
+	}
+	if err := n.storage.saveSnapshot(&snap); err != nil {
+		return err
+	}
+	// 快照之后的日志如果与快照一致则保留，否则全部丢弃
+	oldLast := n.lastIndex()
+	var rest []entry
+	if snap.Index < oldLast && n.termAt(snap.Index) == snap.Term {
+		rest = n.log[snap.Index-n.snapIndex+1:]
+		oldLast = snap.Index
+	}
+	if err := n.storage.deleteEntries(n.snapIndex+1, oldLast); err != nil {
+		return err
+	}
+	n.log = append([]entry{{Term: snap.Term}}, rest...)
+	n.snapIndex, n.snapTerm = snap.Index, snap.Term
+	if n.commitIndex < snap.Index {
+		n.commitIndex = snap.Index
+	}
+	n.pendingSnapshot = &snap
+	n.applyCond.Broadcast()
+	return nil
+}
+
+// applier 按顺序把已提交的日志应用到状态机，并通知等待结果的写入方
+func (n *node) applier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.closed && n.pendingSnapshot == nil && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+
+		if snap := n.pendingSnapshot; snap != nil {
+			n.pendingSnapshot = nil
+			if snap.Index > n.lastApplied {
+				n.mu.Unlock()
+				err := n.sm.restore(snap.Data)
+				n.mu.Lock()
+				if err != nil { // 稍后重试，在快照载入之前不能继续应用日志
+					if n.pendingSnapshot == nil {
+						n.pendingSnapshot = snap
+					}
+					n.mu.Unlock()
+					time.Sleep(n.conf.HeartbeatInterval)
+					continue
+				}
+				n.lastApplied = snap.Index
+				n.releaseWaiters(snap)
+			}
+			n.mu.Unlock()
+			continue
+		}
+
+		start, end := n.lastApplied+1, n.commitIndex
+		if end-start >= maxAppendEntries {
+			end = start + maxAppendEntries - 1
+		}
+		batch := append([]entry{}, n.log[start-n.snapIndex:end-n.snapIndex+1]...)
+		n.mu.Unlock()
+
+		for i, e := range batch {
+			err := n.sm.apply(e.Command)
+			index := start + uint64(i)
+
+			n.mu.Lock()
+			if index > n.lastApplied {
+				n.lastApplied = index
+			}
+			if w, ok := n.waiters[index]; ok {
+				delete(n.waiters, index)
+				if w.term != e.Term { // 该位置的日志被新leader覆盖了
+					err = ErrLeadershipLost
+				}
+				w.done <- err
+			}
+			n.mu.Unlock()
+		}
+		n.maybeSnapshot()
+	}
+}
+
+// releaseWaiters 载入快照后通知序号被快照覆盖的写入方，调用者需持锁。
+// 快照中同一任期的日志只能来自该任期的leader，与写入方的任期相同说明写入已经生效；否则无法判断写入是否生效
+func (n *node) releaseWaiters(snap *snapshot) {
+	for index, w := range n.waiters {
+		if index > snap.Index {
+			continue
+		}
+		delete(n.waiters, index)
+		if w.term == snap.Term {
+			w.done <- nil
+		} else {
+			w.done <- ErrTimeout
+		}
+	}
+}
+
+// maybeSnapshot 已应用的日志足够多时生成快照并压缩日志。只在应用协程中调用，此时状态机不会被修改
+func (n *node) maybeSnapshot() {
+	n.mu.Lock()
+	if n.pendingSnapshot != nil || n.lastApplied < n.snapIndex+n.conf.SnapshotThreshold {
+		n.mu.Unlock()
+		return
+	}
+	index := n.lastApplied
+	term := n.termAt(index)
+	n.mu.Unlock()
+
+	data, err := n.sm.snapshot()
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.snapIndex {
+		return
+	}
+	if err = n.storage.saveSnapshot(&snapshot{Index: index, Term: term, Data: data}); err != nil {
+		return
+	}
+	oldSnap := n.snapIndex
+	n.log = append([]entry{{Term: term}}, n.log[index-n.snapIndex+1:]...)
+	n.snapIndex, n.snapTerm = index, term
+	_ = n.storage.deleteEntries(oldSnap+1, index)
+}
+
+// propose leader检查并追加一条命令，等待其被应用，返回状态机应用该命令的结果
+func (n *node) propose(ctx context.Context, command []byte) error {
+	check, err := n.sm.precondition(command)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		n.proposeMu.Lock()
+	} else {
+		n.proposeMu.RLock()
+	}
+	index, w, err := n.appendChecked(ctx, command, check)
+	if check != nil {
+		n.proposeMu.Unlock()
+	} else {
+		n.proposeMu.RUnlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-w.done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return ErrTimeout
+	case <-n.stop:
+		return ErrClosed
+	}
+}
+
+// appendChecked 等此前的日志全部应用后执行check，通过后追加命令。
+// check与追加在同一次持锁中完成，中间不会有其他日志进入
+func (n *node) appendChecked(ctx context.Context, command []byte, check func() error) (uint64, *waiter, error) {
+	for {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return 0, nil, ErrClosed
+		}
+		if n.role != leader {
+			n.mu.Unlock()
+			return 0, nil, errNotLeader
+		}
+		if check == nil || n.lastApplied >= n.lastIndex() {
+			break
+		}
+		n.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, nil, ErrTimeout
+		case <-n.stop:
+			return 0, nil, ErrClosed
+		case <-time.After(time.Millisecond):
+		}
+	}
+	defer n.mu.Unlock()
+
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, nil, err
+		}
+	}
+	index, err := n.appendLocal(command)
+	if err != nil {
+		return 0, nil, err
+	}
+	w := &waiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[index] = w
+	return index, w, nil
+}
+
+// leader 当前leader的ID与地址，未知时为空
+func (n *node) leader() (string, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.leaderID == n.id {
+		return n.id, ""
+	}
+	return n.leaderID, n.peers[n.leaderID]
+}
+
+// submit 提交一条命令：自己是leader时直接追加，否则转发给leader。没有leader时等待选举，直到ctx结束
+func (n *node) submit(ctx context.Context, command []byte) error {
+	for {
+		err := n.propose(ctx, command)
+		if err != errNotLeader {
+			return err
+		}
+
+		if id, addr := n.leader(); addr != "" && id != n.id {
+			reply := &ProposeReply{}
+			timeout := n.conf.ProposeTimeout
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = time.Until(deadline)
+			}
+			// 请求发出后出错不再重试，避免同一条命令被应用两次
+			if err = n.trans.call(addr, "Propose", &ProposeArgs{Command: command}, reply, timeout); err != nil {
+				return err
+			}
+			switch {
+			case reply.NotLeader:
+			case reply.Conflict:
+				return errConflict
+			case reply.Err != "":
+				return errors.New(reply.Err)
+			default:
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrNoLeader
+		case <-n.stop:
+			return ErrClosed
+		case <-time.After(n.conf.HeartbeatInterval):
+		}
+	}
+}
+
+func (n *node) handlePropose(args *ProposeArgs, reply *ProposeReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.conf.ProposeTimeout)
+	defer cancel()
+
+	switch err := n.propose(ctx, args.Command); err {
+	case nil:
+	case errNotLeader:
+		reply.NotLeader = true
+	case errConflict:
+		reply.Conflict = true
+	default:
+		reply.Err = err.Error()
+	}
+	return nil
+}
+
+// readIndex leader当前的提交位置。新leader在提交本任期的第一条日志之前不能确定提交位置。
+// 记下提交位置后还要通过一轮心跳确认多数节点仍承认自己是leader，否则与集群隔离的旧leader会返回过期的位置
+func (n *node) readIndex() (uint64, error) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return 0, errNotLeader
+	}
+	if n.termAt(n.commitIndex) != n.term {
+		n.mu.Unlock()
+		return 0, ErrNoLeader
+	}
+	index, term := n.commitIndex, n.term
+	n.mu.Unlock()
+
+	if err := n.confirmLeadership(term); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// confirmLeadership 向其他节点发送一轮心跳，多数节点在任期term内回应时确认自己仍是leader
+func (n *node) confirmLeadership(term uint64) error {
+	n.mu.Lock()
+	if n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return errNotLeader
+	}
+	acks := make(chan bool, len(n.peers))
+	for id, addr := range n.peers {
+		prev := n.nextIndex[id] - 1
+		if prev < n.snapIndex {
+			prev = n.snapIndex
+		}
+		// 不携带日志与提交位置，只用来确认对方是否承认本任期
+		args := &AppendEntriesArgs{Term: term, LeaderID: n.id, PrevLogIndex: prev, PrevLogTerm: n.termAt(prev)}
+		go func(addr string) {
+			reply := &AppendEntriesReply{}
+			if err := n.trans.call(addr, "AppendEntries", args, reply, n.conf.ElectionTimeout); err != nil {
+				acks <- false
+				return
+			}
+			if reply.Term > term {
+				n.mu.Lock()
+				if reply.Term > n.term {
+					_ = n.stepDown(reply.Term)
+				}
+				n.mu.Unlock()
+			}
+			acks <- reply.Term == term
+		}(addr)
+	}
+	n.mu.Unlock()
+
+	count := 1
+	for i := 0; i < len(n.peers) && count < n.quorum(); i++ {
+		if <-acks {
+			count++
+		}
+	}
+	if count < n.quorum() {
+		return errNotLeader
+	}
+	return nil
+}
+
+func (n *node) handleReadIndex(reply *ReadIndexReply) error {
+	index, err := n.readIndex()
+	reply.Index = index
+	return err
+}
+
+// sync 等待本节点应用到leader当前的提交位置
+func (n *node) sync(ctx context.Context) error {
+	var index uint64
+	for {
+		var err error
+		if index, err = n.readIndex(); err == errNotLeader {
+			if id, addr := n.leader(); addr != "" && id != n.id {
+				reply := &ReadIndexReply{}
+				if err = n.trans.call(addr, "ReadIndex", &ReadIndexArgs{}, reply, n.conf.ElectionTimeout); err == nil {
+					index = reply.Index
+				}
+			}
+		}
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ErrNoLeader
+		case <-n.stop:
+			return ErrClosed
+		case <-time.After(n.conf.HeartbeatInterval):
+		}
+	}
+
+	for {
+		n.mu.Lock()
+		applied := n.lastApplied
+		n.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ErrTimeout
+		case <-n.stop:
+			return ErrClosed
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (n *node) close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.stop)
+	for index, w := range n.waiters {
+		delete(n.waiters, index)
+		w.done <- ErrClosed
+	}
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+
+	n.trans.close()
+	n.wg.Wait()
+}
@@ -0,0 +1,360 @@
+package raftdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azd1997/ego/edatabase"
+)
+
+// testCluster 在本进程内通过loopback组成的集群
+type testCluster struct {
+	t     *testing.T
+	confs []*Config
+	dbs   []*DB
+}
+
+// newTestCluster 为size个节点分配地址与目录，节点需要用start启动
+func newTestCluster(t *testing.T, size int, engine string, threshold uint64) *testCluster {
+	c := &testCluster{t: t, dbs: make([]*DB, size)}
+	peers := make([]Peer, size)
+	listeners := make([]net.Listener, size)
+	for i := range peers {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		peers[i] = Peer{ID: fmt.Sprintf("n%d", i), Addr: l.Addr().String()}
+	}
+	for i := range peers {
+		dir, err := ioutil.TempDir("", "raftdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.confs = append(c.confs, &Config{
+			ID:                peers[i].ID,
+			Peers:             peers,
+			Listener:          listeners[i],
+			Dir:               dir,
+			Engine:            engine,
+			HeartbeatInterval: 20 * time.Millisecond,
+			ElectionTimeout:   150 * time.Millisecond,
+			SnapshotThreshold: threshold,
+		})
+	}
+	t.Cleanup(func() {
+		for i, db := range c.dbs {
+			if db != nil {
+				db.Close()
+			} else {
+				c.confs[i].Listener.Close()
+			}
+			os.RemoveAll(c.confs[i].Dir)
+		}
+	})
+	return c
+}
+
+func (c *testCluster) start(i int) *DB {
+	db, err := Open(c.confs[i])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.dbs[i] = db
+	return db
+}
+
+func (c *testCluster) stop(i int) {
+	if err := c.dbs[i].Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.dbs[i] = nil
+}
+
+// leader 等待存活的节点中选出leader
+func (c *testCluster) leader() int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, db := range c.dbs {
+			if db != nil && db.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return -1
+}
+
+func (c *testCluster) sync(db *DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.Sync(ctx); err != nil {
+		c.t.Fatalf("%s: Sync: %v", db.ID(), err)
+	}
+}
+
+func expectValue(t *testing.T, db edatabase.Database, k, want string) {
+	t.Helper()
+	v, err := db.Get([]byte(k))
+	if err != nil || string(v) != want {
+		t.Fatalf("Get(%q) = %q, %v, want %q", k, v, err, want)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3, "memory", 0)
+	for i := range c.dbs {
+		c.start(i)
+	}
+	follower := c.dbs[(c.leader()+1)%3]
+
+	// follower上的写入转发给leader
+	if err := follower.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.BatchSet([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有节点并发地对同一个计数器做Increment，不能丢失更新
+	var wg sync.WaitGroup
+	for _, db := range c.dbs {
+		wg.Add(1)
+		go func(db *DB) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, err := db.Increment([]byte("counter"), 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(db)
+	}
+	wg.Wait()
+
+	for _, db := range c.dbs {
+		c.sync(db)
+		expectValue(t, db, "k", "v")
+		expectValue(t, db, "b", "2")
+		if db.Has([]byte("a")) {
+			t.Fatalf("%s: deleted key a still exists", db.ID())
+		}
+		if n, err := db.Increment([]byte("counter"), 0); err != nil || n != 30 {
+			t.Fatalf("%s: counter = %d, %v, want 30", db.ID(), n, err)
+		}
+	}
+
+	// Increment保留计数器原有的过期时间
+	expireAt := time.Now().Add(time.Hour).Unix()
+	if err := follower.SetWithTTL([]byte("ttl-counter"), make([]byte, 8), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Increment([]byte("ttl-counter"), 1); err != nil {
+		t.Fatal(err)
+	}
+	err := follower.Update(func(txn edatabase.Txn) error {
+		got, err := txn.(edatabase.ExpiryTxn).ExpireAt([]byte("ttl-counter"))
+		if err == nil && got != expireAt {
+			t.Errorf("ttl-counter expires at %d after Increment, want %d", got, expireAt)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := follower.Namespace("users")
+	if err := ns.Set([]byte("alice"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.DropPrefix(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range c.dbs {
+		c.sync(db)
+		if n := db.IterDB(func(k, v []byte) error { return nil }); n != 0 {
+			t.Fatalf("%s: %d keys left after DropPrefix", db.ID(), n)
+		}
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3, "memory", 0)
+	for i := range c.dbs {
+		c.start(i)
+	}
+	old := c.leader()
+	if err := c.dbs[old].Set([]byte("before"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	c.stop(old)
+	leader := c.leader()
+	if leader == old {
+		t.Fatal("stopped node is still the leader")
+	}
+	for _, db := range c.dbs {
+		if db == nil {
+			continue
+		}
+		if err := db.Set([]byte("after-"+db.ID()), []byte("2")); err != nil {
+			t.Fatalf("%s: write after failover: %v", db.ID(), err)
+		}
+	}
+	for _, db := range c.dbs {
+		if db == nil {
+			continue
+		}
+		c.sync(db)
+		expectValue(t, db, "before", "1")
+		for _, other := range c.dbs {
+			if other != nil {
+				expectValue(t, db, "after-"+other.ID(), "2")
+			}
+		}
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newTestCluster(t, 3, "memory", 10)
+	c.start(0)
+	c.start(1)
+	db := c.dbs[c.leader()]
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	if err := db.SetWithTTL([]byte("ttl"), []byte("x"), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第三个节点需要的日志已经被压缩，只能通过快照追上
+	late := c.start(2)
+	c.sync(late)
+	for i := 0; i < 50; i++ {
+		expectValue(t, late, fmt.Sprintf("key%02d", i), fmt.Sprint(i))
+	}
+	late.node.mu.Lock()
+	snapIndex := late.node.snapIndex
+	late.node.mu.Unlock()
+	if snapIndex == 0 {
+		t.Fatal("late node caught up without installing a snapshot")
+	}
+
+	expectValue(t, late, "ttl", "x")
+}
+
+func TestRestart(t *testing.T) {
+	c := newTestCluster(t, 1, "badger", 5)
+	db := c.start(0)
+	c.leader()
+	for i := 0; i < 12; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.stop(0)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.confs[0].Listener = l
+	c.confs[0].Peers = []Peer{{ID: "n0", Addr: l.Addr().String()}}
+	db = c.start(0)
+	c.leader()
+	c.sync(db)
+	for i := 0; i < 12; i++ {
+		expectValue(t, db, fmt.Sprintf("key%02d", i), fmt.Sprint(i))
+	}
+}
+
+func TestApplyIgnoresReadSet(t *testing.T) {
+	db, err := edatabase.OpenDatabase("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	f := &fsm{db: db}
+
+	// 事务读到k=old，提交前k已经过期(或被修改)
+	data, err := encode(&command{
+		Op:     opWrite,
+		Reads:  []read{{Key: []byte("k"), Value: []byte("old"), Found: true}},
+		Writes: []write{{Key: []byte("k"), Value: []byte("new")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := f.precondition(data)
+	if err != nil || check == nil {
+		t.Fatalf("precondition returned no check, %v", err)
+	}
+	if err = check(); err != errConflict {
+		t.Fatalf("check = %v, want errConflict", err)
+	}
+
+	// 已经进入日志的命令在任何节点上都照常应用，不再依赖本地时钟
+	if err = f.apply(data); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "k", "new")
+
+	if check, _ = f.precondition(nil); check != nil {
+		t.Fatal("empty command should not need a check")
+	}
+}
+
+func TestSyncRequiresQuorum(t *testing.T) {
+	c := newTestCluster(t, 3, "memory", 1000)
+	for i := range c.confs {
+		c.start(i)
+	}
+	l := c.leader()
+	c.sync(c.dbs[l])
+
+	// 其他节点全部停止后，旧leader无法确认自己仍是leader，不能再提供线性一致读
+	for i := range c.dbs {
+		if i != l {
+			c.stop(i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := c.dbs[l].Sync(ctx); err == nil {
+		t.Fatal("isolated leader served Sync")
+	}
+}
+
+func TestSnapshotReleasesWaiters(t *testing.T) {
+	n := &node{waiters: make(map[uint64]*waiter)}
+	sameTerm := &waiter{term: 2, done: make(chan error, 1)}
+	oldTerm := &waiter{term: 1, done: make(chan error, 1)}
+	later := &waiter{term: 2, done: make(chan error, 1)}
+	n.waiters[5], n.waiters[3], n.waiters[9] = sameTerm, oldTerm, later
+
+	n.releaseWaiters(&snapshot{Index: 6, Term: 2})
+	if err := <-sameTerm.done; err != nil {
+		t.Fatalf("waiter in the snapshot term got %v", err)
+	}
+	if err := <-oldTerm.done; err != ErrTimeout {
+		t.Fatalf("waiter from an older term got %v, want ErrTimeout", err)
+	}
+	if _, ok := n.waiters[9]; !ok || len(n.waiters) != 1 {
+		t.Fatalf("waiters after snapshot = %v", n.waiters)
+	}
+}
@@ -0,0 +1,155 @@
+package raftdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/azd1997/ego/edatabase"
+)
+
+/*storage.go 把Raft需要持久化的状态(任期、投票、日志与快照)保存在本地的edatabase引擎中*/
+
+// 日志库中的key
+var (
+	keyHardState = []byte("raft/state")    // 当前任期与投票
+	keySnapshot  = []byte("raft/snapshot") // 最近一次快照
+	keyLogPrefix = []byte("raft/log/")     // 日志：keyLogPrefix + 8字节大端的日志序号
+)
+
+// hardState 需要在应答RPC之前落盘的状态
+type hardState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// entry 一条Raft日志
+type entry struct {
+	Term    uint64
+	Command []byte
+}
+
+// snapshot 状态机快照：截至Index(含)的全部日志应用后的数据
+type snapshot struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+func logKey(index uint64) []byte {
+	key := make([]byte, len(keyLogPrefix)+8)
+	copy(key, keyLogPrefix)
+	binary.BigEndian.PutUint64(key[len(keyLogPrefix):], index)
+	return key
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// storage 日志库
+type storage struct {
+	db edatabase.Database
+}
+
+func (s *storage) saveHardState(hs hardState) error {
+	data, err := encode(hs)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(keyHardState, data)
+}
+
+// appendEntries 写入从index开始的连续日志
+func (s *storage) appendEntries(index uint64, entries []entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	keys := make([][]byte, len(entries))
+	values := make([][]byte, len(entries))
+	for i, e := range entries {
+		data, err := encode(e)
+		if err != nil {
+			return err
+		}
+		keys[i], values[i] = logKey(index+uint64(i)), data
+	}
+	return s.db.BatchSet(keys, values)
+}
+
+// deleteEntries 删除[from, to]之间的日志
+func (s *storage) deleteEntries(from, to uint64) error {
+	if from > to {
+		return nil
+	}
+	keys := make([][]byte, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		keys = append(keys, logKey(i))
+	}
+	return s.db.BatchDelete(keys)
+}
+
+func (s *storage) saveSnapshot(snap *snapshot) error {
+	data, err := encode(snap)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(keySnapshot, data)
+}
+
+func (s *storage) loadSnapshot() (*snapshot, error) {
+	data, err := s.db.Get(keySnapshot)
+	if err == edatabase.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{}
+	return snap, decode(data, snap)
+}
+
+// load 读出任期、投票、快照以及快照之后的全部日志
+func (s *storage) load() (hardState, *snapshot, []entry, error) {
+	var hs hardState
+	if data, err := s.db.Get(keyHardState); err == nil {
+		if err = decode(data, &hs); err != nil {
+			return hs, nil, nil, err
+		}
+	} else if err != edatabase.ErrKeyNotFound {
+		return hs, nil, nil, err
+	}
+
+	snap, err := s.loadSnapshot()
+	if err != nil {
+		return hs, nil, nil, err
+	}
+	var snapIndex uint64
+	if snap != nil {
+		snapIndex = snap.Index
+	}
+
+	entries := make([]entry, 0)
+	next := snapIndex + 1
+	s.db.IterPrefix(keyLogPrefix, func(k, v []byte) error {
+		index := binary.BigEndian.Uint64(k[len(keyLogPrefix):])
+		if index != next || err != nil { // 快照之前残留的日志以及不连续的日志都不要
+			return nil
+		}
+		var e entry
+		if err = decode(v, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		next++
+		return nil
+	})
+	return hs, snap, entries, err
+}
@@ -0,0 +1,234 @@
+package raftdb
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+/*transport.go 节点之间基于TCP的net/rpc通信*/
+
+// errRPCTimeout RPC在超时时间内没有返回
+var errRPCTimeout = errors.New("rpc timeout")
+
+// 以下为节点之间RPC的参数与返回值。net/rpc要求它们是导出类型，使用者无需关心
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// 失败时用于快速回退nextIndex：ConflictTerm为冲突位置的任期(0表示日志太短)，ConflictIndex为该任期的第一条日志
+	ConflictTerm  uint64
+	ConflictIndex uint64
+}
+
+type InstallSnapshotArgs struct {
+	Term     uint64
+	LeaderID string
+	Snapshot snapshot
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+type ProposeArgs struct {
+	Command []byte
+}
+
+type ProposeReply struct {
+	Err       string // 应用命令出错时的错误信息
+	Conflict  bool   // 事务的读检查失败
+	NotLeader bool   // 对方已经不是leader，需要重新寻找leader
+}
+
+type ReadIndexArgs struct{}
+
+type ReadIndexReply struct {
+	Index uint64
+}
+
+// rpcService 注册到net/rpc的服务，方法名即RPC名
+type rpcService struct {
+	n *node
+}
+
+func (s *rpcService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return s.n.handleRequestVote(args, reply)
+}
+
+func (s *rpcService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return s.n.handleAppendEntries(args, reply)
+}
+
+func (s *rpcService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return s.n.handleInstallSnapshot(args, reply)
+}
+
+// Propose follower转发过来的写入
+func (s *rpcService) Propose(args *ProposeArgs, reply *ProposeReply) error {
+	return s.n.handlePropose(args, reply)
+}
+
+// ReadIndex 返回leader当前的提交位置
+func (s *rpcService) ReadIndex(args *ReadIndexArgs, reply *ReadIndexReply) error {
+	return s.n.handleReadIndex(reply)
+}
+
+// transport 监听本节点地址并维护到其他节点的连接
+type transport struct {
+	listener net.Listener
+	server   *rpc.Server
+
+	mu      sync.Mutex
+	clients map[string]*rpc.Client // 地址 -> 连接
+	conns   map[net.Conn]struct{}  // 对方连进来的连接，关闭时一并断开
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newTransport(listener net.Listener, n *node) (*transport, error) {
+	t := &transport{
+		listener: listener,
+		server:   rpc.NewServer(),
+		clients:  make(map[string]*rpc.Client),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if err := t.server.RegisterName("Raft", &rpcService{n: n}); err != nil {
+		return nil, err
+	}
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+func (t *transport) accept() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.mu.Unlock()
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.server.ServeConn(conn)
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+// client 取到addr的连接，没有则新建
+func (t *transport) client(addr string, timeout time.Duration) (*rpc.Client, error) {
+	t.mu.Lock()
+	c, ok := t.clients[addr]
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if ok {
+		return c, nil
+	}
+
+	// 拨号不持锁，避免一个不可达的节点拖慢对其他节点的调用
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c = rpc.NewClient(conn)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		c.Close()
+		return nil, ErrClosed
+	}
+	if exist, ok := t.clients[addr]; ok { // 并发拨号时保留先建立的连接
+		c.Close()
+		return exist, nil
+	}
+	t.clients[addr] = c
+	return c, nil
+}
+
+// call 调用addr上的方法，超时或连接出错时丢弃该连接，下次调用重新建立
+func (t *transport) call(addr, method string, args, reply interface{}, timeout time.Duration) error {
+	c, err := t.client(addr, timeout)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	call := c.Go("Raft."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = errRPCTimeout
+	}
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			t.drop(addr, c)
+		}
+	}
+	return err
+}
+
+func (t *transport) drop(addr string, c *rpc.Client) {
+	t.mu.Lock()
+	if t.clients[addr] == c {
+		delete(t.clients, addr)
+	}
+	t.mu.Unlock()
+	c.Close()
+}
+
+func (t *transport) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.listener.Close()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	for addr, c := range t.clients {
+		c.Close()
+		delete(t.clients, addr)
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
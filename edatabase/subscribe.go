@@ -0,0 +1,216 @@
+package edatabase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+/*subscribe.go 变更订阅：把每一次写入和删除推送给订阅了对应前缀的订阅者，用于缓存失效、数据同步等场景。
+有订阅者时，写入方在提交锁内提交并为变更分配序号，订阅者收到的顺序与提交顺序一致；
+每个订阅者有自己的队列，推送不会等待订阅者，消费太慢的订阅者被断开，而不是拖慢写入*/
+
+// subscriberBuffer 每个订阅者最多积压的变更批次数，积压满后该订阅者被断开并返回ErrSlowSubscriber
+const subscriberBuffer = 1024
+
+// ErrSlowSubscriber 订阅者积压的变更太多，订阅被断开，之后的变更不会再推送。订阅者应当重新读取数据后再次订阅
+var ErrSlowSubscriber = errors.New("subscriber fell too far behind, changes were dropped")
+
+// KV 一次变更。Deleted为true时表示删除，此时Value为空
+type KV struct {
+	Key      []byte
+	Value    []byte
+	ExpireAt int64 // 过期时间(unix秒)，0表示永不过期
+	Deleted  bool
+	// Bulk 为true时表示以Key为前缀的数据被批量修改(DropPrefix，或badger引擎的Restore)，没有逐条的变更，
+	// 订阅者应丢弃该前缀下的缓存。Key为空表示整个数据库
+	Bulk bool
+	// Seq 变更的序号，同一个数据库内按提交顺序递增
+	Seq uint64
+}
+
+// subscriber 一个订阅者
+type subscriber struct {
+	prefix   []byte
+	ch       chan []*KV
+	overflow chan struct{} // 队列满时关闭，订阅者随之退出
+}
+
+// publisher 变更发布器，每个数据库实例持有一个
+type publisher struct {
+	commitMu  sync.Mutex // 有订阅者时写入方在提交期间持有，保证推送顺序与提交顺序一致
+	seq       uint64     // 最近分配的序号，持有commitMu时修改
+	mu        sync.RWMutex
+	subs      map[uint64]*subscriber
+	nextID    uint64
+	count     int32         // 订阅者数量，没有订阅者时写入方可以跳过加锁与拷贝
+	closed    chan struct{} // 数据库关闭时关闭
+	closeOnce sync.Once
+}
+
+func newPublisher() *publisher {
+	return &publisher{
+		subs:   make(map[uint64]*subscriber),
+		closed: make(chan struct{}),
+	}
+}
+
+// active 是否有订阅者
+func (p *publisher) active() bool {
+	return atomic.LoadInt32(&p.count) > 0
+}
+
+// subscribe 阻塞地把以prefix开头的变更交给fn，直到ctx结束(返回ctx.Err())、数据库关闭(返回nil)
+// 或积压太多(返回ErrSlowSubscriber)。fn在订阅者自己的协程中执行，可以读写数据库
+func (p *publisher) subscribe(ctx context.Context, prefix []byte, fn func(kv *KV)) error {
+	sub := &subscriber{
+		prefix:   append([]byte{}, prefix...),
+		ch:       make(chan []*KV, subscriberBuffer),
+		overflow: make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return nil
+	default:
+	}
+	id := p.nextID
+	p.nextID++
+	p.subs[id] = sub
+	atomic.AddInt32(&p.count, 1)
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.subs, id)
+		atomic.AddInt32(&p.count, -1)
+		p.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case batch := <-sub.ch:
+			for _, kv := range batch {
+				fn(kv)
+			}
+		case <-sub.overflow:
+			return ErrSlowSubscriber
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.closed:
+			return nil
+		}
+	}
+}
+
+// begin 有订阅者时获取提交锁并返回true。写入方在提交前调用，提交后无论成败都必须调用end
+func (p *publisher) begin() bool {
+	if !p.active() {
+		return false
+	}
+	p.commitMu.Lock()
+	return true
+}
+
+// end 为提交成功的变更分配序号并放入匹配的订阅者队列，然后释放提交锁。locked为false时什么都不做
+func (p *publisher) end(locked bool, kvs []*KV) {
+	if !locked {
+		return
+	}
+	defer p.commitMu.Unlock()
+	if len(kvs) == 0 {
+		return
+	}
+	for _, kv := range kvs {
+		p.seq++
+		kv.Seq = p.seq
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, sub := range p.subs {
+		matched := make([]*KV, 0, len(kvs))
+		for _, kv := range kvs {
+			if sub.matches(kv) {
+				matched = append(matched, kv)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case sub.ch <- matched:
+		case <-sub.overflow:
+		default:
+			close(sub.overflow)
+		}
+	}
+}
+
+// matches 变更是否属于订阅的前缀。批量变更的前缀与订阅的前缀有重叠即推送
+func (sub *subscriber) matches(kv *KV) bool {
+	if kv.Bulk {
+		return prefixOverlap(kv.Key, sub.prefix)
+	}
+	return bytes.HasPrefix(kv.Key, sub.prefix)
+}
+
+// prefixOverlap 以a开头的key与以b开头的key是否可能相同
+func prefixOverlap(a, b []byte) bool {
+	return bytes.HasPrefix(a, b) || bytes.HasPrefix(b, a)
+}
+
+// setKVs 一批写入对应的变更，expireAts为nil表示都不过期
+func setKVs(keys, values [][]byte, expireAts []int64) []*KV {
+	kvs := make([]*KV, len(keys))
+	for i, k := range keys {
+		kvs[i] = &KV{Key: append([]byte{}, k...), Value: append([]byte{}, values[i]...)}
+		if expireAts != nil {
+			kvs[i].ExpireAt = expireAts[i]
+		}
+	}
+	return kvs
+}
+
+// deleteKVs 一批删除对应的变更
+func deleteKVs(keys [][]byte) []*KV {
+	kvs := make([]*KV, len(keys))
+	for i, k := range keys {
+		kvs[i] = &KV{Key: append([]byte{}, k...), Deleted: true}
+	}
+	return kvs
+}
+
+// bulkKVs 以prefix开头的数据被批量修改对应的变更
+func bulkKVs(prefix []byte) []*KV {
+	return []*KV{{Key: append([]byte{}, prefix...), Bulk: true}}
+}
+
+// close 数据库关闭时通知全部订阅者退出
+func (p *publisher) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// txnRecorder 记录事务中的写入，事务提交成功后一并推送
+type txnRecorder struct {
+	kvs []*KV
+}
+
+func (tr *txnRecorder) set(k, v []byte) {
+	tr.kvs = append(tr.kvs, &KV{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+}
+
+func (tr *txnRecorder) setWithTTL(k, v []byte, expireAt int64) {
+	tr.set(k, v)
+	tr.kvs[len(tr.kvs)-1].ExpireAt = expireAt
+}
+
+func (tr *txnRecorder) delete(k []byte) {
+	tr.kvs = append(tr.kvs, &KV{Key: append([]byte{}, k...), Deleted: true})
+}
@@ -0,0 +1,308 @@
+package edatabase
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azd1997/ego/econvert"
+)
+
+func checkSubscribe(t *testing.T, db Database) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan *KV, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Subscribe(ctx, []byte("user/"), func(kv *KV) {
+			events <- kv
+		})
+	}()
+
+	// 订阅在另一个协程中注册，反复写入哨兵直到收到推送，确认订阅已经生效
+	for ready := false; !ready; {
+		if err := db.Set([]byte("user/ready"), []byte{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-events:
+			ready = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for len(events) > 0 {
+		<-events
+	}
+
+	_ = db.Set([]byte("other/1"), []byte("ignored"))
+	_ = db.Set([]byte("user/1"), []byte("alice"))
+	_ = db.Delete([]byte("user/1"))
+	_, _ = db.Increment([]byte("user/counter"), 1)
+
+	expect := []struct {
+		key     string
+		deleted bool
+	}{{"user/1", false}, {"user/1", true}, {"user/counter", false}}
+	for _, e := range expect {
+		select {
+		case kv := <-events:
+			if string(kv.Key) != e.key || kv.Deleted != e.deleted {
+				t.Fatalf("got event %s deleted=%v, want %s deleted=%v", kv.Key, kv.Deleted, e.key, e.deleted)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event for %s not received", e.key)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Subscribe returned %v after cancel", err)
+	}
+}
+
+func TestSubscribeMemory(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+
+	checkSubscribe(t, db)
+	checkSubscribe(t, db.Namespace("ns"))
+}
+
+func TestSubscribeBadger(t *testing.T) {
+	db, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	checkSubscribe(t, db)
+}
+
+func TestSubscribeStopsOnClose(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Subscribe(context.Background(), nil, func(kv *KV) {})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	db.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Subscribe returned %v after Close", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe did not return after Close")
+	}
+}
+
+// startSubscribe 在新协程中订阅prefix，反复写入哨兵key直到fn收到推送，确认订阅已经生效后返回Subscribe的结果通道
+func startSubscribe(t *testing.T, ctx context.Context, db Database, prefix []byte, fn func(kv *KV)) <-chan error {
+	sentinel := append(append([]byte{}, prefix...), "ready"...)
+	ready := make(chan struct{})
+	var once sync.Once
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Subscribe(ctx, prefix, func(kv *KV) {
+			if bytes.Equal(kv.Key, sentinel) {
+				once.Do(func() { close(ready) })
+				return
+			}
+			fn(kv)
+		})
+	}()
+	for {
+		if err := db.Set(sentinel, []byte{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ready:
+			return done
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func checkSubscribeOrder(t *testing.T, db Database) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *KV, 1000)
+	startSubscribe(t, ctx, db, []byte("order/"), func(kv *KV) { events <- kv })
+
+	const writers, times = 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				if _, err := db.Increment([]byte("order/counter"), 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 推送顺序与提交顺序一致，因此收到的计数器值依次为1,2,3...
+	var lastSeq uint64
+	for i := int64(1); i <= writers*times; i++ {
+		select {
+		case kv := <-events:
+			if got := econvert.BytesToInt64(kv.Value); got != i {
+				t.Fatalf("event %d carries counter %d", i, got)
+			}
+			if kv.Seq <= lastSeq {
+				t.Fatalf("event %d has seq %d after %d", i, kv.Seq, lastSeq)
+			}
+			lastSeq = kv.Seq
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+	checkSubscribeOrder(t, db)
+
+	bdb, closeDb := openTempBadger(t)
+	defer closeDb()
+	checkSubscribeOrder(t, bdb)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+
+	release := make(chan struct{})
+	done := startSubscribe(t, context.Background(), db, []byte("slow/"), func(kv *KV) { <-release })
+
+	// 订阅者卡住时写入不会被阻塞
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriberBuffer+10; i++ {
+			_ = db.Set([]byte(fmt.Sprintf("slow/%d", i)), []byte{})
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by a slow subscriber")
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != ErrSlowSubscriber {
+			t.Fatalf("Subscribe returned %v, want ErrSlowSubscriber", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber was not disconnected")
+	}
+}
+
+func TestSubscriberWritesOwnPrefix(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+
+	// 回调中写入自己订阅的前缀，链式触发远超队列长度的变更，不应死锁
+	const total = subscriberBuffer * 2
+	finished := make(chan struct{})
+	startSubscribe(t, context.Background(), db, []byte("loop/"), func(kv *KV) {
+		n, _ := strconv.Atoi(string(kv.Key[len("loop/"):]))
+		if n == total {
+			close(finished)
+			return
+		}
+		if err := db.Set([]byte(fmt.Sprintf("loop/%d", n+1)), []byte{}); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := db.Set([]byte("loop/0"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber writing its own prefix deadlocked")
+	}
+}
+
+func checkSubscribeBulk(t *testing.T, db Database) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *KV, 10)
+	startSubscribe(t, ctx, db, []byte("user/"), func(kv *KV) { events <- kv })
+
+	_ = db.DropPrefix([]byte("other/"))
+	_ = db.DropPrefix([]byte("user/old/"))
+	_ = db.DropPrefix(nil)
+
+	for _, want := range []string{"user/old/", ""} {
+		select {
+		case kv := <-events:
+			if !kv.Bulk || string(kv.Key) != want {
+				t.Fatalf("got event %q bulk=%v, want bulk %q", kv.Key, kv.Bulk, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("bulk event for %q not received", want)
+		}
+	}
+}
+
+func TestSubscribeBulk(t *testing.T) {
+	db, _ := OpenDatabase("memory", "")
+	defer db.Close()
+	checkSubscribeBulk(t, db)
+	checkSubscribeBulk(t, db.Namespace("ns"))
+
+	bdb, closeDb := openTempBadger(t)
+	defer closeDb()
+	checkSubscribeBulk(t, bdb)
+}
+
+func TestSubscribeWriteInsideUpdate(t *testing.T) {
+	db, closeDb := openTempBadger(t)
+	defer closeDb()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *KV, 10)
+	startSubscribe(t, ctx, db, []byte("txn/"), func(kv *KV) { events <- kv })
+
+	// 有订阅者时，Update的回调中写入同一个数据库不会死锁
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Update(func(txn Txn) error {
+			if err := db.Set([]byte("txn/inner"), []byte("1")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("txn/outer"), []byte("2"))
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write inside Update deadlocked")
+	}
+
+	for _, want := range []string{"txn/inner", "txn/outer"} {
+		select {
+		case kv := <-events:
+			if string(kv.Key) != want {
+				t.Fatalf("got event %s, want %s", kv.Key, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event for %s not received", want)
+		}
+	}
+}
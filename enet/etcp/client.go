@@ -0,0 +1,265 @@
+package etcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrConnClosed 连接已经关闭
+var ErrConnClosed = errors.New("connection closed")
+
+// Client TCP客户端。与服务端的Connection使用相同的读写goroutine和封包格式，
+// 既可以用Send单向发送消息，也可以用Call发送请求并等待服务端Reply的响应
+type Client struct {
+
+	// Opts 参数配置，不使用其中服务端的Host、TcpPort、Name、Version与MaxConn
+	Opts *Option
+
+	// MsgHandler 服务端主动推送的消息(不是Call的响应)交给这里注册的路由处理
+	MsgHandler IMsgHandler
+
+	// conn 与服务端的连接
+	conn *Connection
+
+	// pending 等待响应的请求，请求ID -> 接收响应的通道
+	pending       map[uint32]chan IMessage
+	nextRequestId uint32
+	closed        bool
+	pendingLock   sync.Mutex
+	closeOnce     sync.Once
+
+	// callErr 封包格式不传输RequestId时Call返回的错误
+	callErr error
+
+	//连接建立时Hook函数
+	OnConnStart func(conn IConnection)
+	//连接断开时的Hook函数
+	OnConnStop func(conn IConnection)
+	//连接因不活跃而关闭时的Hook函数，之后还会调用OnConnStop
+	OnConnIdle func(conn IConnection)
+}
+
+// NewClient 新建一个客户端，注册好路由和Hook函数后调用Dial连接服务端
+func NewClient(opts *Option) *Client {
+	if opts == nil {
+		opts = DefaultOption()
+	}
+	return &Client{
+		Opts:       opts,
+		MsgHandler: NewMsgHandler(int(opts.WorkerPoolSize)),
+		pending:    make(map[uint32]chan IMessage),
+	}
+}
+
+// Dial 连接服务端并启动读写goroutine
+func (c *Client) Dial(addr string) error {
+	if c.conn != nil {
+		return errors.New("client already connected")
+	}
+
+	dp := c.Opts.NewDataPack()
+	if err := checkCompression(c.Opts, dp); err != nil {
+		return err
+	}
+	c.callErr = checkRequestId(dp)
+
+	raddr, err := net.ResolveTCPAddr(c.Opts.IPVersion, addr)
+	if err != nil {
+		return err
+	}
+	tcpConn, err := net.DialTCP(c.Opts.IPVersion, nil, raddr)
+	if err != nil {
+		return err
+	}
+	var conn net.Conn = tcpConn
+	if c.Opts.TLSConfig != nil {
+		config := c.Opts.TLSConfig.Clone()
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			}
+		}
+		tlsConn := tls.Client(tcpConn, config)
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			tcpConn.Close()
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	if c.Opts.WorkerPoolSize > 0 {
+		c.MsgHandler.StartWorkerPool()
+	}
+	c.conn = newConnection(c, conn, 0, c.MsgHandler)
+	c.conn.onResponse = c.deliver
+	c.conn.Start()
+	return nil
+}
+
+// Conn 获取与服务端的连接，Dial之前为nil
+func (c *Client) Conn() IConnection {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn
+}
+
+// Send 单向发送消息，不等待响应
+func (c *Client) Send(msgId uint32, data []byte) error {
+	if c.conn == nil {
+		return errors.New("client not connected")
+	}
+	return c.conn.SendMsg(msgId, data)
+}
+
+// Call 发送请求并等待服务端的响应，直到ctx结束或连接断开。
+// 服务端处理出错时返回*RemoteError。需要两端使用能传输RequestId的封包格式，默认格式下返回错误
+func (c *Client) Call(ctx context.Context, msgId uint32, data []byte) (IMessage, error) {
+	if c.conn == nil {
+		return nil, errors.New("client not connected")
+	}
+	if c.callErr != nil {
+		return nil, c.callErr
+	}
+
+	ch := make(chan IMessage, 1)
+	c.pendingLock.Lock()
+	if c.closed {
+		c.pendingLock.Unlock()
+		return nil, ErrConnClosed
+	}
+	// 请求ID为0表示不需要响应，跳过0以及仍在等待中的ID
+	requestId := c.nextRequestId + 1
+	for _, ok := c.pending[requestId]; requestId == 0 || ok; _, ok = c.pending[requestId] {
+		requestId++
+	}
+	c.nextRequestId = requestId
+	c.pending[requestId] = ch
+	c.pendingLock.Unlock()
+
+	msg := NewMessage(msgId, data)
+	msg.SetRequestId(requestId)
+	if err := c.conn.sendMessage(msg, false); err != nil {
+		c.removePending(requestId)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrConnClosed
+		}
+		if resp.GetMsgId() == ErrorMsgId {
+			return nil, &RemoteError{Message: string(resp.GetData())}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.removePending(requestId)
+		return nil, ctx.Err()
+	}
+}
+
+// deliver 把响应交给等待它的Call，没有对应的请求时返回false
+func (c *Client) deliver(msg IMessage) bool {
+	c.pendingLock.Lock()
+	ch, ok := c.pending[msg.GetRequestId()]
+	delete(c.pending, msg.GetRequestId())
+	c.pendingLock.Unlock()
+
+	if ok {
+		ch <- msg
+	}
+	return ok
+}
+
+func (c *Client) removePending(requestId uint32) {
+	c.pendingLock.Lock()
+	delete(c.pending, requestId)
+	c.pendingLock.Unlock()
+}
+
+// Close 断开与服务端的连接，等待中的Call返回ErrConnClosed。
+// 已经收到的推送消息在后台处理完后worker退出
+func (c *Client) Close() {
+	if c.conn == nil {
+		return
+	}
+	c.closeOnce.Do(func() {
+		c.conn.Stop()
+		// 路由中也可能调用Close，所以不在这里等待worker
+		go func() {
+			<-c.conn.readerDone
+			c.MsgHandler.StopWorkerPool(context.Background())
+		}()
+	})
+}
+
+// AddRouter 为服务端推送的消息注册路由
+func (c *Client) AddRouter(msgId uint32, router IRouter) {
+	c.MsgHandler.AddRouter(msgId, router)
+}
+
+// SetOnError 设置处理服务端推送的消息出错时的Hook函数
+func (c *Client) SetOnError(hookFunc func(request IRequest, err error)) {
+	c.MsgHandler.SetOnError(hookFunc)
+}
+
+// Option 获取配置的拷贝
+func (c *Client) Option() Option {
+	return *(c.Opts)
+}
+
+// GetConnMgr 客户端没有连接管理
+func (c *Client) GetConnMgr() IConnManager {
+	return nil
+}
+
+//设置连接建立时Hook函数
+func (c *Client) SetOnConnStart(hookFunc func(IConnection)) {
+	c.OnConnStart = hookFunc
+}
+
+//设置连接断开时的Hook函数
+func (c *Client) SetOnConnStop(hookFunc func(IConnection)) {
+	c.OnConnStop = hookFunc
+}
+
+//调用连接OnConnStart Hook函数
+func (c *Client) CallOnConnStart(conn IConnection) {
+	if c.OnConnStart != nil {
+		c.OnConnStart(conn)
+	}
+}
+
+// CallOnConnStop 连接断开时让等待中的Call全部返回，再调用OnConnStop Hook函数
+func (c *Client) CallOnConnStop(conn IConnection) {
+	c.pendingLock.Lock()
+	c.closed = true
+	for requestId, ch := range c.pending {
+		close(ch)
+		delete(c.pending, requestId)
+	}
+	c.pendingLock.Unlock()
+
+	if c.OnConnStop != nil {
+		c.OnConnStop(conn)
+	}
+}
+
+//设置连接因不活跃而关闭时的Hook函数
+func (c *Client) SetOnConnIdle(hookFunc func(IConnection)) {
+	c.OnConnIdle = hookFunc
+}
+
+//调用连接OnConnIdle Hook函数
+func (c *Client) CallOnConnIdle(conn IConnection) {
+	if c.OnConnIdle != nil {
+		c.OnConnIdle(conn)
+	}
+}
@@ -0,0 +1,185 @@
+package etcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freePort 找一个空闲的本地端口
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestServer 在空闲端口上启动服务器，setup用于注册路由，返回服务器与其地址
+func startTestServer(t *testing.T, setup func(s IServer)) (IServer, string) {
+	return startTestServerWithOption(t, callOption(), setup)
+}
+
+// callOption 测试使用的配置，封包格式能传输RequestId，可以使用Call
+func callOption() *Option {
+	return DefaultOption().SetDataPack(NewVersionedDataPack)
+}
+
+// startTestServerWithOption 使用opts在空闲端口上启动服务器
+func startTestServerWithOption(t *testing.T, opts *Option, setup func(s IServer)) (IServer, string) {
+	port := freePort(t)
+	s := NewServer(opts.SetHost("127.0.0.1").SetPort(port))
+	if setup != nil {
+		setup(s)
+	}
+	s.Start()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp4", addr)
+		if err == nil {
+			conn.Close()
+			return s, addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// funcRouter 用函数实现Handle的路由
+type funcRouter struct {
+	BaseRouter
+	handle func(r IRequest)
+}
+
+func (fr *funcRouter) Handle(r IRequest) {
+	fr.handle(r)
+}
+
+func TestClientCall(t *testing.T) {
+	pushed := make(chan []byte, 1)
+	_, addr := startTestServer(t, func(s IServer) {
+		// 1: 回显请求的大写形式
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			r.Reply(bytes.ToUpper(r.GetData()))
+		}})
+		// 2: 不回复请求，而是推送一条普通消息
+		s.AddRouter(2, &funcRouter{handle: func(r IRequest) {
+			r.GetConn().SendMsg(3, r.GetData())
+		}})
+		// 4: 永不回复
+		s.AddRouter(4, &funcRouter{handle: func(r IRequest) {}})
+	})
+
+	c := NewClient(callOption())
+	c.AddRouter(3, &funcRouter{handle: func(r IRequest) {
+		pushed <- r.GetData()
+	}})
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 并发的Call各自收到自己的响应
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			data := fmt.Sprintf("hello-%d", i)
+			resp, err := c.Call(ctx, 1, []byte(data))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if want := bytes.ToUpper([]byte(data)); !bytes.Equal(resp.GetData(), want) || resp.GetMsgId() != 1 {
+				t.Errorf("Call(%s) = %d %q, want %q", data, resp.GetMsgId(), resp.GetData(), want)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 服务端推送的消息交给客户端的路由
+	if err := c.Send(2, []byte("push")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-pushed:
+		if string(data) != "push" {
+			t.Fatalf("pushed %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pushed message not received")
+	}
+
+	// 没有响应时Call随ctx超时返回
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Call(ctx, 4, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Call without reply got %v", err)
+	}
+}
+
+func TestClientCloseFailsPendingCalls(t *testing.T) {
+	_, addr := startTestServer(t, func(s IServer) {
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {}})
+	})
+	c := NewClient(callOption())
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), 1, nil)
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-errCh:
+		if err != ErrConnClosed {
+			t.Fatalf("pending Call got %v, want ErrConnClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending Call not released by Close")
+	}
+	if _, err := c.Call(context.Background(), 1, nil); err == nil {
+		t.Fatal("Call after Close should fail")
+	}
+}
+
+// 默认格式保持旧版本的8字节包头，不传输RequestId
+func TestDataPackLegacyHeader(t *testing.T) {
+	dp := NewDataPack(4096)
+	if dp.GetHeadLen() != 8 {
+		t.Fatalf("default head length = %d, want 8", dp.GetHeadLen())
+	}
+	msg := NewMessage(7, []byte("data"))
+	msg.SetRequestId(42)
+	packed, err := dp.Pack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := dp.Unpack(packed[:dp.GetHeadLen()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.GetMsgId() != 7 || head.GetRequestId() != 0 || head.GetDataLen() != 4 {
+		t.Fatalf("unpacked head = %+v", head)
+	}
+	if string(packed[dp.GetHeadLen():]) != "data" {
+		t.Fatalf("unpacked data = %q", packed[dp.GetHeadLen():])
+	}
+}
@@ -0,0 +1,310 @@
+package etcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// 内置的封包格式，都可以作为Option.DataPack使用：
+//
+//	NewLittleEndianDataPack 默认格式，小端的DataLen、Id定长包头，与旧版本的对端兼容
+//	NewBigEndianDataPack    大端的DataLen、Id定长包头
+//	NewVarintDataPack       varint编码的Id、RequestId与数据长度
+//	NewLineDataPack         以换行分隔的文本："<Id> <RequestId> <数据>\n"
+//	NewVersionedDataPack    带版本、标志位、请求ID与校验和的包头
+//
+// 定长包头的两种格式不传输RequestId，Client.Call需要两端都使用其余能传输RequestId的格式
+
+// errTooLarge 数据长度超过MaxPacketSize
+var errTooLarge = errors.New("too large msg data recieved")
+
+// checkSize 检查数据长度是否超过maxSize，maxSize为0表示不限制
+func checkSize(maxSize int, dataLen uint64) error {
+	if maxSize > 0 && dataLen > uint64(maxSize) {
+		return errTooLarge
+	}
+	return nil
+}
+
+// errRequestIdNotSupported 封包格式不传输RequestId，无法等待响应
+var errRequestIdNotSupported = errors.New("Call requires a data pack that carries request ids, such as NewVersionedDataPack")
+
+// checkRequestId 检查封包格式能否传输RequestId
+func checkRequestId(dp IDataPack) error {
+	probe := NewMessage(0, nil)
+	probe.SetRequestId(1)
+	packet, err := dp.Pack(probe)
+	if err != nil {
+		return err
+	}
+	got, err := readMessage(dp, bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return err
+	}
+	if got.GetRequestId() != 1 {
+		return errRequestIdNotSupported
+	}
+	return nil
+}
+
+// unpackStream 用ReadMessage从一个完整的数据包中拆出消息
+func unpackStream(dp IStreamDataPack, packet []byte) (IMessage, error) {
+	return dp.ReadMessage(bufio.NewReader(bytes.NewReader(packet)))
+}
+
+// readMessage 从r中读取一个完整的消息，包头不定长的封包格式交给其ReadMessage
+func readMessage(dp IDataPack, r *bufio.Reader) (IMessage, error) {
+	if sdp, ok := dp.(IStreamDataPack); ok {
+		return sdp.ReadMessage(r)
+	}
+
+	// 读取Msg Head，拆包得到msgid 和 datalen 放在msg中
+	headData := make([]byte, dp.GetHeadLen())
+	if _, err := io.ReadFull(r, headData); err != nil {
+		return nil, err
+	}
+	msg, err := dp.Unpack(headData)
+	if err != nil {
+		return nil, err
+	}
+
+	//根据 dataLen 读取 data，放在msg.Data中
+	var data []byte
+	if msg.GetDataLen() > 0 {
+		data = make([]byte, msg.GetDataLen())
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+	}
+	msg.SetData(data)
+	return msg, nil
+}
+
+// NewLittleEndianDataPack 默认的封包格式，不传输RequestId
+func NewLittleEndianDataPack(maxPacketSize int) IDataPack {
+	return NewDataPack(maxPacketSize)
+}
+
+// NewBigEndianDataPack 与默认格式相同的包头，但使用大端字节序
+func NewBigEndianDataPack(maxPacketSize int) IDataPack {
+	return &DataPack{MaxSize: maxPacketSize, Order: binary.BigEndian}
+}
+
+// VarintDataPack varint编码的Id、RequestId与数据长度，后接数据。小消息的包头只有3个字节
+type VarintDataPack struct {
+	MaxSize int
+}
+
+// NewVarintDataPack 新建varint封包格式
+func NewVarintDataPack(maxPacketSize int) IDataPack {
+	return &VarintDataPack{MaxSize: maxPacketSize}
+}
+
+func (dp *VarintDataPack) MaxPacketSize() int {
+	return dp.MaxSize
+}
+
+// GetHeadLen 包头不定长，返回0
+func (dp *VarintDataPack) GetHeadLen() uint32 {
+	return 0
+}
+
+// Pack 封包方法
+func (dp *VarintDataPack) Pack(msg IMessage) ([]byte, error) {
+	packet := make([]byte, 3*binary.MaxVarintLen32+len(msg.GetData()))
+	n := binary.PutUvarint(packet, uint64(msg.GetMsgId()))
+	n += binary.PutUvarint(packet[n:], uint64(msg.GetRequestId()))
+	n += binary.PutUvarint(packet[n:], uint64(len(msg.GetData())))
+	n += copy(packet[n:], msg.GetData())
+	return packet[:n], nil
+}
+
+// Unpack 从一个完整的数据包中拆出消息
+func (dp *VarintDataPack) Unpack(packet []byte) (IMessage, error) {
+	return unpackStream(dp, packet)
+}
+
+// ReadMessage 从r中读取一个完整的消息
+func (dp *VarintDataPack) ReadMessage(r *bufio.Reader) (IMessage, error) {
+	var fields [3]uint32
+	for i := range fields {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v > 0xFFFFFFFF {
+			return nil, errors.New("varint field overflows uint32")
+		}
+		fields[i] = uint32(v)
+	}
+	if err := checkSize(dp.MaxSize, uint64(fields[2])); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, fields[2])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	msg := NewMessage(fields[0], data)
+	msg.SetRequestId(fields[1])
+	return msg, nil
+}
+
+// LineDataPack 以换行分隔的文本格式，每行为"<Id> <RequestId> <数据>"，数字为十进制。
+// 数据中不能包含换行，适合调试或与文本协议对接
+type LineDataPack struct {
+	MaxSize int
+}
+
+// NewLineDataPack 新建换行分隔的封包格式
+func NewLineDataPack(maxPacketSize int) IDataPack {
+	return &LineDataPack{MaxSize: maxPacketSize}
+}
+
+func (dp *LineDataPack) MaxPacketSize() int {
+	return dp.MaxSize
+}
+
+// GetHeadLen 包头不定长，返回0
+func (dp *LineDataPack) GetHeadLen() uint32 {
+	return 0
+}
+
+// Pack 封包方法，数据中有换行时返回错误
+func (dp *LineDataPack) Pack(msg IMessage) ([]byte, error) {
+	if bytes.IndexByte(msg.GetData(), '\n') >= 0 {
+		return nil, errors.New("line data pack: data contains newline")
+	}
+	packet := make([]byte, 0, 22+len(msg.GetData()))
+	packet = strconv.AppendUint(packet, uint64(msg.GetMsgId()), 10)
+	packet = append(packet, ' ')
+	packet = strconv.AppendUint(packet, uint64(msg.GetRequestId()), 10)
+	packet = append(packet, ' ')
+	packet = append(packet, msg.GetData()...)
+	return append(packet, '\n'), nil
+}
+
+// Unpack 从一个完整的数据包中拆出消息
+func (dp *LineDataPack) Unpack(packet []byte) (IMessage, error) {
+	return unpackStream(dp, packet)
+}
+
+// ReadMessage 从r中读取一行消息
+func (dp *LineDataPack) ReadMessage(r *bufio.Reader) (IMessage, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		// 两个十进制的uint32与两个空格最多22个字符，之外的部分才是数据
+		if dp.MaxSize > 0 && len(line) > dp.MaxSize+22 {
+			return nil, errTooLarge
+		}
+		if !isPrefix {
+			break
+		}
+	}
+
+	fields := bytes.SplitN(line, []byte{' '}, 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("line data pack: malformed line %q", line)
+	}
+	msgId, err := strconv.ParseUint(string(fields[0]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("line data pack: bad msg id: %w", err)
+	}
+	requestId, err := strconv.ParseUint(string(fields[1]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("line data pack: bad request id: %w", err)
+	}
+	if err = checkSize(dp.MaxSize, uint64(len(fields[2]))); err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(uint32(msgId), fields[2])
+	msg.SetRequestId(uint32(requestId))
+	return msg, nil
+}
+
+// VersionedDataPackVersion VersionedDataPack当前的版本号
+const VersionedDataPackVersion = 1
+
+// versionedHeadLen Version(1) + Flags(1) + Id(4) + RequestId(4) + DataLen(4) + Checksum(4)
+const versionedHeadLen = 18
+
+// crcTable 校验和使用的CRC-32C表
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// VersionedDataPack 带版本号的大端定长包头，包括消息的标志位、请求ID与数据的CRC-32C校验和。
+// 版本号不一致或校验和错误时拆包失败
+type VersionedDataPack struct {
+	MaxSize int
+}
+
+// NewVersionedDataPack 新建带版本与校验和的封包格式
+func NewVersionedDataPack(maxPacketSize int) IDataPack {
+	return &VersionedDataPack{MaxSize: maxPacketSize}
+}
+
+func (dp *VersionedDataPack) MaxPacketSize() int {
+	return dp.MaxSize
+}
+
+// GetHeadLen 获取包头长度
+func (dp *VersionedDataPack) GetHeadLen() uint32 {
+	return versionedHeadLen
+}
+
+// Pack 封包方法
+func (dp *VersionedDataPack) Pack(msg IMessage) ([]byte, error) {
+	data := msg.GetData()
+	packet := make([]byte, versionedHeadLen, versionedHeadLen+len(data))
+	packet[0] = VersionedDataPackVersion
+	packet[1] = msg.GetFlags()
+	binary.BigEndian.PutUint32(packet[2:], msg.GetMsgId())
+	binary.BigEndian.PutUint32(packet[6:], msg.GetRequestId())
+	binary.BigEndian.PutUint32(packet[10:], uint32(len(data)))
+	binary.BigEndian.PutUint32(packet[14:], crc32.Checksum(data, crcTable))
+	return append(packet, data...), nil
+}
+
+// Unpack 从一个完整的数据包中拆出消息，并校验数据
+func (dp *VersionedDataPack) Unpack(packet []byte) (IMessage, error) {
+	return unpackStream(dp, packet)
+}
+
+// ReadMessage 从r中读取一个完整的消息，并校验数据
+func (dp *VersionedDataPack) ReadMessage(r *bufio.Reader) (IMessage, error) {
+	var head [versionedHeadLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != VersionedDataPackVersion {
+		return nil, fmt.Errorf("versioned data pack: unsupported version %d", head[0])
+	}
+	dataLen := binary.BigEndian.Uint32(head[10:])
+	if err := checkSize(dp.MaxSize, uint64(dataLen)); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(head[14:]) {
+		return nil, errors.New("versioned data pack: checksum mismatch")
+	}
+
+	msg := NewMessage(binary.BigEndian.Uint32(head[2:]), data)
+	msg.SetFlags(head[1])
+	msg.SetRequestId(binary.BigEndian.Uint32(head[6:]))
+	return msg, nil
+}
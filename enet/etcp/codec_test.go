@@ -0,0 +1,181 @@
+package etcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+var testDataPacks = map[string]func(maxPacketSize int) IDataPack{
+	"little-endian": NewLittleEndianDataPack,
+	"big-endian":    NewBigEndianDataPack,
+	"varint":        NewVarintDataPack,
+	"line":          NewLineDataPack,
+	"versioned":     NewVersionedDataPack,
+}
+
+func TestDataPackRoundTrip(t *testing.T) {
+	msgs := []*Message{
+		NewMessage(1, []byte("hello")),
+		NewMessage(0xFFFFFFFE, nil),
+		NewMessage(300, bytes.Repeat([]byte("x"), 1000)),
+		NewMessage(7, []byte("with spaces and\ttabs")),
+	}
+	msgs[1].SetRequestId(0xFFFFFFFF)
+	msgs[2].SetRequestId(128)
+
+	for name, factory := range testDataPacks {
+		dp := factory(4096)
+		// 定长包头的格式不传输RequestId
+		carriesRequestId := checkRequestId(dp) == nil
+
+		// 多个消息连续写入数据流后逐个读出
+		var stream bytes.Buffer
+		for _, msg := range msgs {
+			packet, err := dp.Pack(msg)
+			if err != nil {
+				t.Fatalf("%s: Pack: %v", name, err)
+			}
+			stream.Write(packet)
+		}
+		reader := bufio.NewReader(&stream)
+		for i, want := range msgs {
+			got, err := readMessage(dp, reader)
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", name, i, err)
+			}
+			wantRequestId := want.GetRequestId()
+			if !carriesRequestId {
+				wantRequestId = 0
+			}
+			if got.GetMsgId() != want.GetMsgId() || got.GetRequestId() != wantRequestId ||
+				!bytes.Equal(got.GetData(), want.GetData()) {
+				t.Fatalf("%s: message %d = %d/%d/%q, want %d/%d/%q", name, i,
+					got.GetMsgId(), got.GetRequestId(), got.GetData(),
+					want.GetMsgId(), want.GetRequestId(), want.GetData())
+			}
+		}
+		if _, err := readMessage(dp, reader); err != io.EOF {
+			t.Fatalf("%s: read after last message = %v, want EOF", name, err)
+		}
+
+		// 超过MaxPacketSize的消息拆包失败
+		packet, err := dp.Pack(NewMessage(1, bytes.Repeat([]byte("y"), 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readMessage(factory(10), bufio.NewReader(bytes.NewReader(packet))); err == nil {
+			t.Fatalf("%s: oversized message accepted", name)
+		}
+	}
+}
+
+func TestDataPackUnpackStream(t *testing.T) {
+	for _, factory := range []func(int) IDataPack{NewVarintDataPack, NewLineDataPack, NewVersionedDataPack} {
+		dp := factory(0)
+		msg := NewMessage(9, []byte("data"))
+		msg.SetRequestId(3)
+		packet, _ := dp.Pack(msg)
+		got, err := dp.Unpack(packet)
+		if err != nil || got.GetMsgId() != 9 || got.GetRequestId() != 3 || string(got.GetData()) != "data" {
+			t.Fatalf("%T Unpack = %v, %v", dp, got, err)
+		}
+	}
+}
+
+func TestBigEndianDataPack(t *testing.T) {
+	packet, _ := NewBigEndianDataPack(0).Pack(NewMessage(1, []byte("ab")))
+	if want := []byte{0, 0, 0, 2, 0, 0, 0, 1, 'a', 'b'}; !bytes.Equal(packet, want) {
+		t.Fatalf("big-endian packet = %v, want %v", packet, want)
+	}
+}
+
+func TestLineDataPack(t *testing.T) {
+	dp := NewLineDataPack(0)
+	if _, err := dp.Pack(NewMessage(1, []byte("two\nlines"))); err == nil {
+		t.Fatal("Pack of data with newline should fail")
+	}
+	msg, err := dp.Unpack([]byte("12 0 plain text\n"))
+	if err != nil || msg.GetMsgId() != 12 || string(msg.GetData()) != "plain text" {
+		t.Fatalf("Unpack = %v, %v", msg, err)
+	}
+	for _, line := range []string{"12\n", "x 0 data\n", "1 -1 data\n"} {
+		if _, err = dp.Unpack([]byte(line)); err == nil {
+			t.Fatalf("Unpack(%q) should fail", line)
+		}
+	}
+}
+
+func TestVersionedDataPack(t *testing.T) {
+	dp := NewVersionedDataPack(0)
+	msg := NewMessage(5, []byte("payload"))
+	msg.SetFlags(0x81)
+	packet, _ := dp.Pack(msg)
+	if len(packet) != int(dp.GetHeadLen())+len("payload") {
+		t.Fatalf("packet length %d", len(packet))
+	}
+	got, err := dp.Unpack(packet)
+	if err != nil || got.GetFlags() != 0x81 {
+		t.Fatalf("Unpack = %v, %v", got, err)
+	}
+
+	corrupted := append([]byte(nil), packet...)
+	corrupted[len(corrupted)-1] ^= 1
+	if _, err = dp.Unpack(corrupted); err == nil {
+		t.Fatal("corrupted data passed the checksum")
+	}
+	future := append([]byte(nil), packet...)
+	future[0] = VersionedDataPackVersion + 1
+	if _, err = dp.Unpack(future); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+}
+
+func TestServerDataPackOption(t *testing.T) {
+	for name, factory := range testDataPacks {
+		received := make(chan string, 1)
+		_, addr := startTestServerWithOption(t, DefaultOption().SetDataPack(factory), func(s IServer) {
+			s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+				r.Reply(bytes.ToUpper(r.GetData()))
+			}})
+			s.AddRouter(2, &funcRouter{handle: func(r IRequest) {
+				received <- string(r.GetData())
+			}})
+		})
+		c := NewClient(DefaultOption().SetDataPack(factory))
+		if err := c.Dial(addr); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Send(2, []byte("send")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case data := <-received:
+			if data != "send" {
+				t.Fatalf("%s: server received %q", name, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: message not received", name)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if checkRequestId(factory(0)) != nil {
+			// 不传输RequestId的格式不能等待响应
+			if _, err := c.Call(ctx, 1, []byte("codec")); err != errRequestIdNotSupported {
+				t.Fatalf("%s: Call = %v, want errRequestIdNotSupported", name, err)
+			}
+			cancel()
+			c.Close()
+			continue
+		}
+		resp, err := c.Call(ctx, 1, []byte("codec"))
+		cancel()
+		c.Close()
+		if err != nil || string(resp.GetData()) != "CODEC" {
+			t.Fatalf("%s: Call = %v, %v", name, resp, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package etcp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FlagCompressionMask 消息标志位中表示压缩算法的低3位，0表示没有压缩。
+// 接收方按照标志位中的算法解压，所以双方只需要都注册了该算法，不需要使用相同的配置
+const FlagCompressionMask uint8 = 0x07
+
+// 压缩算法的ID，写入消息标志位。3、4预留给snappy与zstd，通过RegisterCompressor注册
+const (
+	CompressionGzip    uint8 = 1
+	CompressionDeflate uint8 = 2
+	CompressionSnappy  uint8 = 3
+	CompressionZstd    uint8 = 4
+)
+
+// Compressor 消息压缩算法
+type Compressor interface {
+	// ID 算法的ID，取值1到7
+	ID() uint8
+	// Compress 压缩数据
+	Compress(data []byte) ([]byte, error)
+	// Decompress 解压数据，解压后超过maxSize(大于0时)返回错误
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	compressors    = make(map[uint8]Compressor)
+	compressorLock sync.RWMutex
+)
+
+func init() {
+	RegisterCompressor(GzipCompressor{})
+	RegisterCompressor(DeflateCompressor{})
+}
+
+// RegisterCompressor 注册压缩算法，接收方据此解压。相同ID的算法会被替换
+func RegisterCompressor(c Compressor) {
+	if c.ID() == 0 || c.ID() > FlagCompressionMask {
+		panic(fmt.Sprintf("compressor id %d out of range 1-%d", c.ID(), FlagCompressionMask))
+	}
+	compressorLock.Lock()
+	compressors[c.ID()] = c
+	compressorLock.Unlock()
+}
+
+// GetCompressor 获取注册的压缩算法
+func GetCompressor(id uint8) (Compressor, bool) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	c, ok := compressors[id]
+	return c, ok
+}
+
+// readLimited 读取r的全部数据，超过maxSize(大于0时)返回错误，避免解压炸弹
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize > 0 {
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSize(maxSize, uint64(len(data))); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GzipCompressor gzip压缩
+type GzipCompressor struct{}
+
+func (GzipCompressor) ID() uint8 { return CompressionGzip }
+
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// DeflateCompressor deflate压缩，没有gzip的文件头，开销更小
+type DeflateCompressor struct{}
+
+func (DeflateCompressor) ID() uint8 { return CompressionDeflate }
+
+func (DeflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (DeflateCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// compressMessage 按照配置压缩消息的数据，数据小于阈值或压缩后没有变小时不压缩
+func compressMessage(opts *Option, msg IMessage) error {
+	if opts.Compressor == nil || len(msg.GetData()) < opts.CompressThreshold {
+		return nil
+	}
+	compressed, err := opts.Compressor.Compress(msg.GetData())
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(msg.GetData()) {
+		return nil
+	}
+	msg.SetData(compressed)
+	msg.SetDataLen(uint32(len(compressed)))
+	msg.SetFlags(msg.GetFlags()&^FlagCompressionMask | opts.Compressor.ID())
+	return nil
+}
+
+// decompressMessage 按照标志位解压消息的数据，解压后的长度同样受maxSize限制
+func decompressMessage(msg IMessage, maxSize int) error {
+	id := msg.GetFlags() & FlagCompressionMask
+	if id == 0 {
+		return nil
+	}
+	c, ok := GetCompressor(id)
+	if !ok {
+		return fmt.Errorf("unknown compressor id %d", id)
+	}
+	data, err := c.Decompress(msg.GetData(), maxSize)
+	if err != nil {
+		return err
+	}
+	msg.SetData(data)
+	msg.SetDataLen(uint32(len(data)))
+	msg.SetFlags(msg.GetFlags() &^ FlagCompressionMask)
+	return nil
+}
+
+// errFlagsNotSupported 封包格式不传输标志位，无法压缩
+var errFlagsNotSupported = errors.New("compression requires a data pack that carries message flags, such as NewVersionedDataPack")
+
+// checkCompression 检查封包格式能否传输压缩标志位
+func checkCompression(opts *Option, dp IDataPack) error {
+	if opts.Compressor == nil {
+		return nil
+	}
+	probe := NewMessage(0, nil)
+	probe.SetFlags(FlagCompressionMask)
+	packet, err := dp.Pack(probe)
+	if err != nil {
+		return err
+	}
+	got, err := readMessage(dp, bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return err
+	}
+	if got.GetFlags() != FlagCompressionMask {
+		return errFlagsNotSupported
+	}
+	return nil
+}
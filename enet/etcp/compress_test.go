@@ -0,0 +1,126 @@
+package etcp
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompressors(t *testing.T) {
+	data := []byte(strings.Repeat(`{"name":"etcp","tags":["a","b"]},`, 200))
+	for _, id := range []uint8{CompressionGzip, CompressionDeflate} {
+		c, ok := GetCompressor(id)
+		if !ok {
+			t.Fatalf("compressor %d not registered", id)
+		}
+		compressed, err := c.Compress(data)
+		if err != nil || len(compressed) >= len(data) {
+			t.Fatalf("compressor %d: %d -> %d bytes, %v", id, len(data), len(compressed), err)
+		}
+		got, err := c.Decompress(compressed, len(data))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("compressor %d: round trip failed: %v", id, err)
+		}
+		// 解压后超过上限的数据被拒绝
+		if _, err = c.Decompress(compressed, len(data)-1); err == nil {
+			t.Fatalf("compressor %d: decompressed size limit not enforced", id)
+		}
+	}
+	if _, ok := GetCompressor(CompressionZstd); ok {
+		t.Fatal("zstd should only be available after RegisterCompressor")
+	}
+}
+
+func TestCompressMessage(t *testing.T) {
+	opts := DefaultOption().SetCompression(GzipCompressor{}, 100)
+
+	small := NewMessage(1, bytes.Repeat([]byte("a"), 99))
+	compressMessage(opts, small)
+	if small.GetFlags() != 0 || len(small.GetData()) != 99 {
+		t.Fatal("message below the threshold was compressed")
+	}
+
+	large := NewMessage(1, bytes.Repeat([]byte("a"), 1000))
+	large.SetFlags(0x80)
+	compressMessage(opts, large)
+	if large.GetFlags() != 0x80|CompressionGzip || int(large.GetDataLen()) != len(large.GetData()) || len(large.GetData()) >= 1000 {
+		t.Fatalf("large message: flags %#x, %d bytes", large.GetFlags(), len(large.GetData()))
+	}
+	if err := decompressMessage(large, 0); err != nil || large.GetFlags() != 0x80 || !bytes.Equal(large.GetData(), bytes.Repeat([]byte("a"), 1000)) {
+		t.Fatalf("decompressMessage: flags %#x, %v", large.GetFlags(), err)
+	}
+
+	unknown := NewMessage(1, []byte("x"))
+	unknown.SetFlags(CompressionZstd)
+	if err := decompressMessage(unknown, 0); err == nil {
+		t.Fatal("unknown compressor accepted")
+	}
+}
+
+func TestCompressionRequiresFlags(t *testing.T) {
+	c := NewClient(DefaultOption().SetCompression(GzipCompressor{}, 0))
+	if err := c.Dial("127.0.0.1:1"); err != errFlagsNotSupported {
+		t.Fatalf("Dial with default data pack = %v, want errFlagsNotSupported", err)
+	}
+}
+
+// countingDataPack 统计Pack输出的字节数
+func countingDataPack(counter *int64) func(int) IDataPack {
+	return func(maxPacketSize int) IDataPack {
+		return &countingPack{IStreamDataPack: NewVersionedDataPack(maxPacketSize).(IStreamDataPack), counter: counter}
+	}
+}
+
+type countingPack struct {
+	IStreamDataPack
+	counter *int64
+}
+
+func (cp *countingPack) Pack(msg IMessage) ([]byte, error) {
+	packet, err := cp.IStreamDataPack.Pack(msg)
+	atomic.AddInt64(cp.counter, int64(len(packet)))
+	return packet, err
+}
+
+func TestCompressedCall(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"id":1,"text":"hello world"},`, 100))
+	var serverSent, clientSent int64
+
+	// 两端使用不同的算法，接收方按照标志位解压
+	serverOpts := DefaultOption().SetDataPack(countingDataPack(&serverSent)).
+		SetCompression(GzipCompressor{}, 256).SetMaxPacketSize(len(payload))
+	_, addr := startTestServerWithOption(t, serverOpts, func(s IServer) {
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			r.Reply(r.GetData())
+		}})
+	})
+	clientOpts := DefaultOption().SetDataPack(countingDataPack(&clientSent)).
+		SetCompression(DeflateCompressor{}, 256).SetMaxPacketSize(len(payload))
+	c := NewClient(clientOpts)
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Call(ctx, 1, payload)
+	if err != nil || !bytes.Equal(resp.GetData(), payload) {
+		t.Fatalf("Call = %v", err)
+	}
+	if n := atomic.LoadInt64(&clientSent); n >= int64(len(payload)) {
+		t.Fatalf("client sent %d bytes for a %d byte payload", n, len(payload))
+	}
+	if n := atomic.LoadInt64(&serverSent); n >= int64(len(payload)) {
+		t.Fatalf("server sent %d bytes for a %d byte payload", n, len(payload))
+	}
+
+	// 压缩后很小但解压后超过MaxPacketSize的消息导致连接关闭
+	bomb := bytes.Repeat([]byte{0}, 100*len(payload))
+	if _, err = c.Call(ctx, 1, bomb); err != ErrConnClosed {
+		t.Fatalf("Call with oversized decompressed payload = %v, want ErrConnClosed", err)
+	}
+}
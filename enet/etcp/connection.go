@@ -1,31 +1,84 @@
 package etcp
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// stopFlushTimeout 停止连接时发送缓冲中消息的最长时间
+	stopFlushTimeout = 5 * time.Second
+	// handshakeTimeout TLS握手的最长时间
+	handshakeTimeout = 10 * time.Second
+)
+
+// endpoint 连接所属的一端，服务端为Server，客户端为Client
+type endpoint interface {
+	// Option 获取配置的拷贝
+	Option() Option
+	// GetConnMgr 获取连接管理，客户端没有连接管理，返回nil
+	GetConnMgr() IConnManager
+	// CallOnConnStart 调用连接OnConnStart Hook函数
+	CallOnConnStart(conn IConnection)
+	// CallOnConnStop 调用连接OnConnStop Hook函数
+	CallOnConnStop(conn IConnection)
+	// CallOnConnIdle 调用连接因不活跃而关闭时的Hook函数
+	CallOnConnIdle(conn IConnection)
+}
+
 // Connection TCP连接，iface.IConnection接口的实现
 type Connection struct {
 
-	// 当前链接隶属于哪个server
+	// 当前链接隶属于哪个server，客户端的连接为nil
 	TcpServer IServer
 
-	// Conn 当前连接的TCP套接字
-	Conn *net.TCPConn
+	// owner 连接所属的一端
+	owner endpoint
+
+	// onResponse 客户端用来截获Call的响应，返回true表示消息已被处理，不再交给路由
+	onResponse func(msg IMessage) bool
+
+	// Conn 当前连接的套接字，启用TLS时为*tls.Conn
+	Conn net.Conn
 
 	// ID 连接ID
 	ID uint32
 
 	// isClosed 当前连接状态
-	isClosed bool
+	isClosed  bool
+	started   bool
+	closeLock sync.Mutex
 
-	// ExitChan 告知当前连接退出的channel
+	// ExitChan 告知当前连接退出的channel，Stop时关闭
 	ExitChan chan bool
 
+	// draining 为1时读goroutine不再读取新的请求，退出时也不停止连接
+	draining int32
+	// 发送队列的统计
+	queueHighWater int64
+	sentCount      uint64
+	droppedCount   uint64
+
+	// lastActive 最近一次收发业务消息的时间(UnixNano)
+	lastActive int64
+	// idleClosed 为1表示连接已经因不活跃而关闭
+	idleClosed int32
+
+	// readerDone、writerDone 读写goroutine退出时关闭
+	readerDone chan struct{}
+	writerDone chan struct{}
+
+	// dp 封包格式
+	dp IDataPack
+
 	// MsgHandler 服务端注册的连接对应的消息管理模块（多路由）
 	MsgHandler IMsgHandler
 
@@ -43,21 +96,34 @@ type Connection struct {
 }
 
 // NewConnection 新建TCP连接对象
-func NewConnection(server IServer, conn *net.TCPConn, id uint32, msgHandler IMsgHandler) *Connection {
+func NewConnection(server IServer, conn net.Conn, id uint32, msgHandler IMsgHandler) *Connection {
+	c := newConnection(server, conn, id, msgHandler)
+	c.TcpServer = server
+	return c
+}
+
+// newConnection 新建属于owner的连接对象
+func newConnection(owner endpoint, conn net.Conn, id uint32, msgHandler IMsgHandler) *Connection {
+	opts := owner.Option()
 	c := &Connection{
-		TcpServer:server,
+		dp:       opts.NewDataPack(),
+		owner:    owner,
 		Conn:     conn,
 		ID:       id,
 		isClosed: false,
 		MsgHandler:msgHandler,
-		ExitChan: make(chan bool, 1), // 有缓冲通道
+		ExitChan: make(chan bool),
+		readerDone: make(chan struct{}),
+		writerDone: make(chan struct{}),
 		msgChan:make(chan []byte),		// 读写goroutine间的消息通道
-		msgBuffChan:make(chan []byte, server.Option().MaxWorkerTaskLen),
+		msgBuffChan:make(chan []byte, opts.sendQueueSize()),
 		property:     make(map[string]interface{}), //对链接属性map初始化
 	}
 
 	//将新创建的Conn添加到链接管理中
-	c.TcpServer.GetConnMgr().Add(c)   //将当前新创建的连接添加到ConnManager中
+	if connMgr := owner.GetConnMgr(); connMgr != nil {
+		connMgr.Add(c)   //将当前新创建的连接添加到ConnManager中
+	}
 
 	return c
 }
@@ -66,47 +132,123 @@ func NewConnection(server IServer, conn *net.TCPConn, id uint32, msgHandler IMsg
 func (c *Connection) Start() {
 	fmt.Printf("Conn start... conn ID = %d\n", c.ID)
 
+	// TLS连接先完成握手，OnConnStart中就可以获取对方的证书
+	if err := c.handshake(); err != nil {
+		fmt.Printf("Conn #%d TLS handshake error: %s\n", c.ID, err)
+		c.Stop()
+		return
+	}
+
+	c.closeLock.Lock()
+	if c.isClosed {
+		c.closeLock.Unlock()
+		return
+	}
+	c.started = true
+	c.closeLock.Unlock()
+
 	// 启动当前连接的读数据业务
 	go c.startReader()
 	// 启动当前连接的写数据goroutine
 	go c.startWriter()
+	// 启动心跳与不活跃检测
+	c.touch()
+	go c.startKeeper()
 
 	//按照用户传递进来的创建连接时需要处理的业务，执行钩子方法
-	c.TcpServer.CallOnConnStart(c)
+	c.owner.CallOnConnStart(c)
 }
 
-// Stop 停止连接，结束当前连接的工作
+// Stop 停止连接，结束当前连接的工作。缓冲中尚未发送的消息会在关闭socket前发送出去
 func (c *Connection) Stop() {
 	fmt.Printf("Conn #%d stop\n", c.ID)
 
 	// 如果当前连接已经关闭
+	c.closeLock.Lock()
 	if c.isClosed {
+		c.closeLock.Unlock()
 		return
 	}
 	c.isClosed = true
-
+	started := c.started
+	c.closeLock.Unlock()
 
 	//如果用户注册了该链接的关闭回调业务，那么在此刻应该显示调用
-	c.TcpServer.CallOnConnStop(c)
+	//没有启动(例如TLS握手失败)的连接没有调用过OnConnStart，也不调用OnConnStop
+	if started {
+		c.owner.CallOnConnStop(c)
+	}
+
+	// 通知写goroutine发送完缓冲中的消息后退出，对方不接收时最多等待stopFlushTimeout
+	c.Conn.SetWriteDeadline(time.Now().Add(stopFlushTimeout))
+	close(c.ExitChan)
+	if started {
+		<-c.writerDone
+	} else {
+		close(c.readerDone)
+	}
 
 	// 关闭socket
 	c.Conn.Close()
-	c.ExitChan <- true
 
 	// 将连接从链接管理器中删除
-	c.TcpServer.GetConnMgr().Remove(c)
+	if connMgr := c.owner.GetConnMgr(); connMgr != nil {
+		connMgr.Remove(c)
+	}
+}
 
-	// 回收资源
-	close(c.ExitChan)
-	close(c.msgBuffChan)
-	close(c.msgChan)
+// drain 让读goroutine不再读取新的请求并退出，但不停止连接，已经收到的请求仍可以回复。
+// 返回的通道在读goroutine退出后关闭
+func (c *Connection) drain() <-chan struct{} {
+	atomic.StoreInt32(&c.draining, 1)
+	// 让阻塞中的读取立即返回
+	c.Conn.SetReadDeadline(time.Now())
+	return c.readerDone
 }
 
-// GetTCPConn 获取当前连接绑定的socket
+func (c *Connection) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// GetTCPConn 获取当前连接绑定的socket，TLS连接为其下层的TCP套接字
 func (c *Connection) GetTCPConn() *net.TCPConn {
+	conn := c.Conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+// NetConn 获取当前连接，TLS连接为*tls.Conn
+func (c *Connection) NetConn() net.Conn {
 	return c.Conn
 }
 
+// PeerCertificate 获取对方的证书，不是TLS连接或对方没有提供证书时为nil
+func (c *Connection) PeerCertificate() *x509.Certificate {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// handshake TLS连接完成握手，其他连接什么也不做
+func (c *Connection) handshake() error {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
+
 // GetConnID 获取当前连接的ID
 func (c *Connection) GetConnID() uint32 {
 	return c.ID
@@ -119,79 +261,123 @@ func (c *Connection) RemoteAddr() net.Addr {
 
 // SendMsg 发送数据
 func (c *Connection) SendMsg(msgId uint32, data []byte) error {
+	return c.sendMessage(NewMessage(msgId, data), false)
+}
 
-	if c.isClosed {
-		return errors.New("connection closed when send msg")
-	}
+// SendBuffMsg 发送数据
+func (c *Connection) SendBuffMsg(msgId uint32, data []byte) error {
+	return c.sendMessage(NewMessage(msgId, data), true)
+}
 
-	// 将data封包
-	dp := NewDataPack(int(c.TcpServer.Option().MaxPacketSize))
-	msg, err := dp.Pack(NewMessage(msgId, data))
+// ReplyMsg 发送对请求requestId的响应
+func (c *Connection) ReplyMsg(requestId uint32, msgId uint32, data []byte) error {
+	msg := NewMessage(msgId, data)
+	msg.SetRequestId(requestId)
+	return c.sendMessage(msg, false)
+}
+
+// sendMessage 将msg封包后交给写goroutine，buffered为true时使用有缓冲通道。
+// 发送队列策略不是SendQueueBlock时，所有消息都不等待地放入发送队列
+func (c *Connection) sendMessage(msg IMessage, buffered bool) error {
+	data, err := c.pack(msg)
 	if err != nil {
-		fmt.Println("Pack error msg id = ", msgId)
-		return  errors.New("Pack error msg ")
+		return err
 	}
 
-	c.msgChan <- msg
-
-	return nil
+	if policy := c.owner.Option().SendQueuePolicy; policy != SendQueueBlock {
+		return c.enqueue(nil, data, policy)
+	}
+	if buffered {
+		return c.enqueue(context.Background(), data, SendQueueBlock)
+	}
+	select {
+	case c.msgChan <- data:
+		return nil
+	case <-c.ExitChan:
+		return ErrConnClosed
+	}
 }
 
-// SendBuffMsg 发送数据
-func (c *Connection) SendBuffMsg(msgId uint32, data []byte) error {
-
-	if c.isClosed {
-		return errors.New("connection closed when send msg")
+// pack 压缩并封包msg，连接已经关闭时返回ErrConnClosed
+func (c *Connection) pack(msg IMessage) ([]byte, error) {
+	select {
+	case <-c.ExitChan:
+		return nil, ErrConnClosed
+	default:
 	}
 
 	// 将data封包
-	dp := NewDataPack(int(c.TcpServer.Option().MaxPacketSize))
-	msg, err := dp.Pack(NewMessage(msgId, data))
-	if err != nil {
-		fmt.Println("Pack error msg id = ", msgId)
-		return  errors.New("Pack error msg ")
+	// 心跳消息很小，不压缩
+	if msg.GetMsgId() != HeartbeatMsgId {
+		opts := c.owner.Option()
+		if err := compressMessage(&opts, msg); err != nil {
+			return nil, err
+		}
 	}
 
-	c.msgBuffChan <- msg
+	data, err := c.dp.Pack(msg)
+	if err != nil {
+		return nil, fmt.Errorf("pack msg id = %d: %s", msg.GetMsgId(), err)
+	}
 
-	return nil
+	if msg.GetMsgId() != HeartbeatMsgId {
+		c.touch()
+	}
+	return data, nil
 }
 
 // startReader 启动连接的读数据，持续从客户端读取数据，并交给handleAPI处理
 func (c *Connection) startReader() {
 	fmt.Println("Reader goroutine is running...")
 	defer fmt.Printf("connID = %d; Reader exits, remote addr is %s\n", c.ID, c.RemoteAddr())
-	defer c.Stop()
+	defer func() {
+		// 优雅关闭时由Server在处理完请求后停止连接
+		if !c.isDraining() {
+			c.Stop()
+		}
+		close(c.readerDone)
+	}()
 
+	readTimeout := c.owner.Option().ReadTimeout
+	// 不定长包头的封包格式需要按字节读取
+	reader := bufio.NewReader(c.Conn)
 	for {
-
-		// 创建拆包对象
-		dp := NewDataPack(int(c.TcpServer.Option().MaxPacketSize))
-
-		// 读取客户端的Msg Head
-		headData := make([]byte, dp.GetHeadLen())
-		if _, err := io.ReadFull(c.GetTCPConn(), headData); err != nil {
-			fmt.Println("read msg head error ", err)
+		// 先设置读超时再检查是否在优雅关闭，避免覆盖drain设置的超时
+		if readTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		if c.isDraining() {
 			break
 		}
 
-		//拆包，得到msgid 和 datalen 放在msg中
-		msg , err := dp.Unpack(headData)
+		// 按照封包格式读取一个完整的消息
+		msg, err := readMessage(c.dp, reader)
 		if err != nil {
-			fmt.Println("unpack error ", err)
+			fmt.Println("read msg error ", err)
+			// 超过ReadTimeout没有收到任何消息，对方已经失联
+			if isTimeout(err) && !c.isDraining() {
+				c.closeIdle()
+			}
 			break
 		}
 
-		//根据 dataLen 读取 data，放在msg.Data中
-		var data []byte
-		if msg.GetDataLen() > 0 {
-			data = make([]byte, msg.GetDataLen())
-			if _, err := io.ReadFull(c.GetTCPConn(), data); err != nil {
-				fmt.Println("read msg data error ", err)
-				break
-			}
+		// 压缩的消息先解压，解压后的长度同样不能超过MaxPacketSize
+		if err = decompressMessage(msg, c.dp.MaxPacketSize()); err != nil {
+			logf("Conn #%d decompress msg error: %s", c.ID, err)
+			break
+		}
+
+		// 心跳消息不交给路由，也不算作活跃
+		if msg.GetMsgId() == HeartbeatMsgId {
+			c.handleHeartbeat(msg)
+			continue
+		}
+		c.touch()
+
+		// Call的响应直接交给等待它的调用方
+		if c.onResponse != nil && msg.GetRequestId() != 0 && c.onResponse(msg) {
+			continue
 		}
-		msg.SetData(data)
 
 		req := NewRequest(c, msg)
 
@@ -200,21 +386,16 @@ func (c *Connection) startReader() {
 		// 执行注册的路由方法
 		// go c.MsgHandler.DoMsgHandler(req)
 
-		// 如果工作池还有空闲worker则传给worker，否则从绑定好的消息和对应处理方法执行相应的handle方法
-		if c.TcpServer.Option().WorkerPoolSize > 0 {
-			//已经启动工作池机制，将消息交给Worker处理
-			c.MsgHandler.SendMsgToTaskQueue(req)
-		} else {
-			// 没有配置工作池机制或者worker已耗尽时则仍然按照原来的而做法单开goroutine去处理
-			//从绑定好的消息和对应的处理方法中执行对应的Handle方法
-			go c.MsgHandler.DoMsgHandler(req)
-		}
+		// 已经启动工作池机制时将消息交给Worker处理，
+		// 否则由MsgHandler按照原来的做法单开goroutine执行对应的Handle方法
+		c.MsgHandler.SendMsgToTaskQueue(req)
 	}
 }
 
 // startWriter 写消息goroutine，用户将数据发送给客户端
 func (c *Connection) startWriter() {
 	defer fmt.Println(c.RemoteAddr().String(), " conn writer exit.")
+	defer close(c.writerDone)
 
 	// 除非出错或者收到退出信号，否则一直循环
 	for {
@@ -222,36 +403,58 @@ func (c *Connection) startWriter() {
 		// 无缓冲数据通道的数据接收处理
 		case data := <-c.msgChan:
 			//有数据要写给客户端
-			if _, err := c.Conn.Write(data); err != nil {
+			if _, err := c.write(data); err != nil {
 				fmt.Println("Send Data error:, ", err, " Conn Writer exit")
+				// 关闭socket让读goroutine退出并停止连接
+				c.Conn.Close()
 				return
 			}
 		// 有缓冲数据通道的数据接收处理
-		case data, ok := <- c.msgBuffChan:
-			if ok {
-				//有数据要写给客户端
-				if _, err := c.Conn.Write(data); err != nil {
-					fmt.Println("Send Buff Data error:, ", err, " Conn Writer exit")
+		case data := <- c.msgBuffChan:
+			//有数据要写给客户端
+			if _, err := c.write(data); err != nil {
+				fmt.Println("Send Buff Data error:, ", err, " Conn Writer exit")
+				c.Conn.Close()
+				return
+			}
+		case <- c.ExitChan:
+			//conn已经关闭，把缓冲中剩余的消息发送完再退出
+			for {
+				select {
+				case data := <-c.msgBuffChan:
+					if _, err := c.Conn.Write(data); err != nil {
+						fmt.Println("Flush Buff Data error:, ", err, " Conn Writer exit")
+						return
+					}
+					atomic.AddUint64(&c.sentCount, 1)
+				default:
 					return
 				}
-			} else {
-				fmt.Println("msgBuffChan is closed")
-				break
 			}
-		case <- c.ExitChan:
-			//conn已经关闭
-			return
 		}
 	}
 }
 
 
+// write 在WriteTimeout内写出数据
+func (c *Connection) write(data []byte) (int, error) {
+	if timeout := c.owner.Option().WriteTimeout; timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := c.Conn.Write(data)
+	if err == nil {
+		atomic.AddUint64(&c.sentCount, 1)
+	}
+	return n, err
+}
+
 //设置链接属性
 func (c *Connection) SetProperty(key string, value interface{}) {
 	c.propertyLock.Lock()
 	defer c.propertyLock.Unlock()
 
 	c.property[key] = value
+	c.propertyChanged(key, value, true)
 }
 
 //获取链接属性
@@ -272,4 +475,12 @@ func (c *Connection) RemoveProperty(key string) {
 	defer c.propertyLock.Unlock()
 
 	delete(c.property, key)
+	c.propertyChanged(key, nil, false)
+}
+
+// propertyChanged 通知连接管理更新属性索引，调用时需持有属性锁
+func (c *Connection) propertyChanged(key string, value interface{}, ok bool) {
+	if observer, isObserver := c.owner.GetConnMgr().(propertyObserver); isObserver {
+		observer.propertyChanged(c, key, value, ok)
+	}
 }
\ No newline at end of file
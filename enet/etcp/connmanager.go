@@ -2,14 +2,25 @@ package etcp
 
 import (
 	"errors"
-	"fmt"
+	"reflect"
 	"sync"
 )
 
+// propertyObserver 关注连接属性变化的连接管理，用于维护属性索引
+type propertyObserver interface {
+	propertyChanged(conn IConnection, key string, value interface{}, ok bool)
+}
+
 // ConnManager 连接管理模块
 type ConnManager struct {
 	connections map[uint32]IConnection //管理的连接信息
 	connLock    sync.RWMutex                  //读写连接的读写锁
+
+	groups   map[string]map[uint32]IConnection // 分组名 -> 组内连接
+	memberOf map[uint32]map[string]struct{}    // 连接ID -> 所在的分组，移除连接时据此退出分组
+
+	indexes map[string]map[interface{}]map[uint32]IConnection // 建立了索引的属性名 -> 属性值 -> 连接
+	indexed map[uint32]map[string]interface{}                 // 连接ID -> 已加入索引的属性值
 }
 
 
@@ -17,6 +28,10 @@ type ConnManager struct {
 func NewConnManager() *ConnManager {
 	return &ConnManager{
 		connections:make(map[uint32]IConnection),
+		groups:      make(map[string]map[uint32]IConnection),
+		memberOf:    make(map[uint32]map[string]struct{}),
+		indexes:     make(map[string]map[interface{}]map[uint32]IConnection),
+		indexed:     make(map[uint32]map[string]interface{}),
 	}
 }
 
@@ -28,8 +43,6 @@ func (connMgr *ConnManager) Add(conn IConnection) {
 
 	//将conn连接添加到ConnMananger中
 	connMgr.connections[conn.GetConnID()] = conn
-
-	fmt.Println("connection add to ConnManager successfully: conn num = ", connMgr.Len())
 }
 
 //删除连接
@@ -39,9 +52,7 @@ func (connMgr *ConnManager) Remove(conn IConnection) {
 	defer connMgr.connLock.Unlock()
 
 	//删除连接信息
-	delete(connMgr.connections, conn.GetConnID())
-
-	fmt.Println("connection Remove ConnID=",conn.GetConnID(), " successfully: conn num = ", connMgr.Len())
+	connMgr.remove(conn.GetConnID())
 }
 
 //利用ConnID获取链接
@@ -59,23 +70,276 @@ func (connMgr *ConnManager) Get(connID uint32) (IConnection, error) {
 
 //获取当前连接
 func (connMgr *ConnManager) Len() int {
+	connMgr.connLock.RLock()
+	defer connMgr.connLock.RUnlock()
+
 	return len(connMgr.connections)
 }
 
+// list 获取当前全部连接的快照
+func (connMgr *ConnManager) list() []IConnection {
+	connMgr.connLock.RLock()
+	defer connMgr.connLock.RUnlock()
+
+	conns := make([]IConnection, 0, len(connMgr.connections))
+	for _, conn := range connMgr.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 //清除并停止所有连接
 func (connMgr *ConnManager) ClearConn() {
-	//保护共享资源Map 加写锁
+	//停止连接时会调用Remove，所以不能在持有锁时停止
+	conns := connMgr.list()
+	for _, conn := range conns {
+		conn.Stop()
+	}
+
+	//删除全部的连接信息
+	connMgr.connLock.Lock()
+	for _, conn := range conns {
+		connMgr.remove(conn.GetConnID())
+	}
+	connMgr.connLock.Unlock()
+}
+// remove 删除连接及其分组与属性索引，调用时需持有写锁
+func (connMgr *ConnManager) remove(connID uint32) {
+	delete(connMgr.connections, connID)
+
+	for group := range connMgr.memberOf[connID] {
+		connMgr.leave(group, connID)
+	}
+	delete(connMgr.memberOf, connID)
+
+	for key, value := range connMgr.indexed[connID] {
+		connMgr.unindex(key, value, connID)
+	}
+	delete(connMgr.indexed, connID)
+}
+
+// Range 依次对每个连接调用fn，fn返回false时停止。
+// 遍历的是调用时的快照，不持有锁，fn中可以发送消息或停止连接
+func (connMgr *ConnManager) Range(fn func(conn IConnection) bool) {
+	for _, conn := range connMgr.list() {
+		if !fn(conn) {
+			return
+		}
+	}
+}
+
+// Broadcast 向全部连接发送消息，返回成功放入发送队列的连接数。
+// 使用TrySend，发送队列已满的慢连接会被跳过，不会阻塞其它连接
+func (connMgr *ConnManager) Broadcast(msgId uint32, data []byte) int {
+	return sendAll(connMgr.list(), msgId, data)
+}
+
+// sendAll 不等待地向conns发送消息，返回成功的个数
+func sendAll(conns []IConnection, msgId uint32, data []byte) int {
+	sent := 0
+	for _, conn := range conns {
+		if conn.TrySend(msgId, data) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// Join 将连接加入分组，分组不存在时创建。连接被移除时自动退出所有分组
+func (connMgr *ConnManager) Join(group string, conn IConnection) error {
 	connMgr.connLock.Lock()
 	defer connMgr.connLock.Unlock()
 
-	//停止并删除全部的连接信息
-	for connID, conn := range connMgr.connections {
-		//停止
-		conn.Stop()
-		//删除
-		delete(connMgr.connections,connID)
+	connID := conn.GetConnID()
+	if connMgr.connections[connID] != conn {
+		return errors.New("connection not found")
+	}
+
+	members, ok := connMgr.groups[group]
+	if !ok {
+		members = make(map[uint32]IConnection)
+		connMgr.groups[group] = members
+	}
+	members[connID] = conn
+
+	groups, ok := connMgr.memberOf[connID]
+	if !ok {
+		groups = make(map[string]struct{})
+		connMgr.memberOf[connID] = groups
+	}
+	groups[group] = struct{}{}
+	return nil
+}
+
+// Leave 将连接移出分组，分组为空时删除
+func (connMgr *ConnManager) Leave(group string, conn IConnection) {
+	connMgr.connLock.Lock()
+	defer connMgr.connLock.Unlock()
+
+	connID := conn.GetConnID()
+	connMgr.leave(group, connID)
+	if groups, ok := connMgr.memberOf[connID]; ok {
+		delete(groups, group)
+		if len(groups) == 0 {
+			delete(connMgr.memberOf, connID)
+		}
+	}
+}
+
+// leave 将连接移出分组，调用时需持有写锁
+func (connMgr *ConnManager) leave(group string, connID uint32) {
+	if members, ok := connMgr.groups[group]; ok {
+		delete(members, connID)
+		if len(members) == 0 {
+			delete(connMgr.groups, group)
+		}
+	}
+}
+
+// GroupMembers 获取分组内的全部连接
+func (connMgr *ConnManager) GroupMembers(group string) []IConnection {
+	connMgr.connLock.RLock()
+	defer connMgr.connLock.RUnlock()
+
+	members := connMgr.groups[group]
+	conns := make([]IConnection, 0, len(members))
+	for _, conn := range members {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// SendToGroup 向分组内的全部连接发送消息，返回成功放入发送队列的连接数。与Broadcast一样跳过慢连接
+func (connMgr *ConnManager) SendToGroup(group string, msgId uint32, data []byte) int {
+	return sendAll(connMgr.GroupMembers(group), msgId, data)
+}
+
+// IndexProperty 为属性key建立索引，此后FindByProperty按照key查找时不再遍历全部连接。
+// 已有连接的属性会被加入索引，之后连接SetProperty/RemoveProperty时自动更新索引。
+// 只有可比较的属性值(能作为map的key)会被索引
+func (connMgr *ConnManager) IndexProperty(key string) {
+	connMgr.connLock.Lock()
+	if _, ok := connMgr.indexes[key]; ok {
+		connMgr.connLock.Unlock()
+		return
+	}
+	connMgr.indexes[key] = make(map[interface{}]map[uint32]IConnection)
+	connMgr.connLock.Unlock()
+
+	// 持有连接的属性锁读取属性值，避免与并发的SetProperty交错导致索引过期
+	for _, conn := range connMgr.list() {
+		if c, ok := conn.(*Connection); ok {
+			c.propertyLock.RLock()
+			value, ok := c.property[key]
+			connMgr.propertyChanged(c, key, value, ok)
+			c.propertyLock.RUnlock()
+		} else if value, err := conn.GetProperty(key); err == nil {
+			connMgr.propertyChanged(conn, key, value, true)
+		}
+	}
+}
+
+// FindByProperty 查找属性key的值等于value的连接，例如按照用户ID查找连接。
+// 属性建立了索引时直接查索引，否则遍历全部连接
+func (connMgr *ConnManager) FindByProperty(key string, value interface{}) []IConnection {
+	if !hashable(value) {
+		return nil
+	}
+
+	connMgr.connLock.RLock()
+	if index, ok := connMgr.indexes[key]; ok {
+		conns := make([]IConnection, 0, len(index[value]))
+		for _, conn := range index[value] {
+			conns = append(conns, conn)
+		}
+		connMgr.connLock.RUnlock()
+		return conns
+	}
+	connMgr.connLock.RUnlock()
+
+	var conns []IConnection
+	for _, conn := range connMgr.list() {
+		if v, err := conn.GetProperty(key); err == nil && hashable(v) && v == value {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// propertyChanged 连接的属性改变后更新索引，ok为false表示属性被移除。
+// 由Connection在持有属性锁时调用，保证同一连接的更新按顺序到达
+func (connMgr *ConnManager) propertyChanged(conn IConnection, key string, value interface{}, ok bool) {
+	connMgr.connLock.Lock()
+	defer connMgr.connLock.Unlock()
+
+	connID := conn.GetConnID()
+	index, indexed := connMgr.indexes[key]
+	if !indexed || connMgr.connections[connID] != conn {
+		return
 	}
 
+	if old, had := connMgr.indexed[connID][key]; had {
+		connMgr.unindex(key, old, connID)
+		delete(connMgr.indexed[connID], key)
+	}
+	if !ok || !hashable(value) {
+		if len(connMgr.indexed[connID]) == 0 {
+			delete(connMgr.indexed, connID)
+		}
+		return
+	}
 
-	fmt.Println("Clear All Connections successfully: conn num = ", connMgr.Len())
-}
\ No newline at end of file
+	conns, exist := index[value]
+	if !exist {
+		conns = make(map[uint32]IConnection)
+		index[value] = conns
+	}
+	conns[connID] = conn
+
+	values, exist := connMgr.indexed[connID]
+	if !exist {
+		values = make(map[string]interface{})
+		connMgr.indexed[connID] = values
+	}
+	values[key] = value
+}
+
+// unindex 从属性索引中删除连接，调用时需持有写锁
+func (connMgr *ConnManager) unindex(key string, value interface{}, connID uint32) {
+	index := connMgr.indexes[key]
+	if conns, ok := index[value]; ok {
+		delete(conns, connID)
+		if len(conns) == 0 {
+			delete(index, value)
+		}
+	}
+}
+
+// hashable 判断属性值能否作为map的key。类型可比较还不够，其中的接口字段保存了不可比较的值时比较同样会panic
+func hashable(value interface{}) bool {
+	return value == nil || valueComparable(reflect.ValueOf(value))
+}
+
+// valueComparable 判断v能否比较：类型可比较，且其中的接口保存的值同样能比较
+func valueComparable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		return v.IsNil() || valueComparable(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !valueComparable(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !valueComparable(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return v.Type().Comparable()
+	}
+}
@@ -0,0 +1,152 @@
+package etcp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitFor 等待cond成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestConnManagerGroups(t *testing.T) {
+	s, addr := startTestServer(t, func(s IServer) {
+		s.GetConnMgr().IndexProperty("uid")
+		// 1: 登录，记录用户ID与昵称
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			r.GetConn().SetProperty("uid", string(r.GetData()))
+			r.GetConn().SetProperty("nick", "user-"+string(r.GetData()))
+			r.Reply(nil)
+		}})
+		// 2: 加入房间
+		s.AddRouter(2, &funcRouter{handle: func(r IRequest) {
+			if err := s.GetConnMgr().Join(string(r.GetData()), r.GetConn()); err != nil {
+				t.Error(err)
+			}
+			r.Reply(nil)
+		}})
+	})
+	defer s.Stop()
+	connMgr := s.GetConnMgr()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	uids := []string{"a", "b", "c"}
+	received := make([]chan string, len(uids))
+	clients := make([]*Client, len(uids))
+	for i, uid := range uids {
+		ch := make(chan string, 4)
+		received[i] = ch
+		c := NewClient(callOption())
+		c.AddRouter(9, &funcRouter{handle: func(r IRequest) {
+			ch <- string(r.GetData())
+		}})
+		if err := c.Dial(addr); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+		if _, err := c.Call(ctx, 1, []byte(uid)); err != nil {
+			t.Fatal(err)
+		}
+		if uid != "c" {
+			if _, err := c.Call(ctx, 2, []byte("room")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 建立了索引的属性与没有索引的属性都能查找
+	for _, key := range []string{"uid", "nick"} {
+		value := map[string]string{"uid": "b", "nick": "user-b"}[key]
+		found := connMgr.FindByProperty(key, value)
+		if len(found) != 1 {
+			t.Fatalf("FindByProperty(%s) found %d connections", key, len(found))
+		}
+		if v, _ := found[0].GetProperty("uid"); v != "b" {
+			t.Fatalf("FindByProperty(%s) found uid %v", key, v)
+		}
+	}
+	connMgr.IndexProperty("nick")
+	if found := connMgr.FindByProperty("nick", "user-c"); len(found) != 1 {
+		t.Fatalf("FindByProperty after IndexProperty found %d connections", len(found))
+	}
+	if found := connMgr.FindByProperty("uid", []byte("b")); len(found) != 0 {
+		t.Fatal("non-comparable value matched")
+	}
+
+	// 类型可比较但接口字段中保存了不可比较的值，不能加入索引也不能panic
+	type wrapped struct{ v interface{} }
+	conn0 := connMgr.FindByProperty("uid", "a")[0]
+	conn0.SetProperty("nick", wrapped{[]byte("a")})
+	if found := connMgr.FindByProperty("nick", wrapped{[]byte("a")}); len(found) != 0 {
+		t.Fatal("value holding a non-comparable field matched")
+	}
+	if found := connMgr.FindByProperty("uid", wrapped{"a"}); len(found) != 0 {
+		t.Fatal("wrapped comparable value matched a plain string")
+	}
+
+	// 属性修改与移除后索引随之更新
+	conn := connMgr.FindByProperty("uid", "c")[0]
+	conn.SetProperty("uid", "d")
+	if len(connMgr.FindByProperty("uid", "c")) != 0 || len(connMgr.FindByProperty("uid", "d")) != 1 {
+		t.Fatal("index not updated after SetProperty")
+	}
+	conn.RemoveProperty("uid")
+	if len(connMgr.FindByProperty("uid", "d")) != 0 {
+		t.Fatal("index not updated after RemoveProperty")
+	}
+
+	count := 0
+	connMgr.Range(func(IConnection) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Fatalf("Range did not stop, visited %d connections", count)
+	}
+
+	if n := connMgr.SendToGroup("room", 9, []byte("room")); n != 2 {
+		t.Fatalf("SendToGroup sent to %d connections", n)
+	}
+	if n := connMgr.Broadcast(9, []byte("all")); n != 3 {
+		t.Fatalf("Broadcast sent to %d connections", n)
+	}
+	want := [][]string{{"room", "all"}, {"room", "all"}, {"all"}}
+	for i := range clients {
+		for _, msg := range want[i] {
+			select {
+			case got := <-received[i]:
+				if got != msg {
+					t.Fatalf("client %s received %q, want %q", uids[i], got, msg)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("client %s did not receive %q", uids[i], msg)
+			}
+		}
+	}
+
+	// 连接断开后退出分组并从索引中删除
+	clients[0].Close()
+	waitFor(t, "connection removed", func() bool {
+		return len(connMgr.GroupMembers("room")) == 1 && len(connMgr.FindByProperty("uid", "a")) == 0
+	})
+
+	connMgr.Leave("room", connMgr.FindByProperty("uid", "b")[0])
+	if n := connMgr.SendToGroup("room", 9, nil); n != 0 {
+		t.Fatalf("SendToGroup on empty group sent to %d connections", n)
+	}
+}
+
+func TestConnManagerJoinUnmanaged(t *testing.T) {
+	c, _, _ := newPipeConnection(t, DefaultOption())
+	if err := NewConnManager().Join("room", c); err == nil {
+		t.Fatal("Join accepted a connection the manager does not own")
+	}
+}
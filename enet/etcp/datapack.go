@@ -3,13 +3,15 @@ package etcp
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 )
 
 // DataPack 封包拆包类实例，暂时不需要成员
 // TODO: 原作者此处使用了一个这样的面向对象方式，但Pack与Unpack其实完全可以在Message实现，所以我后面要修改此处，暂时跟着作者一样
 type DataPack struct {
 	MaxSize int
+
+	// Order 包头的字节序，nil表示小端
+	Order binary.ByteOrder
 }
 
 // NewDataPack 封包拆包实例初始化方法
@@ -21,6 +23,13 @@ func (dp *DataPack) MaxPacketSize() int {
 	return dp.MaxSize
 }
 
+func (dp *DataPack) order() binary.ByteOrder {
+	if dp.Order == nil {
+		return binary.LittleEndian
+	}
+	return dp.Order
+}
+
 // GetHeadLen 获取包头长度方法
 func (dp *DataPack) GetHeadLen() uint32 {
 	//Id uint32(4字节) +  DataLen uint32(4字节)
@@ -33,17 +42,17 @@ func (dp *DataPack) Pack(msg IMessage) ([]byte, error) {
 	dataBuff := bytes.NewBuffer([]byte{})
 
 	//写dataLen
-	if err := binary.Write(dataBuff, binary.LittleEndian, msg.GetDataLen()); err != nil {
+	if err := binary.Write(dataBuff, dp.order(), msg.GetDataLen()); err != nil {
 		return nil, err
 	}
 
 	//写msgID
-	if err := binary.Write(dataBuff, binary.LittleEndian, msg.GetMsgId()); err != nil {
+	if err := binary.Write(dataBuff, dp.order(), msg.GetMsgId()); err != nil {
 		return nil, err
 	}
 
 	//写data数据
-	if err := binary.Write(dataBuff, binary.LittleEndian, msg.GetData()); err != nil {
+	if err := binary.Write(dataBuff, dp.order(), msg.GetData()); err != nil {
 		return nil, err
 	}
 
@@ -59,18 +68,18 @@ func (dp *DataPack) Unpack(binaryData []byte) (IMessage, error) {
 	msg := &Message{}
 
 	//读dataLen
-	if err := binary.Read(dataBuff, binary.LittleEndian, &msg.DataLen); err != nil {
+	if err := binary.Read(dataBuff, dp.order(), &msg.DataLen); err != nil {
 		return nil, err
 	}
 
 	//读msgID
-	if err := binary.Read(dataBuff, binary.LittleEndian, &msg.Id); err != nil {
+	if err := binary.Read(dataBuff, dp.order(), &msg.Id); err != nil {
 		return nil, err
 	}
 
 	//判断dataLen的长度是否超出我们允许的最大包长度
-	if dp.MaxSize > 0 && int(msg.DataLen) > dp.MaxSize {
-		return nil, errors.New("too large msg data recieved")
+	if err := checkSize(dp.MaxSize, uint64(msg.DataLen)); err != nil {
+		return nil, err
 	}
 
 	//这里只需要把head的数据拆包出来就可以了，然后再通过head的长度，再从conn读取一次数据
@@ -0,0 +1,31 @@
+package etcp
+
+import "fmt"
+
+// ErrorMsgId 错误帧保留的消息ID，不能为它注册路由。
+// 处理请求出错时，以该消息ID和请求的请求ID回复错误信息，对方的Client.Call返回*RemoteError
+const ErrorMsgId uint32 = 0xFFFFFFFE
+
+// panicErrorMessage panic时回复给对方的错误信息，不暴露panic的内容
+const panicErrorMessage = "internal error"
+
+// PanicError 处理消息时发生的panic
+type PanicError struct {
+	// Value recover得到的值
+	Value interface{}
+	// Stack 发生panic时的调用栈
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// RemoteError 对方处理请求出错时回复的错误
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
@@ -0,0 +1,97 @@
+package etcp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// echoErrorRouter 数据为空时返回错误，否则回显
+type echoErrorRouter struct {
+	BaseRouter
+}
+
+func (er *echoErrorRouter) HandleError(r IRequest) error {
+	if len(r.GetData()) == 0 {
+		return errors.New("empty data")
+	}
+	return r.Reply(r.GetData())
+}
+
+func TestHandlerErrors(t *testing.T) {
+	// 工作池与单开goroutine两种处理方式
+	for _, poolSize := range []int{4, 0} {
+		type report struct {
+			msgId uint32
+			err   error
+		}
+		reports := make(chan report, 10)
+		opts := callOption().SetWorkerPoolSize(poolSize)
+		_, addr := startTestServerWithOption(t, opts, func(s IServer) {
+			s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+				panic("boom")
+			}})
+			s.AddRouter(2, ErrorHandlerFunc(func(r IRequest) error {
+				return errors.New("bad input")
+			}))
+			s.AddRouter(3, &echoErrorRouter{})
+			s.SetOnError(func(r IRequest, err error) {
+				reports <- report{r.GetMsgId(), err}
+			})
+		})
+
+		c := NewClient(callOption())
+		if err := c.Dial(addr); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		// panic被恢复，对方收到不含panic内容的错误帧
+		_, err := c.Call(ctx, 1, nil)
+		if re, ok := err.(*RemoteError); !ok || re.Message != panicErrorMessage {
+			t.Fatalf("pool %d: Call panicking handler = %v", poolSize, err)
+		}
+		rep := <-reports
+		if pe, ok := rep.err.(*PanicError); !ok || rep.msgId != 1 || pe.Value != "boom" || len(pe.Stack) == 0 {
+			t.Fatalf("pool %d: OnError got %d %#v", poolSize, rep.msgId, rep.err)
+		}
+
+		// 返回的错误原样回复
+		_, err = c.Call(ctx, 2, nil)
+		if re, ok := err.(*RemoteError); !ok || re.Message != "bad input" {
+			t.Fatalf("pool %d: Call error handler = %v", poolSize, err)
+		}
+		if rep = <-reports; rep.msgId != 2 || rep.err.Error() != "bad input" {
+			t.Fatalf("pool %d: OnError got %d %v", poolSize, rep.msgId, rep.err)
+		}
+
+		// 没有注册路由的请求同样回复错误帧
+		_, err = c.Call(ctx, 99, nil)
+		if re, ok := err.(*RemoteError); !ok || re.Message != "api msgId = 99 is not found" {
+			t.Fatalf("pool %d: Call unregistered msgId = %v", poolSize, err)
+		}
+		if rep = <-reports; rep.msgId != 99 {
+			t.Fatalf("pool %d: OnError got %d %v", poolSize, rep.msgId, rep.err)
+		}
+
+		// 不等待响应的消息panic时只交给OnError，服务器继续工作
+		if err = c.Send(1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if rep = <-reports; rep.msgId != 1 {
+			t.Fatalf("pool %d: OnError got %d %v", poolSize, rep.msgId, rep.err)
+		}
+		if _, err = c.Call(ctx, 3, nil); err == nil {
+			t.Fatalf("pool %d: IErrorRouter error not returned", poolSize)
+		}
+		<-reports
+		resp, err := c.Call(ctx, 3, []byte("ok"))
+		if err != nil || string(resp.GetData()) != "ok" {
+			t.Fatalf("pool %d: Call after panics = %v, %v", poolSize, resp, err)
+		}
+
+		cancel()
+		c.Close()
+	}
+}
@@ -0,0 +1,96 @@
+package etcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// HeartbeatMsgId 心跳消息保留的消息ID，不能为它注册路由。
+// 心跳消息由连接自己处理：收到ping回复pong，收到pong什么也不做
+const HeartbeatMsgId uint32 = 0xFFFFFFFF
+
+// 心跳消息的内容
+var (
+	heartbeatPing = []byte{0}
+	heartbeatPong = []byte{1}
+)
+
+// touch 记录最近一次收发业务消息的时间
+func (c *Connection) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idleFor 距离最近一次收发业务消息的时间
+func (c *Connection) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// handleHeartbeat 处理收到的心跳消息。在读goroutine中调用，pong不等待地放入发送队列，
+// 队列已满时丢弃：此时还有数据等着写出，对方不会因为少一个pong而认为连接已死
+func (c *Connection) handleHeartbeat(msg IMessage) {
+	if len(msg.GetData()) == 1 && msg.GetData()[0] == heartbeatPing[0] {
+		_ = c.TrySend(HeartbeatMsgId, heartbeatPong)
+	}
+}
+
+// startKeeper 按照HeartbeatInterval发送心跳，超过IdleTimeout没有业务消息时关闭连接
+func (c *Connection) startKeeper() {
+	opts := c.owner.Option()
+	if opts.HeartbeatInterval <= 0 && opts.IdleTimeout <= 0 {
+		return
+	}
+
+	var heartbeat, idle <-chan time.Time
+	if opts.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(opts.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var idleTimer *time.Timer
+	if opts.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-heartbeat:
+			// 与pong一样不等待，对方不读取时也能继续检查IdleTimeout
+			_ = c.TrySend(HeartbeatMsgId, heartbeatPing)
+		case <-idle:
+			remain := opts.IdleTimeout - c.idleFor()
+			if remain <= 0 {
+				logf("Conn #%d idle for %s, closing", c.ID, opts.IdleTimeout)
+				c.closeIdle()
+				return
+			}
+			idleTimer.Reset(remain)
+		case <-c.ExitChan:
+			return
+		}
+	}
+}
+
+// closeIdle 因为不活跃关闭连接，先调用OnConnIdle Hook函数
+func (c *Connection) closeIdle() {
+	if !atomic.CompareAndSwapInt32(&c.idleClosed, 0, 1) {
+		return
+	}
+	c.closeLock.Lock()
+	closed := c.isClosed
+	c.closeLock.Unlock()
+	if closed {
+		return
+	}
+
+	c.owner.CallOnConnIdle(c)
+	c.Stop()
+}
+
+// isTimeout 判断是否是读写超时的错误
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,173 @@
+package etcp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatKeepsConnectionAlive(t *testing.T) {
+	idle := make(chan IConnection, 1)
+	opts := callOption().SetReadTimeout(300 * time.Millisecond)
+	s, addr := startTestServerWithOption(t, opts, func(s IServer) {
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			r.Reply(r.GetData())
+		}})
+		s.SetOnConnIdle(func(conn IConnection) {
+			idle <- conn
+		})
+	})
+	defer s.Stop()
+
+	// 只有客户端发送心跳，服务端的回复也让客户端的读超时不会触发
+	c := NewClient(callOption().SetHeartbeatInterval(50 * time.Millisecond).SetReadTimeout(300 * time.Millisecond))
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case <-idle:
+		t.Fatal("connection with heartbeats closed as idle")
+	case <-time.After(time.Second):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if resp, err := c.Call(ctx, 1, []byte("alive")); err != nil || string(resp.GetData()) != "alive" {
+		t.Fatalf("Call after heartbeats = %v, %v", resp, err)
+	}
+}
+
+func TestReadTimeoutClosesDeadPeer(t *testing.T) {
+	// 按远程地址识别测试的连接，不受启动服务器时探测用的连接影响
+	idle := make(chan string, 4)
+	opts := callOption().SetReadTimeout(200 * time.Millisecond)
+	s, addr := startTestServerWithOption(t, opts, func(s IServer) {
+		s.SetOnConnIdle(func(conn IConnection) {
+			idle <- conn.RemoteAddr().String()
+		})
+	})
+	defer s.Stop()
+
+	// 连上之后什么也不发送的对方
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for found := false; !found; {
+		select {
+		case remote := <-idle:
+			found = remote == conn.LocalAddr().String()
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnConnIdle not called for a silent peer")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.GetConnMgr().Len() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections left after read timeout", s.GetConnMgr().Len())
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("silent peer not disconnected: %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	serverIdle := make(chan IConnection, 1)
+	opts := callOption().SetIdleTimeout(300 * time.Millisecond)
+	s, addr := startTestServerWithOption(t, opts, func(s IServer) {
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			r.Reply(nil)
+		}})
+		s.SetOnConnIdle(func(conn IConnection) {
+			serverIdle <- conn
+		})
+	})
+	defer s.Stop()
+
+	c := NewClient(callOption().SetHeartbeatInterval(50 * time.Millisecond))
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 业务消息让连接保持活跃
+	for i := 0; i < 6; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := c.Call(ctx, 1, nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("Call %d: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-serverIdle:
+		t.Fatal("active connection closed as idle")
+	default:
+	}
+
+	// 只有心跳时超过IdleTimeout关闭连接
+	select {
+	case <-serverIdle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnIdle not called for an idle connection")
+	}
+	if _, err := c.Call(context.Background(), 1, nil); err == nil {
+		t.Fatal("Call on idle-closed connection should fail")
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	s, addr := startTestServer(t, nil)
+	defer s.Stop()
+
+	clientIdle := make(chan IConnection, 1)
+	c := NewClient(callOption().SetIdleTimeout(200 * time.Millisecond))
+	c.SetOnConnIdle(func(conn IConnection) {
+		clientIdle <- conn
+	})
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case conn := <-clientIdle:
+		if conn != c.Conn() {
+			t.Fatal("OnConnIdle called with another connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client OnConnIdle not called")
+	}
+}
+
+func TestHeartbeatMsgIdReserved(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("AddRouter on HeartbeatMsgId should panic")
+		}
+	}()
+	NewMsgHandler(0).AddRouter(HeartbeatMsgId, &BaseRouter{})
+}
+
+func TestHeartbeatPongDoesNotBlockReader(t *testing.T) {
+	c, _, _ := newPipeConnection(t, callOption().SetSendQueue(2, SendQueueBlock))
+	fillQueue(t, c)
+
+	// 对方不读取数据、发送队列已满时，回复pong不能阻塞读goroutine
+	done := make(chan struct{})
+	go func() {
+		c.handleHeartbeat(NewMessage(HeartbeatMsgId, heartbeatPing))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pong blocked the reader on a full send queue")
+	}
+}
@@ -1,6 +1,11 @@
 package etcp
 
-import "net"
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"net"
+)
 
 type IServer interface {
 
@@ -10,14 +15,27 @@ type IServer interface {
 	// Stop 停止服务器
 	Stop()
 
-	// Serve 运行服务器
+	// Serve 运行服务器，阻塞直到服务器被Stop或Shutdown
 	Serve()
 
+	// Shutdown 优雅地关闭服务器：不再接受新连接和新请求，等待处理中的请求完成、
+	// 缓冲中的消息发送完之后关闭全部连接并停止worker。ctx结束时立即强制关闭并返回ctx.Err()
+	Shutdown(ctx context.Context) error
+
 	// AddRouter 路由功能，给当前的服务器注册一个路由方法，供客户端的连接处理使用
 	AddRouter(msgId uint32, router IRouter)
 
 	AddRouters(routers map[uint32]IRouter)
 
+	// Use 添加包装所有消息处理的中间件，例如鉴权、日志、限流、监控
+	Use(middlewares ...Middleware)
+
+	// Group 创建路由组，组内注册的路由额外经过组的中间件
+	Group(middlewares ...Middleware) *RouteGroup
+
+	// SetOnError 设置处理消息出错时的Hook函数，包括IErrorRouter返回的错误和恢复的panic(*PanicError)
+	SetOnError(func(request IRequest, err error))
+
 	//得到链接管理
 	GetConnMgr() IConnManager
 
@@ -29,6 +47,10 @@ type IServer interface {
 	CallOnConnStart(conn IConnection)
 	//调用连接OnConnStop Hook函数
 	CallOnConnStop(conn IConnection)
+	//设置该Server的连接因不活跃(对方失联或超过IdleTimeout)而关闭时的Hook函数
+	SetOnConnIdle(func(IConnection))
+	//调用连接OnConnIdle Hook函数
+	CallOnConnIdle(conn IConnection)
 
 	// 获取配置的拷贝
 	Option() Option
@@ -42,9 +64,15 @@ type IConnection interface {
 	// Stop 停止连接
 	Stop()
 
-	// GetTCPConn 获取当前连接绑定的socket
+	// GetTCPConn 获取当前连接绑定的socket，TLS连接为其下层的TCP套接字
 	GetTCPConn() *net.TCPConn
 
+	// NetConn 获取当前连接，TLS连接为*tls.Conn
+	NetConn() net.Conn
+
+	// PeerCertificate 获取对方的证书，不是TLS连接或对方没有提供证书时为nil
+	PeerCertificate() *x509.Certificate
+
 	// GetConnID 获取当前连接的ID
 	GetConnID() uint32
 
@@ -57,6 +85,18 @@ type IConnection interface {
 	// SendBuffMsg 带缓冲发送数据
 	SendBuffMsg(msgId uint32, data []byte) error
 
+	// ReplyMsg 发送对请求requestId的响应
+	ReplyMsg(requestId uint32, msgId uint32, data []byte) error
+
+	// TrySend 不等待地把消息放入发送队列，队列已满时返回ErrQueueFull
+	TrySend(msgId uint32, data []byte) error
+
+	// SendContext 把消息放入发送队列，队列已满时等待直到ctx结束
+	SendContext(ctx context.Context, msgId uint32, data []byte) error
+
+	// SendQueueStats 获取发送队列的统计
+	SendQueueStats() SendQueueStats
+
 	//设置链接属性
 	SetProperty(key string, value interface{})
 	//获取链接属性
@@ -78,6 +118,15 @@ type IRouter interface {
 	PostHandle(r IRequest)
 }
 
+// IErrorRouter 处理时可以返回错误的路由，MsgHandler调用HandleError代替Handle。
+// 返回的错误交给OnError，对方在等待响应时还会收到错误帧
+type IErrorRouter interface {
+	IRouter
+
+	// HandleError 处理conn业务的主方法，返回处理中的错误
+	HandleError(r IRequest) error
+}
+
 // IMessage 将请求的一个消息封装到message中，定义抽象层接口
 type IMessage interface {
 
@@ -88,8 +137,17 @@ type IMessage interface {
 	// GetData 获取消息内容
 	GetData() []byte
 
+	// GetRequestId 获取请求ID，0表示不需要响应
+	GetRequestId() uint32
+
 	// SetMsgId 设置消息ID
 	SetMsgId(uint32)
+	// SetRequestId 设置请求ID
+	SetRequestId(uint32)
+	// GetFlags 获取消息的标志位
+	GetFlags() uint8
+	// SetFlags 设置消息的标志位
+	SetFlags(uint8)
 	// 设置消息数据段长度
 	SetDataLen(uint32)
 	// 设置消息内容
@@ -107,6 +165,12 @@ type IRequest interface {
 
 	// GetMsgId 获取消息Id
 	GetMsgId() uint32
+
+	// GetRequestId 获取请求ID，0表示对方不等待响应
+	GetRequestId() uint32
+
+	// Reply 以相同的msgId和请求ID回复对方，对方的Client.Call会收到该响应
+	Reply(data []byte) error
 }
 
 // IMsgHandle 消息管理抽象层
@@ -115,6 +179,10 @@ type IMsgHandler interface{
 	AddRouter(msgId uint32, router IRouter) //为消息添加具体的处理逻辑
 	StartWorkerPool()                       //启动worker工作池
 	SendMsgToTaskQueue(request IRequest)    //将消息交给TaskQueue,由worker进行处理
+	StopWorkerPool(ctx context.Context) error //关闭任务队列，等待已经收到的消息处理完
+	Use(middlewares ...Middleware)            //添加全局中间件
+	Group(middlewares ...Middleware) *RouteGroup //创建路由组
+	SetOnError(func(request IRequest, err error)) //设置处理消息出错(包括panic)时的Hook函数
 }
 
 // IConnManager 连接管理抽象层
@@ -124,6 +192,25 @@ type IConnManager interface {
 	Get(connID uint32) (IConnection, error) //利用ConnID获取链接
 	Len() int                               //获取当前连接
 	ClearConn()                             //删除并停止所有链接
+
+	// Range 依次对每个连接调用fn，fn返回false时停止
+	Range(fn func(conn IConnection) bool)
+	// Broadcast 向全部连接发送消息，跳过发送队列已满的连接，返回发送成功的连接数
+	Broadcast(msgId uint32, data []byte) int
+
+	// Join 将连接加入分组(如聊天室)，连接被移除时自动退出所有分组
+	Join(group string, conn IConnection) error
+	// Leave 将连接移出分组
+	Leave(group string, conn IConnection)
+	// GroupMembers 获取分组内的全部连接
+	GroupMembers(group string) []IConnection
+	// SendToGroup 向分组内的全部连接发送消息，返回发送成功的连接数
+	SendToGroup(group string, msgId uint32, data []byte) int
+
+	// IndexProperty 为连接属性key建立索引
+	IndexProperty(key string)
+	// FindByProperty 查找属性key的值等于value的连接，例如按照用户ID查找
+	FindByProperty(key string, value interface{}) []IConnection
 }
 
 // IDataPack 封包数据和拆包数据
@@ -142,6 +229,16 @@ type IDataPack interface{
 	Unpack([]byte)(IMessage, error)
 }
 
+// IStreamDataPack 包头不定长或需要读取数据后才能校验的封包格式。
+// 连接调用ReadMessage从数据流中读取消息；GetHeadLen可以返回0，Unpack接收Pack产生的完整数据包。
+// 同一个实例会被连接的多个goroutine同时使用，实现需要并发安全
+type IStreamDataPack interface {
+	IDataPack
+
+	// ReadMessage 从r中读取一个完整的消息
+	ReadMessage(r *bufio.Reader) (IMessage, error)
+}
+
 
 
 
@@ -0,0 +1,37 @@
+package etcp
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Logger etcp输出运行错误使用的日志接口，*log.Logger满足该接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// discardLogger 丢弃全部日志
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+// logger 当前使用的日志，默认输出到标准错误
+var logger atomic.Value
+
+func init() {
+	logger.Store(Logger(log.New(os.Stderr, "[etcp] ", log.LstdFlags)))
+}
+
+// SetLogger 设置etcp输出运行错误使用的日志，nil表示不输出
+func SetLogger(l Logger) {
+	if l == nil {
+		l = discardLogger{}
+	}
+	logger.Store(l)
+}
+
+// logf 输出一条运行错误
+func logf(format string, v ...interface{}) {
+	logger.Load().(Logger).Printf(format, v...)
+}
@@ -6,6 +6,10 @@ type Message struct {
 	Id      uint32
 	// DataLen 消息数据段长度
 	DataLen uint32
+	// RequestId 请求ID，用于把响应与请求对应起来，0表示不需要响应
+	RequestId uint32
+	// Flags 消息的标志位，只有包头中有标志位的封包格式(如VersionedDataPack)会传输
+	Flags uint8
 	// Data 消息的数据段
 	Data    []byte
 }
@@ -45,7 +49,27 @@ func (msg *Message) SetMsgId(msgId uint32) {
 	msg.Id = msgId
 }
 
+// GetRequestId 获取请求ID
+func (msg *Message) GetRequestId() uint32 {
+	return msg.RequestId
+}
+
+// SetRequestId 设置请求ID
+func (msg *Message) SetRequestId(requestId uint32) {
+	msg.RequestId = requestId
+}
+
 // SetData 设置消息内容
 func (msg *Message) SetData(data []byte) {
 	msg.Data = data
 }
+
+// GetFlags 获取消息的标志位
+func (msg *Message) GetFlags() uint8 {
+	return msg.Flags
+}
+
+// SetFlags 设置消息的标志位
+func (msg *Message) SetFlags(flags uint8) {
+	msg.Flags = flags
+}
@@ -0,0 +1,56 @@
+package etcp
+
+// HandlerFunc 处理一个请求
+type HandlerFunc func(request IRequest)
+
+// Middleware 中间件，包装下一个处理函数。例如：
+//
+//	func logging(next HandlerFunc) HandlerFunc {
+//		return func(r IRequest) {
+//			start := time.Now()
+//			next(r)
+//			log.Printf("msgId=%d cost=%s", r.GetMsgId(), time.Since(start))
+//		}
+//	}
+//
+// 不调用next即终止处理，可用于鉴权、限流等
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// chain 用middlewares由外到内包装handle
+func chain(handle HandlerFunc, middlewares []Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handle = middlewares[i](handle)
+	}
+	return handle
+}
+
+// RouteGroup 路由组，组的中间件只作用于在组内注册的路由，
+// 在MsgHandler全局中间件之内、路由的PreHandle之外执行。子组先执行父组的中间件
+type RouteGroup struct {
+	handler     *MsgHandler
+	parent      *RouteGroup
+	middlewares []Middleware
+}
+
+// Use 为路由组添加中间件，对组内已经注册和之后注册的路由都生效
+func (g *RouteGroup) Use(middlewares ...Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+// Group 创建子路由组
+func (g *RouteGroup) Group(middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{handler: g.handler, parent: g, middlewares: middlewares}
+}
+
+// AddRouter 在路由组内为消息注册路由
+func (g *RouteGroup) AddRouter(msgId uint32, router IRouter) {
+	g.handler.addRouter(msgId, router, g)
+}
+
+// wrap 用路由组及其所有父组的中间件包装handle
+func (g *RouteGroup) wrap(handle HandlerFunc) HandlerFunc {
+	for ; g != nil; g = g.parent {
+		handle = chain(handle, g.middlewares)
+	}
+	return handle
+}
@@ -0,0 +1,126 @@
+package etcp
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordRouter 记录三个阶段的路由
+type recordRouter struct {
+	name  string
+	trace *[]string
+}
+
+func (rr *recordRouter) PreHandle(r IRequest)  { *rr.trace = append(*rr.trace, rr.name+".pre") }
+func (rr *recordRouter) Handle(r IRequest)     { *rr.trace = append(*rr.trace, rr.name) }
+func (rr *recordRouter) PostHandle(r IRequest) { *rr.trace = append(*rr.trace, rr.name+".post") }
+
+// recordMiddleware 在next前后记录名字
+func recordMiddleware(name string, trace *[]string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r IRequest) {
+			*trace = append(*trace, name+">")
+			next(r)
+			*trace = append(*trace, "<"+name)
+		}
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	var trace []string
+	mh := NewMsgHandler(0)
+	mh.Use(recordMiddleware("g1", &trace), recordMiddleware("g2", &trace))
+	mh.AddRouter(1, &recordRouter{"plain", &trace})
+
+	api := mh.Group(recordMiddleware("api", &trace))
+	api.AddRouter(2, &recordRouter{"api", &trace})
+	admin := api.Group(recordMiddleware("admin", &trace))
+	admin.AddRouter(3, &recordRouter{"admin", &trace})
+	// 注册路由之后添加的组中间件同样生效
+	admin.Use(recordMiddleware("audit", &trace))
+
+	// 不调用next的中间件终止处理
+	deny := mh.Group(func(next HandlerFunc) HandlerFunc {
+		return func(r IRequest) {
+			trace = append(trace, "denied")
+		}
+	})
+	deny.AddRouter(4, &recordRouter{"secret", &trace})
+
+	for _, tc := range []struct {
+		msgId uint32
+		want  string
+	}{
+		{1, "g1> g2> plain.pre plain plain.post <g2 <g1"},
+		{2, "g1> g2> api> api.pre api api.post <api <g2 <g1"},
+		{3, "g1> g2> api> admin> audit> admin.pre admin admin.post <audit <admin <api <g2 <g1"},
+		{4, "g1> g2> denied <g2 <g1"},
+		// 没有路由的消息也经过全局中间件
+		{5, "g1> g2> <g2 <g1"},
+	} {
+		trace = nil
+		mh.DoMsgHandler(NewRequest(nil, NewMessage(tc.msgId, nil)))
+		if got := strings.Join(trace, " "); got != tc.want {
+			t.Errorf("msgId %d: got %q, want %q", tc.msgId, got, tc.want)
+		}
+	}
+}
+
+func TestServerUse(t *testing.T) {
+	seen := make(chan uint32, 10)
+	_, addr := startTestServer(t, func(s IServer) {
+		s.Use(func(next HandlerFunc) HandlerFunc {
+			return func(r IRequest) {
+				seen <- r.GetMsgId()
+				next(r)
+			}
+		})
+		// 鉴权组：没有令牌的请求得到空响应
+		auth := s.Group(func(next HandlerFunc) HandlerFunc {
+			return func(r IRequest) {
+				if string(r.GetData()) != "token" {
+					r.Reply(nil)
+					return
+				}
+				next(r)
+			}
+		})
+		auth.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			r.Reply([]byte("secret"))
+		}})
+		s.AddRouter(2, &funcRouter{handle: func(r IRequest) {
+			r.Reply([]byte("public"))
+		}})
+	})
+
+	c := NewClient(callOption())
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []string
+	for _, call := range []struct {
+		msgId uint32
+		data  string
+	}{{1, "token"}, {1, "guess"}, {2, ""}} {
+		resp, err := c.Call(ctx, call.msgId, []byte(call.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(resp.GetData()))
+	}
+	if want := []string{"secret", "", "public"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("responses = %q, want %q", got, want)
+	}
+	for _, want := range []uint32{1, 1, 2} {
+		if msgId := <-seen; msgId != want {
+			t.Fatalf("global middleware saw msgId %d, want %d", msgId, want)
+		}
+	}
+}
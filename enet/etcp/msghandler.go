@@ -1,10 +1,17 @@
 package etcp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"strconv"
+	"sync"
 )
 
+// ErrHandlerStopped 工作池停止后仍有消息交给MsgHandler
+var ErrHandlerStopped = errors.New("msg handler stopped")
+
 // MsgHandle 消息管理（多路由）
 type MsgHandler struct{
 	// Apis 存放每个MsgId 所对应的处理方法的map属性
@@ -18,6 +25,21 @@ type MsgHandler struct{
 	TaskQueue      []chan IRequest
 
 	MaxWorkerTaskLen uint32
+
+	// inflight 已经交给worker或单独goroutine但还没有处理完的消息
+	inflight sync.WaitGroup
+	// poolLock 保护TaskQueue与stopped，StopWorkerPool持写锁关闭队列，SendMsgToTaskQueue持读锁放入消息
+	poolLock sync.RWMutex
+	// stopped StopWorkerPool之后为true，此后的消息不再处理
+	stopped bool
+
+	// middlewares 包装所有消息处理的全局中间件
+	middlewares []Middleware
+	// groups 在路由组中注册的路由所属的组
+	groups map[uint32]*RouteGroup
+
+	// OnError 处理消息出错时的Hook函数，为nil时打印错误
+	OnError func(request IRequest, err error)
 }
 
 // NewMsgHandler 新建消息管理
@@ -26,49 +48,121 @@ func NewMsgHandler(poolSize int) *MsgHandler {
 		Apis:make(map[uint32]IRouter),
 		WorkerPoolSize:uint32(poolSize),
 		TaskQueue:make([]chan IRequest, poolSize),
+		groups:    make(map[uint32]*RouteGroup),
 	}
 }
 
-// DoMsgHandler 马上以非阻塞方式处理消息
+// DoMsgHandler 马上以非阻塞方式处理消息，依次经过全局中间件、路由组中间件和路由。
+// 处理中的panic被恢复，作为*PanicError交给OnError
 func (mh *MsgHandler) DoMsgHandler(request IRequest)  {
+	defer func() {
+		if v := recover(); v != nil {
+			mh.handleError(request, &PanicError{Value: v, Stack: debug.Stack()})
+		}
+	}()
+	chain(mh.route, mh.middlewares)(request)
+}
+
+// handleError 将错误交给OnError，对方在等待响应时回复错误帧
+func (mh *MsgHandler) handleError(request IRequest, err error) {
+	if mh.OnError != nil {
+		mh.OnError(request, err)
+	} else {
+		logf("handle msgId = %d error: %s", request.GetMsgId(), err)
+	}
+
+	if request.GetRequestId() == 0 || request.GetConn() == nil {
+		return
+	}
+	message := err.Error()
+	if _, ok := err.(*PanicError); ok {
+		message = panicErrorMessage
+	}
+	request.GetConn().ReplyMsg(request.GetRequestId(), ErrorMsgId, []byte(message))
+}
+
+// SetOnError 设置处理消息出错时的Hook函数
+func (mh *MsgHandler) SetOnError(hookFunc func(request IRequest, err error)) {
+	mh.OnError = hookFunc
+}
+
+// route 找到消息对应的路由并处理
+func (mh *MsgHandler) route(request IRequest) {
 	handler, ok := mh.Apis[request.GetMsgId()]
 	if !ok {
-		fmt.Println("api msgId = ", request.GetMsgId(), " is not FOUND!")
+		if request.GetRequestId() != 0 {
+			// 对方在等待响应，回复错误帧，避免Call一直阻塞到超时
+			mh.handleError(request, fmt.Errorf("api msgId = %d is not found", request.GetMsgId()))
+			return
+		}
+		logf("api msgId = %d is not found", request.GetMsgId())
 		return
 	}
 
 	//执行对应处理方法
-	handler.PreHandle(request)
-	handler.Handle(request)
-	handler.PostHandle(request)
+	handle := func(request IRequest) {
+		handler.PreHandle(request)
+		if errorRouter, ok := handler.(IErrorRouter); ok {
+			if err := errorRouter.HandleError(request); err != nil {
+				mh.handleError(request, err)
+			}
+		} else {
+			handler.Handle(request)
+		}
+		handler.PostHandle(request)
+	}
+	mh.groups[request.GetMsgId()].wrap(handle)(request)
+}
+
+// Use 添加全局中间件，对所有消息生效，应当在开始处理消息前调用
+func (mh *MsgHandler) Use(middlewares ...Middleware) {
+	mh.middlewares = append(mh.middlewares, middlewares...)
+}
+
+// Group 创建路由组，在组内注册的路由额外经过组的中间件
+func (mh *MsgHandler) Group(middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{handler: mh, middlewares: middlewares}
 }
 
 // AddRouter 为消息添加具体的处理逻辑
 func (mh *MsgHandler) AddRouter(msgId uint32, router IRouter) {
-	//1 判断当前msg绑定的API处理方法是否已经存在
+	mh.addRouter(msgId, router, nil)
+}
+
+// addRouter 为消息添加路由，group不为nil时路由属于该路由组
+func (mh *MsgHandler) addRouter(msgId uint32, router IRouter, group *RouteGroup) {
+	//1 判断当前msg绑定的API处理方法是否已经存在，心跳与错误帧的消息ID是保留的
+	if msgId == HeartbeatMsgId || msgId == ErrorMsgId {
+		panic("msgId " + strconv.FormatUint(uint64(msgId), 10) + " is reserved")
+	}
 	if _, ok := mh.Apis[msgId]; ok {
 		panic("repeated api , msgId = " + strconv.Itoa(int(msgId)))
 	}
 	//2 添加msg与api的绑定关系
 	mh.Apis[msgId] = router
+	if group != nil {
+		mh.groups[msgId] = group
+	}
 	fmt.Println("Add api msgId = ", msgId)
 }
 
 //启动一个Worker工作流程
 func (mh *MsgHandler) StartOneWorker(workerID int, taskQueue chan IRequest) {
 	fmt.Println("Worker ID = ", workerID, " is started.")
-	//不断的等待队列中的消息
-	for {
-		select {
+	//不断的等待队列中的消息，直到队列被StopWorkerPool关闭
+	for request := range taskQueue {
 		//有消息则取出队列的Request，并执行绑定的业务方法
-		case request := <-taskQueue:
-			mh.DoMsgHandler(request)
-		}
+		mh.DoMsgHandler(request)
+		mh.inflight.Done()
 	}
+	fmt.Println("Worker ID = ", workerID, " is stopped.")
 }
 
 //启动worker工作池
 func (mh *MsgHandler) StartWorkerPool() {
+	mh.poolLock.Lock()
+	defer mh.poolLock.Unlock()
+	mh.stopped = false
 	//遍历需要启动worker的数量，依此启动
 	for i:= 0; i < int(mh.WorkerPoolSize); i++ {
 		//一个worker被启动
@@ -79,14 +173,63 @@ func (mh *MsgHandler) StartWorkerPool() {
 	}
 }
 
-//将消息交给TaskQueue,由worker进行处理
+// StopWorkerPool 关闭任务队列，等待已经收到的消息全部处理完、worker退出。
+// 之后交给SendMsgToTaskQueue的消息以ErrHandlerStopped拒绝；ctx结束时不再等待，返回ctx.Err()
+func (mh *MsgHandler) StopWorkerPool(ctx context.Context) error {
+	mh.poolLock.Lock()
+	mh.stopped = true
+	for i, taskQueue := range mh.TaskQueue {
+		if taskQueue != nil {
+			close(taskQueue)
+			mh.TaskQueue[i] = nil
+		}
+	}
+	mh.poolLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		mh.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//将消息交给TaskQueue,由worker进行处理；没有启动工作池时单开goroutine处理。
+//StopWorkerPool之后的消息交给OnError，对方在等待响应时回复错误帧
 func (mh *MsgHandler)SendMsgToTaskQueue(request IRequest) {
+	if !mh.dispatch(request) {
+		mh.handleError(request, ErrHandlerStopped)
+	}
+}
+
+// dispatch 持读锁把消息交给worker，工作池已经停止时返回false
+func (mh *MsgHandler) dispatch(request IRequest) bool {
+	mh.poolLock.RLock()
+	defer mh.poolLock.RUnlock()
+	if mh.stopped {
+		return false
+	}
+
+	mh.inflight.Add(1)
+	if mh.WorkerPoolSize == 0 {
+		go func() {
+			defer mh.inflight.Done()
+			mh.DoMsgHandler(request)
+		}()
+		return true
+	}
+
 	//根据ConnID来分配当前的连接应该由哪个worker负责处理
 	//轮询的平均分配法则
 
 	//得到需要处理此条连接的workerID
 	workerID := request.GetConn().GetConnID() % mh.WorkerPoolSize
-	fmt.Println("Add ConnID=", request.GetConn().GetConnID()," request msgID=", request.GetMsgId(), "to workerID=", workerID)
 	//将请求消息发送给任务队列
 	mh.TaskQueue[workerID] <- request
+	return true
 }
\ No newline at end of file
@@ -1,5 +1,10 @@
 package etcp
 
+import (
+	"crypto/tls"
+	"time"
+)
+
 // Option 服务器配置选项
 type Option struct {
 
@@ -29,6 +34,42 @@ type Option struct {
 
 	// MaxWorkerTaskLen 业务工作Worker对应负责的任务队列最大任务存储数量
 	MaxWorkerTaskLen uint32
+
+	// TLSConfig 不为nil时使用TLS加密连接。
+	// 服务端需要设置Certificates，要求客户端证书时设置ClientAuth与ClientCAs；
+	// 客户端按需设置RootCAs与用于双向认证的Certificates，ServerName为空时使用Dial的主机名
+	TLSConfig *tls.Config
+
+	// HeartbeatInterval 发送心跳的间隔，0表示不发送。对方收到心跳会回复，所以一端发送即可
+	HeartbeatInterval time.Duration
+
+	// ReadTimeout 等待下一个消息(包括心跳)的最长时间，超时认为对方已经失联并关闭连接，0表示不限制。
+	// 应当大于心跳间隔
+	ReadTimeout time.Duration
+
+	// WriteTimeout 写一个消息的最长时间，0表示不限制
+	WriteTimeout time.Duration
+
+	// IdleTimeout 没有收发业务消息(心跳不算)的最长时间，超时后关闭连接，0表示不限制
+	IdleTimeout time.Duration
+
+	// DataPack 创建连接使用的封包格式，参数为MaxPacketSize，nil表示默认格式(与旧版本兼容，不传输RequestId)。
+	// 可以直接使用NewBigEndianDataPack、NewVarintDataPack、NewLineDataPack、NewVersionedDataPack等，
+	// 通信的两端必须使用相同的格式。使用Client.Call时需要能传输RequestId的格式，如NewVersionedDataPack
+	DataPack func(maxPacketSize int) IDataPack
+
+	// Compressor 发送消息使用的压缩算法，nil表示不压缩。需要包头中有标志位的封包格式(如NewVersionedDataPack)
+	Compressor Compressor
+
+	// CompressThreshold 数据不小于该长度时才压缩
+	CompressThreshold int
+
+	// SendQueueSize 每个连接发送队列(SendBuffMsg使用的缓冲)的容量，0表示使用MaxWorkerTaskLen
+	SendQueueSize int
+
+	// SendQueuePolicy 发送队列已满时的处理策略。
+	// 不是SendQueueBlock时SendMsg与回复也进入发送队列，对方再慢也不会阻塞处理消息的worker
+	SendQueuePolicy SendQueuePolicy
 }
 
 func DefaultOption() *Option {
@@ -79,3 +120,63 @@ func (op *Option) SetMax(size int) *Option {
 	op.MaxWorkerTaskLen = uint32(size)
 	return op
 }
+
+func (op *Option) SetTLSConfig(config *tls.Config) *Option {
+	op.TLSConfig = config
+	return op
+}
+
+func (op *Option) SetDataPack(factory func(maxPacketSize int) IDataPack) *Option {
+	op.DataPack = factory
+	return op
+}
+
+// SetCompression 数据不小于threshold的消息使用compressor压缩
+func (op *Option) SetCompression(compressor Compressor, threshold int) *Option {
+	op.Compressor = compressor
+	op.CompressThreshold = threshold
+	return op
+}
+
+// SetSendQueue 设置每个连接发送队列的容量与队列已满时的处理策略
+func (op *Option) SetSendQueue(size int, policy SendQueuePolicy) *Option {
+	op.SendQueueSize = size
+	op.SendQueuePolicy = policy
+	return op
+}
+
+// sendQueueSize 每个连接发送队列的容量
+func (op *Option) sendQueueSize() int {
+	if op.SendQueueSize > 0 {
+		return op.SendQueueSize
+	}
+	return int(op.MaxWorkerTaskLen)
+}
+
+// NewDataPack 按照配置创建封包格式
+func (op *Option) NewDataPack() IDataPack {
+	if op.DataPack == nil {
+		return NewDataPack(int(op.MaxPacketSize))
+	}
+	return op.DataPack(int(op.MaxPacketSize))
+}
+
+func (op *Option) SetHeartbeatInterval(interval time.Duration) *Option {
+	op.HeartbeatInterval = interval
+	return op
+}
+
+func (op *Option) SetReadTimeout(timeout time.Duration) *Option {
+	op.ReadTimeout = timeout
+	return op
+}
+
+func (op *Option) SetWriteTimeout(timeout time.Duration) *Option {
+	op.WriteTimeout = timeout
+	return op
+}
+
+func (op *Option) SetIdleTimeout(timeout time.Duration) *Option {
+	op.IdleTimeout = timeout
+	return op
+}
@@ -25,6 +25,16 @@ func (r *Request) GetMsgId() uint32 {
 	return r.msg.GetMsgId()
 }
 
+// GetRequestId 获取请求ID
+func (r *Request) GetRequestId() uint32 {
+	return r.msg.GetRequestId()
+}
+
+// Reply 回复当前请求
+func (r *Request) Reply(data []byte) error {
+	return r.conn.ReplyMsg(r.GetRequestId(), r.GetMsgId(), data)
+}
+
 // NewRequest 新建请求
 func NewRequest(conn IConnection, msg IMessage) IRequest {
 	return &Request{
@@ -14,3 +14,18 @@ func (br *BaseRouter) Handle(r IRequest) {}
 
 // PostHandle 处理conn业务之后的钩子方法(Hook)
 func (br *BaseRouter) PostHandle(r IRequest) {}
+
+// ErrorHandlerFunc 返回错误的处理函数，实现了IErrorRouter，可以直接注册为路由
+type ErrorHandlerFunc func(r IRequest) error
+
+// PreHandle 什么也不做
+func (f ErrorHandlerFunc) PreHandle(r IRequest) {}
+
+// Handle 调用f并忽略错误，MsgHandler会改为调用HandleError
+func (f ErrorHandlerFunc) Handle(r IRequest) { f(r) }
+
+// PostHandle 什么也不做
+func (f ErrorHandlerFunc) PostHandle(r IRequest) {}
+
+// HandleError 调用f
+func (f ErrorHandlerFunc) HandleError(r IRequest) error { return f(r) }
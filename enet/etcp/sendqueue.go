@@ -0,0 +1,109 @@
+package etcp
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQueueFull 连接的发送队列已满
+var ErrQueueFull = errors.New("send queue full")
+
+// SendQueuePolicy 发送队列已满时的处理策略
+type SendQueuePolicy int
+
+const (
+	// SendQueueBlock 等待队列有空位，SendMsg等待写goroutine取走消息。默认策略
+	SendQueueBlock SendQueuePolicy = iota
+	// SendQueueDrop 丢弃新消息并返回ErrQueueFull
+	SendQueueDrop
+	// SendQueueClose 认为对方太慢，关闭连接并返回ErrQueueFull
+	SendQueueClose
+)
+
+// SendQueueStats 连接发送队列的统计
+type SendQueueStats struct {
+	// Depth 队列中等待发送的消息数
+	Depth int
+	// Capacity 队列容量
+	Capacity int
+	// HighWater 队列曾经达到的最大深度
+	HighWater int
+	// Sent 已经写出的消息数
+	Sent uint64
+	// Dropped 因队列已满而没有发送的消息数
+	Dropped uint64
+}
+
+// TrySend 不等待地把消息放入发送队列，队列已满时返回ErrQueueFull
+func (c *Connection) TrySend(msgId uint32, data []byte) error {
+	packet, err := c.pack(NewMessage(msgId, data))
+	if err != nil {
+		return err
+	}
+	return c.enqueue(nil, packet, SendQueueDrop)
+}
+
+// SendContext 把消息放入发送队列，队列已满时等待直到ctx结束
+func (c *Connection) SendContext(ctx context.Context, msgId uint32, data []byte) error {
+	packet, err := c.pack(NewMessage(msgId, data))
+	if err != nil {
+		return err
+	}
+	return c.enqueue(ctx, packet, SendQueueBlock)
+}
+
+// SendQueueStats 获取发送队列的统计
+func (c *Connection) SendQueueStats() SendQueueStats {
+	return SendQueueStats{
+		Depth:     len(c.msgBuffChan),
+		Capacity:  cap(c.msgBuffChan),
+		HighWater: int(atomic.LoadInt64(&c.queueHighWater)),
+		Sent:      atomic.LoadUint64(&c.sentCount),
+		Dropped:   atomic.LoadUint64(&c.droppedCount),
+	}
+}
+
+// enqueue 把封包后的数据放入发送队列。
+// ctx不为nil时等待空位直到ctx结束；为nil时不等待，队列已满按照policy处理
+func (c *Connection) enqueue(ctx context.Context, packet []byte, policy SendQueuePolicy) error {
+	if ctx == nil {
+		select {
+		case c.msgBuffChan <- packet:
+			c.recordDepth()
+			return nil
+		case <-c.ExitChan:
+			return ErrConnClosed
+		default:
+		}
+
+		atomic.AddUint64(&c.droppedCount, 1)
+		if policy == SendQueueClose {
+			// 直接关闭socket，让阻塞在对方身上的写goroutine立即失败，读goroutine随之停止连接
+			c.Conn.Close()
+		}
+		return ErrQueueFull
+	}
+
+	select {
+	case c.msgBuffChan <- packet:
+		c.recordDepth()
+		return nil
+	case <-c.ExitChan:
+		return ErrConnClosed
+	case <-ctx.Done():
+		atomic.AddUint64(&c.droppedCount, 1)
+		return ctx.Err()
+	}
+}
+
+// recordDepth 更新队列的最大深度
+func (c *Connection) recordDepth() {
+	depth := int64(len(c.msgBuffChan))
+	for {
+		high := atomic.LoadInt64(&c.queueHighWater)
+		if depth <= high || atomic.CompareAndSwapInt64(&c.queueHighWater, high, depth) {
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package etcp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPipeConnection 在net.Pipe上建立连接，返回连接与不读取数据的对方
+func newPipeConnection(t *testing.T, opts *Option) (*Connection, net.Conn, *Client) {
+	local, peer := net.Pipe()
+	owner := NewClient(opts)
+	c := newConnection(owner, local, 1, owner.MsgHandler)
+	c.Start()
+	t.Cleanup(func() {
+		peer.Close()
+		c.Stop()
+	})
+	return c, peer, owner
+}
+
+// fillQueue 等写goroutine阻塞在对方身上后用TrySend填满发送队列，返回放入的消息数
+func fillQueue(t *testing.T, c *Connection) int {
+	if err := c.TrySend(1, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.SendQueueStats().Depth != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("writer did not take the first message")
+		}
+	}
+	for n := 1; n < 100; n++ {
+		if err := c.TrySend(1, []byte("data")); err == ErrQueueFull {
+			return n
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("send queue never filled")
+	return 0
+}
+
+func TestSendQueueBackpressure(t *testing.T) {
+	c, peer, _ := newPipeConnection(t, DefaultOption().SetSendQueue(2, SendQueueBlock))
+
+	// 写goroutine阻塞在对方身上，再放入队列容量个消息后队列已满
+	sent := fillQueue(t, c)
+	if sent != 3 {
+		t.Fatalf("TrySend accepted %d messages with queue size 2", sent)
+	}
+	stats := c.SendQueueStats()
+	if stats.Depth != 2 || stats.Capacity != 2 || stats.HighWater != 2 || stats.Dropped != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.SendContext(ctx, 1, nil); err != context.DeadlineExceeded {
+		t.Fatalf("SendContext on full queue = %v", err)
+	}
+
+	// 对方开始读取后，队列中的消息全部写出
+	reader := bufio.NewReader(peer)
+	for i := 0; i < sent; i++ {
+		if _, err := readMessage(c.dp, reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.SendQueueStats().Sent != uint64(sent); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats after drain = %+v", c.SendQueueStats())
+		}
+	}
+	if err := c.SendContext(context.Background(), 1, nil); err != nil {
+		t.Fatalf("SendContext after drain = %v", err)
+	}
+}
+
+func TestSendQueueDropPolicy(t *testing.T) {
+	c, _, _ := newPipeConnection(t, DefaultOption().SetSendQueue(2, SendQueueDrop))
+	fillQueue(t, c)
+
+	// SendMsg与SendBuffMsg都不再阻塞
+	done := make(chan error, 2)
+	go func() {
+		done <- c.SendMsg(1, nil)
+		done <- c.SendBuffMsg(1, nil)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != ErrQueueFull {
+				t.Fatalf("send on full queue = %v, want ErrQueueFull", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("send blocked under SendQueueDrop")
+		}
+	}
+	if stats := c.SendQueueStats(); stats.Dropped != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestSendQueueClosePolicy(t *testing.T) {
+	c, _, owner := newPipeConnection(t, DefaultOption().SetSendQueue(2, SendQueueClose))
+	stopped := make(chan struct{})
+	owner.SetOnConnStop(func(IConnection) {
+		close(stopped)
+	})
+	fillQueue(t, c)
+	if err := c.SendMsg(1, nil); err != ErrQueueFull {
+		t.Fatalf("SendMsg on full queue = %v, want ErrQueueFull", err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow connection not closed under SendQueueClose")
+	}
+	if err := c.SendMsg(1, nil); err != ErrConnClosed {
+		t.Fatalf("SendMsg after close = %v, want ErrConnClosed", err)
+	}
+}
+
+func TestSendAfterStop(t *testing.T) {
+	c, peer, _ := newPipeConnection(t, DefaultOption())
+	peer.Close()
+	c.Stop()
+
+	for name, send := range map[string]func() error{
+		"SendMsg":     func() error { return c.SendMsg(1, nil) },
+		"SendBuffMsg": func() error { return c.SendBuffMsg(1, nil) },
+		"ReplyMsg":    func() error { return c.ReplyMsg(1, 1, nil) },
+		"TrySend":     func() error { return c.TrySend(1, nil) },
+		"SendContext": func() error { return c.SendContext(context.Background(), 1, nil) },
+	} {
+		if err := send(); err != ErrConnClosed {
+			t.Fatalf("%s after Stop = %v, want ErrConnClosed", name, err)
+		}
+	}
+}
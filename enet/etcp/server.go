@@ -1,8 +1,12 @@
 package etcp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 )
 
 // Server iface.IServer接口的一个实现
@@ -21,6 +25,19 @@ type Server struct {
 	OnConnStart func(conn IConnection)
 	//该Server的连接断开时的Hook函数
 	OnConnStop func(conn IConnection)
+	//该Server的连接因不活跃而关闭时的Hook函数，之后还会调用OnConnStop
+	OnConnIdle func(conn IConnection)
+
+	// listener 监听套接字，Shutdown时关闭以停止接受新连接
+	listener *net.TCPListener
+	// started、closing 服务器状态
+	started bool
+	closing bool
+	lock    sync.Mutex
+	// acceptDone 接受连接的goroutine退出时关闭
+	acceptDone chan struct{}
+	// done 服务器关闭后关闭，Serve随之返回
+	done chan struct{}
 }
 
 // NewServer 新建一个Server
@@ -30,6 +47,8 @@ func NewServer(opts *Option) IServer {
 		Opts:opts,
 		MsgHandler: NewMsgHandler(int(opts.WorkerPoolSize)),
 		ConnMgr:NewConnManager(),
+		acceptDone: make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
@@ -41,26 +60,51 @@ func (s *Server) Start() {
 		s.Opts.MaxConn,
 		s.Opts.MaxPacketSize)
 
+	if err := checkCompression(s.Opts, s.Opts.NewDataPack()); err != nil {
+		s.startFailed(fmt.Sprintf("Start: %s", err))
+		return
+	}
+
+	s.lock.Lock()
+	if s.started || s.closing {
+		s.lock.Unlock()
+		fmt.Println("Start: server already started or closed")
+		return
+	}
+	s.started = true
+	s.lock.Unlock()
+
+	// 0. 启动 worker 工作池机制
+	s.MsgHandler.StartWorkerPool()
+
 	// 异步启动，避免阻塞主线程
 	go func() {
-
-		// 0. 启动 worker 工作池机制
-		s.MsgHandler.StartWorkerPool()
+		defer close(s.acceptDone)
 
 		// 1. 获取一个TCP Addr
 		addr, err := net.ResolveTCPAddr(s.Opts.IPVersion, fmt.Sprintf("%s:%d", s.Opts.Host, s.Opts.TcpPort))
 		if err != nil {
-			fmt.Printf("Start: resolving tcp addr err: %s\n", err)
+			s.startFailed(fmt.Sprintf("Start: resolving tcp addr err: %s", err))
 			return
 		}
 
 		// 2. 监听服务器地址
 		listener, err := net.ListenTCP(s.Opts.IPVersion, addr)
 		if err != nil {
-			fmt.Printf("Start listen %s err: %s\n", s.Opts.IPVersion, err)
+			s.startFailed(fmt.Sprintf("Start listen %s err: %s", s.Opts.IPVersion, err))
 			return
 		}
 
+		// 启动过程中已经开始关闭
+		s.lock.Lock()
+		if s.closing {
+			s.lock.Unlock()
+			listener.Close()
+			return
+		}
+		s.listener = listener
+		s.lock.Unlock()
+
 		fmt.Printf("[Start] Server starts listening at IP: %s, Port: %d successful\n", s.Opts.Host, s.Opts.TcpPort)
 
 		// TODO: 添加一个自动生成ID的方法
@@ -71,6 +115,9 @@ func (s *Server) Start() {
 			// 如果有客户端连接，则阻塞会返回，往下执行
 			conn, err := listener.AcceptTCP()
 			if err != nil {
+				if s.isClosing() {
+					return
+				}
 				fmt.Printf("Start: Listener AcceptTCP: %s\n", err)
 				continue
 			}
@@ -85,7 +132,11 @@ func (s *Server) Start() {
 
 			// 将处理当前连接的业务方法和conn进行绑定，得到我们的连接模块
 			// dealConn := NewConnection(conn, connID, s.MsgHandler)
-			dealConn := NewConnection(s, conn, connID, s.MsgHandler)
+			var netConn net.Conn = conn
+			if s.Opts.TLSConfig != nil {
+				netConn = tls.Server(conn, s.Opts.TLSConfig)
+			}
+			dealConn := NewConnection(s, netConn, connID, s.MsgHandler)
 			connID++
 			// 尝试启动连接模块
 			go dealConn.Start()
@@ -93,24 +144,125 @@ func (s *Server) Start() {
 	}()
 }
 
-// Stop 停止
+// startFailed 启动失败时打印原因并关闭服务器，使Serve返回而不是一直阻塞。
+// 在接受连接的goroutine中调用时，Shutdown要等待该goroutine退出，因此在后台执行
+func (s *Server) startFailed(reason string) {
+	fmt.Println(reason)
+	go s.Shutdown(context.Background())
+}
+
+// Stop 立即停止，不等待处理中的请求
 func (s *Server) Stop() {
 	fmt.Printf("[STOP] server %s\n", s.Opts.Name)
 
-	// TODO: 将服务器的资源、状态或者已经建立的连接等等进行停止或回收
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+// Shutdown 优雅地关闭服务器：
+// 1. 关闭监听套接字，不再接受新连接；
+// 2. 各连接不再读取新的请求；
+// 3. 等待已经收到的请求处理完，停止worker；
+// 4. 发送完各连接缓冲中的消息后关闭连接。
+// ctx结束时不再等待，立即关闭全部连接并返回ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return errors.New("server already closed")
+	}
+	s.closing = true
+	started := s.started
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.lock.Unlock()
+
+	// 无论是否等到请求处理完，最后都关闭全部连接并让Serve返回
+	defer close(s.done)
+	if !started {
+		s.ConnMgr.ClearConn()
+		return nil
+	}
 
+	err := s.drain(ctx)
+	conns := s.connections()
 	s.ConnMgr.ClearConn()
+	if err != nil {
+		// 强制关闭后读goroutine会很快退出，之后在后台停止worker
+		go func() {
+			<-s.acceptDone
+			// 接受连接的goroutine退出前可能又加入了新连接
+			conns := append(conns, s.connections()...)
+			s.ConnMgr.ClearConn()
+			for _, conn := range conns {
+				if c, ok := conn.(*Connection); ok {
+					<-c.readerDone
+				}
+			}
+			s.MsgHandler.StopWorkerPool(context.Background())
+		}()
+	}
+	return err
+}
+
+// drain 等待接受连接的goroutine退出，让各连接不再读取新的请求，再等待已经收到的请求处理完
+func (s *Server) drain(ctx context.Context) error {
+	if err := waitDone(ctx, s.acceptDone); err != nil {
+		return err
+	}
+
+	// 已经接受的连接不再读取新的请求
+	var readers []<-chan struct{}
+	for _, conn := range s.connections() {
+		if c, ok := conn.(*Connection); ok {
+			readers = append(readers, c.drain())
+		}
+	}
+	for _, readerDone := range readers {
+		if err := waitDone(ctx, readerDone); err != nil {
+			return err
+		}
+	}
+
+	// 此时不会再有新的请求，等待已经收到的请求处理完
+	return s.MsgHandler.StopWorkerPool(ctx)
+}
+
+// connections 当前全部连接
+func (s *Server) connections() []IConnection {
+	if connMgr, ok := s.ConnMgr.(*ConnManager); ok {
+		return connMgr.list()
+	}
+	return nil
+}
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// waitDone 等待done关闭或ctx结束
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// Serve 运行
+// Serve 运行，阻塞直到服务器被Stop或Shutdown
 func (s *Server) Serve() {
 	// 启动server服务功能
 	s.Start()
 
 	// TODO: 可以做一些服务器启动之后的额外业务
 
-	// 阻塞状态
-	select {}
+	// 阻塞直到服务器关闭
+	<-s.done
 }
 
 // AddRouter 添加路由
@@ -127,6 +279,21 @@ func (s *Server) AddRouters(routers map[uint32]IRouter) {
 	fmt.Println("Add Routers Successfully!")
 }
 
+// Use 添加包装所有消息处理的中间件，先添加的在外层
+func (s *Server) Use(middlewares ...Middleware) {
+	s.MsgHandler.Use(middlewares...)
+}
+
+// Group 创建路由组，组内注册的路由额外经过组的中间件
+func (s *Server) Group(middlewares ...Middleware) *RouteGroup {
+	return s.MsgHandler.Group(middlewares...)
+}
+
+// SetOnError 设置处理消息出错时的Hook函数
+func (s *Server) SetOnError(hookFunc func(request IRequest, err error)) {
+	s.MsgHandler.SetOnError(hookFunc)
+}
+
 //得到链接管理
 func (s *Server) GetConnMgr() IConnManager {
 	return s.ConnMgr
@@ -158,6 +325,19 @@ func (s *Server) CallOnConnStop(conn IConnection) {
 	}
 }
 
+//设置该Server的连接因不活跃而关闭时的Hook函数
+func (s *Server) SetOnConnIdle(hookFunc func(IConnection)) {
+	s.OnConnIdle = hookFunc
+}
+
+//调用连接OnConnIdle Hook函数
+func (s *Server) CallOnConnIdle(conn IConnection) {
+	if s.OnConnIdle != nil {
+		fmt.Println("---> CallOnConnIdle....")
+		s.OnConnIdle(conn)
+	}
+}
+
 // 获取拷贝的配置
 func (s *Server) Option() Option {
 	return *(s.Opts)
@@ -0,0 +1,201 @@
+package etcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	const pushCount = 100
+	started := make(chan struct{})
+	port := freePort(t)
+	s := NewServer(callOption().SetHost("127.0.0.1").SetPort(port))
+	// 1: 处理较慢的请求
+	s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		r.Reply([]byte("done"))
+	}})
+	// 2: 一次写入大量缓冲消息
+	s.AddRouter(2, &funcRouter{handle: func(r IRequest) {
+		for i := 0; i < pushCount; i++ {
+			r.GetConn().SendBuffMsg(3, []byte(fmt.Sprint(i)))
+		}
+	}})
+
+	served := make(chan struct{})
+	go func() {
+		s.Serve()
+		close(served)
+	}()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	pushed := make(chan []byte, pushCount)
+	c := NewClient(callOption())
+	c.AddRouter(3, &funcRouter{handle: func(r IRequest) {
+		pushed <- r.GetData()
+	}})
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if err = c.Dial(addr); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Send(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		msg IMessage
+		err error
+	}
+	called := make(chan result, 1)
+	go func() {
+		msg, err := c.Call(context.Background(), 1, nil)
+		called <- result{msg, err}
+	}()
+	<-started
+
+	// 处理中的请求完成、缓冲中的消息发送完之后才返回
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case res := <-called:
+		if res.err != nil || string(res.msg.GetData()) != "done" {
+			t.Fatalf("in-flight Call = %v, %v", res.msg, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight Call not answered")
+	}
+	for i := 0; i < pushCount; i++ {
+		select {
+		case data := <-pushed:
+			if string(data) != fmt.Sprint(i) {
+				t.Fatalf("pushed message %d = %q", i, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d buffered messages received", i, pushCount)
+		}
+	}
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+	if conn, err := net.Dial("tcp4", addr); err == nil {
+		conn.Close()
+		t.Fatal("server still accepting after Shutdown")
+	}
+	if err = s.Shutdown(ctx); err == nil {
+		t.Fatal("second Shutdown should fail")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, addr := startTestServer(t, func(s IServer) {
+		s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+			<-release
+		}})
+	})
+
+	c := NewClient(callOption())
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), 1, nil)
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// 请求一直没有处理完时，ctx结束后强制关闭连接
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrConnClosed {
+			t.Fatalf("pending Call got %v, want ErrConnClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed by Shutdown")
+	}
+}
+
+func TestServeReturnsWhenStartFails(t *testing.T) {
+	// 端口已被占用，监听失败
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	for name, opts := range map[string]*Option{
+		"listen":      DefaultOption().SetHost("127.0.0.1").SetPort(port),
+		"compression": DefaultOption().SetHost("127.0.0.1").SetPort(freePort(t)).SetCompression(GzipCompressor{}, 0),
+	} {
+		done := make(chan struct{})
+		go func() {
+			NewServer(opts).Serve()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Serve blocked after Start failed", name)
+		}
+	}
+}
+
+func TestStopWorkerPoolRejectsLateMessages(t *testing.T) {
+	c, _, _ := newPipeConnection(t, DefaultOption())
+	mh := NewMsgHandler(2)
+	mh.MaxWorkerTaskLen = 4
+	mh.AddRouter(1, &funcRouter{handle: func(IRequest) {}})
+	rejected := make(chan error, 1000)
+	mh.OnError = func(r IRequest, err error) {
+		rejected <- err
+	}
+	mh.StartWorkerPool()
+
+	// 停止工作池的同时还在交给它消息，不能向已经关闭的队列发送
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			mh.SendMsgToTaskQueue(NewRequest(c, NewMessage(1, nil)))
+		}
+	}()
+	if err := mh.StopWorkerPool(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	mh.SendMsgToTaskQueue(NewRequest(c, NewMessage(1, nil)))
+	if len(rejected) == 0 {
+		t.Fatal("message after StopWorkerPool was not rejected")
+	}
+	for len(rejected) > 0 {
+		if err := <-rejected; err != ErrHandlerStopped {
+			t.Fatalf("late message got %v, want ErrHandlerStopped", err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package etcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA 测试用的证书签发机构
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "etcp test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue 签发一张证书，usage为服务端或客户端用途
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+
+	port := freePort(t)
+	s := NewServer(callOption().SetHost("127.0.0.1").SetPort(port).SetTLSConfig(serverConfig))
+	// 1: 回复对方证书中的名字
+	s.AddRouter(1, &funcRouter{handle: func(r IRequest) {
+		if cert := r.GetConn().PeerCertificate(); cert != nil {
+			r.Reply([]byte(cert.Subject.CommonName))
+		}
+	}})
+	startIdentities := make(chan string, 1)
+	s.SetOnConnStart(func(conn IConnection) {
+		if _, ok := conn.NetConn().(*tls.Conn); !ok {
+			t.Error("server connection is not TLS")
+		}
+		if conn.GetTCPConn() == nil {
+			t.Error("GetTCPConn of TLS connection is nil")
+		}
+		if cert := conn.PeerCertificate(); cert != nil {
+			startIdentities <- cert.Subject.CommonName
+		}
+	})
+	s.Start()
+	defer s.Stop()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	// 提供证书的客户端可以调用，服务端按证书识别身份
+	clientOpts := callOption().SetTLSConfig(&tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+	})
+	c := NewClient(clientOpts)
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if err = c.Dial(addr); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if cert := c.Conn().PeerCertificate(); cert == nil || cert.Subject.CommonName != "server" {
+		t.Fatalf("client sees server certificate %v", cert)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.Call(ctx, 1, nil)
+	if err != nil || string(resp.GetData()) != "alice" {
+		t.Fatalf("Call = %v, %v", resp, err)
+	}
+	select {
+	case name := <-startIdentities:
+		if name != "alice" {
+			t.Fatalf("OnConnStart sees %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer certificate not available in OnConnStart")
+	}
+
+	// 没有证书的客户端被拒绝
+	anonymous := NewClient(callOption().SetTLSConfig(&tls.Config{RootCAs: ca.pool}))
+	if err = anonymous.Dial(addr); err == nil {
+		defer anonymous.Close()
+		if _, err = anonymous.Call(ctx, 1, nil); err == nil {
+			t.Fatal("client without certificate was accepted")
+		}
+	}
+
+	// 不信任服务端证书的客户端握手失败
+	untrusted := NewClient(callOption().SetTLSConfig(&tls.Config{}))
+	if err = untrusted.Dial(addr); err == nil {
+		untrusted.Close()
+		t.Fatal("client accepted an untrusted server certificate")
+	}
+
+	// 明文客户端拿不到响应
+	plain := NewClient(callOption())
+	if err = plain.Dial(addr); err == nil {
+		defer plain.Close()
+		short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if _, err = plain.Call(short, 1, nil); err == nil {
+			t.Fatal("plain client got a response from TLS server")
+		}
+	}
+}
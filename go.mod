@@ -1,9 +1,17 @@
 module github.com/azd1997/ego
 
-go 1.12
+go 1.18
 
 require (
 	github.com/dgraph-io/badger v1.6.0
 	github.com/pkg/errors v0.8.1
+)
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20190306092124-e2d15f34fcf9 // indirect
+	github.com/dgryski/go-farm v0.0.0-20190423205320-6a90982ecee2 // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
 	golang.org/x/net v0.0.0-20190912160710-24e19bdeb0f2 // indirect
+	golang.org/x/sys v0.0.0-20190626221950-04f50cda93cb // indirect
 )